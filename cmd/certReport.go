@@ -0,0 +1,144 @@
+package cmd
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.cicd.cloud.fpdev.io/BD/bd-azure-smc-deployment/lib"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"io/ioutil"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+var certReportCmd = &cobra.Command{
+	Use:   "cert-report",
+	Short: "Report the LDAPS certificates of the deployment and their expiry",
+	Long: `Show the thumbprint, subject, SANs and expiry of the LDAPS certificate of the managed domain,
+of the certificate served on port 636 of the LDAPS external ip address and of the PFX of
+PFX_CERTIFICATE_BASE64 and --pfx-file.
+
+Certificates which differ from the one of the managed domain or which expire within
+CERT_EXPIRY_WINDOW_DAYS are reported as findings and the command exits with 1.
+Use --output json for a JSON document`,
+	Run: func(cmd *cobra.Command, args []string) {
+		pfxFiles, _ := cmd.Flags().GetStringSlice("pfx-file")
+		if err := AzureCLIInstance.Login(); err != nil {
+			logrus.Fatal(err)
+		}
+		report, err := certificateReport(pfxFiles, time.Now())
+		if err := AzureCLIInstance.Logout(); err != nil {
+			logrus.Error(err)
+		}
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		if viper.GetString("OUTPUT") == lib.OutputJSON {
+			encoder := json.NewEncoder(os.Stdout)
+			encoder.SetIndent("", " ")
+			if err := encoder.Encode(report); err != nil {
+				logrus.Fatal(err)
+			}
+		} else {
+			printCertificateReport(report)
+		}
+		if len(report.Findings) != 0 {
+			ReporterInstance.Close()
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(certReportCmd)
+	certReportCmd.Flags().StringSlice("pfx-file", nil,
+		"a PFX protected by PFX_CERTIFICATE_PASSWORD to report as well, the flag can be repeated")
+	certReportCmd.Flags().Int("expiry-window", 0, "the days before the expiry a certificate is reported")
+	if err := viper.BindPFlag("CERT_EXPIRY_WINDOW_DAYS", certReportCmd.Flags().Lookup("expiry-window")); err != nil {
+		logrus.Fatal(err.Error())
+	}
+}
+
+// read the certificates of the managed domain, of its LDAPS endpoint and of the PFXs and check them
+func certificateReport(pfxFiles []string, now time.Time) (*lib.CertificateReport, error) {
+	report := &lib.CertificateReport{Domain: viper.GetString("DOMAIN_NAME"),
+		WindowDays: viper.GetInt("CERT_EXPIRY_WINDOW_DAYS")}
+	domainService, err := AzureCLIInstance.GetDomainService()
+	if err != nil {
+		return nil, err
+	}
+	report.Certificates = append(report.Certificates, lib.DomainServiceCertificate(domainService, now))
+
+	address := viper.GetString("LDAPS_EXTERNAL_IP_ADDRESS")
+	if address == "" {
+		address = domainService.Properties.LdapsSettings.ExternalAccessIpAddress
+	}
+	if address != "" {
+		report.Certificates = append(report.Certificates, lib.ServedCertificateInfo(address, 10*time.Second, now))
+	} else {
+		report.Certificates = append(report.Certificates, lib.CertificateInfo{Source: lib.CertSourceServed,
+			Error: "the managed domain has no LDAPS external access ip address"})
+	}
+
+	password := viper.GetString("PFX_CERTIFICATE_PASSWORD")
+	if pfxBase64 := viper.GetString("PFX_CERTIFICATE_BASE64"); pfxBase64 != "" {
+		pfx, err := base64.StdEncoding.DecodeString(pfxBase64)
+		if err != nil {
+			report.Certificates = append(report.Certificates, lib.CertificateInfo{Source: lib.CertSourcePfx,
+				Location: "PFX_CERTIFICATE_BASE64", Error: "the PFX is not base64: " + err.Error()})
+		} else {
+			report.Certificates = append(report.Certificates,
+				lib.PfxCertificateInfo("PFX_CERTIFICATE_BASE64", pfx, password, now))
+		}
+	}
+	for _, pfxFile := range pfxFiles {
+		pfx, err := ioutil.ReadFile(pfxFile)
+		if err != nil {
+			report.Certificates = append(report.Certificates, lib.CertificateInfo{Source: lib.CertSourcePfx,
+				Location: pfxFile, Error: err.Error()})
+			continue
+		}
+		report.Certificates = append(report.Certificates, lib.PfxCertificateInfo(pfxFile, pfx, password, now))
+	}
+	report.Check()
+	return report, nil
+}
+
+// print the certificates as a table followed by the findings
+func printCertificateReport(report *lib.CertificateReport) {
+	w := tabwriter.NewWriter(ReporterInstance.Writer(), 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SOURCE\tLOCATION\tTHUMBPRINT\tSUBJECT\tSANS\tEXPIRES\tDAYS LEFT")
+	for _, info := range report.Certificates {
+		if info.Error != "" && info.Thumbprint == "" {
+			fmt.Fprintf(w, "%s\t%s\t-\t-\t-\t-\t-\n", info.Source, info.Location)
+			continue
+		}
+		expires, daysLeft := "-", "-"
+		if info.NotAfter != nil {
+			expires, daysLeft = info.NotAfter.Format("2006-01-02"), fmt.Sprint(*info.DaysLeft)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", info.Source, info.Location, info.Thumbprint,
+			valueOrDash(info.Subject), valueOrDash(strings.Join(info.SANs, ",")), expires, daysLeft)
+	}
+	w.Flush()
+	out := ReporterInstance.Writer()
+	if len(report.Findings) == 0 {
+		fmt.Fprintf(out, "\nNo findings, no certificate expires within %d days\n", report.WindowDays)
+		return
+	}
+	fmt.Fprintln(out, "\nFindings:")
+	for _, finding := range report.Findings {
+		fmt.Fprintf(out, "  %s %s\n", lib.PlanWarning, finding)
+	}
+}
+
+func valueOrDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
@@ -3,21 +3,61 @@ package cmd
 import (
 	"fmt"
 	"github.cicd.cloud.fpdev.io/BD/bd-azure-smc-deployment/lib"
-	"github.com/cheggaaa/pb/v3"
+	"github.cicd.cloud.fpdev.io/BD/bd-azure-smc-deployment/lib/arm"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
-	"os"
+	"net/http"
+	"strconv"
 	"strings"
 	"time"
 )
 
 const (
-	RUNNING_DEPLOYMENT  = 10
-	FINISHED_DEPLOYMENT = 10
+	// seconds between two polls of a running deployment
+	RUNNING_DEPLOYMENT = 10
+	// minutes to wait for a submitted deployment to be visible
+	DEPLOYMENT_VISIBLE_TIMEOUT = 5
+	// seconds between two reads of the managed domain health
+	HEALTH_POLL_INTERVAL = 60
 )
 
+// the Azure AD groups created for the SMC roles of ROLE_MAPPINGS
+func smcGroups() ([]string, error) {
+	mappings, err := lib.RoleMappings()
+	if err != nil {
+		return nil, err
+	}
+	return lib.ManagedGroupNames(mappings), nil
+}
+
+// the state of STATE_FILE bound to the tenant and the subscription of the login
+func loadState() (*lib.DeploymentState, error) {
+	state, err := lib.LoadState(viper.GetString("STATE_FILE"))
+	if err != nil {
+		return nil, err
+	}
+	subscriptionID, err := AzureCLIInstance.SubscriptionID()
+	if err != nil {
+		return nil, err
+	}
+	state.Reporter = ReporterInstance
+	state.SetScope(viper.GetString("AZURE_TENANT_ID"), subscriptionID)
+	return state, nil
+}
+
+// whether the state records that deploy-azure created the resource group
+func resourceGroupCreated(state *lib.DeploymentState, resourceGroup string) bool {
+	results := state.Results("resource-group")
+	return strings.EqualFold(results["resourceGroup"], resourceGroup) && results["created"] == "true"
+}
+
+// the key of the groups step results which records whether a group was created or existed
+func groupStatusKey(name string) string {
+	return name + "/status"
+}
+
 var deployCmd = &cobra.Command{
 	Use:   "deploy-azure",
 	Short: "Deploy Azure Template",
@@ -30,133 +70,349 @@ and usage of using your command. For example:
 				logrus.Fatal(err)
 			}
 		}
-		// configure azure app provisioning
-		if viper.GetBool("CREATE_GROUPS_SMC") {
-			if err := lib.GenerateAppScimTemplate(viper.GetString("SCIM_TEMPLATE")); err != nil {
+		if plan, _ := cmd.Flags().GetBool("plan"); plan {
+			err := planDeployAzure()
+			if err := AzureCLIInstance.Logout(); err != nil {
+				logrus.Error(err)
+			}
+			if err != nil {
+				logrus.Fatal(errors.Wrap(err, "the plan failed"))
+			}
+			return
+		}
+		state, err := loadState()
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		if restart, _ := cmd.Flags().GetBool("restart"); restart {
+			if err := state.Reset(); err != nil {
 				logrus.Fatal(err)
 			}
+		}
+		if attach, _ := cmd.Flags().GetString("attach"); attach != "" {
+			err = attachDeployment(state, attach)
+		} else {
+			err = deployAzure(state)
+		}
+		if err != nil {
+			if err := AzureCLIInstance.Logout(); err != nil {
+				logrus.Error(err)
+			}
+			logrus.Fatal(err)
+		}
+		if err := AzureCLIInstance.Logout(); err != nil {
+			logrus.Error(err)
+		}
+	},
+}
+
+// run the deployment steps, the steps completed by a previous run are skipped
+func deployAzure(state *lib.DeploymentState) error {
+	// configure azure app provisioning
+	if viper.GetBool("CREATE_GROUPS_SMC") {
+		scimInputs := []string{viper.GetString("APP_NAME"), viper.GetString("NGINX_PUBLIC_IP_ADDRESS"),
+			viper.GetString("SCIM_TEMPLATE")}
+		_, err := state.RunStep("scim", scimInputs, func() (map[string]string, error) {
+			if err := AzureCLIInstance.GenerateAppScimTemplate(viper.GetString("SCIM_TEMPLATE")); err != nil {
+				return nil, err
+			}
 			logrus.Infof("Your app %s is been configured for provisioning with SCIM", viper.GetString("APP_NAME"))
-			if err := lib.AddSpTag(viper.GetString("APP_NAME"), "WindowsAzureActiveDirectoryOnPremApp"); err != nil {
-				logrus.Fatal("failed in adding a tag to sp")
+			if err := AzureCLIInstance.AddSpTag(viper.GetString("APP_NAME"), "WindowsAzureActiveDirectoryOnPremApp"); err != nil {
+				return nil, errors.Wrap(err, "failed in adding a tag to sp")
 			}
+			spId, err := AzureCLIInstance.GetSpId(viper.GetString("APP_NAME"))
+			if err != nil {
+				return nil, err
+			}
+			return map[string]string{"servicePrincipalId": spId}, nil
+		})
+		if err != nil {
+			return err
 		}
-		// read all exists groups
-		c := "az group list --query [].name -o tsv"
-		output, err := lib.ExecuteCmd(c)
+		groupNames, err := smcGroups()
 		if err != nil {
-			logrus.Fatal(errors.Wrap(err, "failed in reading all exists resource groups"))
-		}
-		groups := strings.Split(output, "\n")
-		resourceExists := false
-		for _, group := range groups {
-			if strings.TrimSpace(group) == viper.GetString("RESOURCE_GROUP") {
-				resourceExists = true
-				break
-			}
-		}
-		if viper.GetBool("CREATE_GROUPS_SMC") {
-			smcGroups := []string{"Operator", "Editor", "Reports Manager", "Superuser", "Owner",
-				"NSX Role", "Viewer", "Monitor", "Logs Viewer"}
-			for _, name := range smcGroups {
-				if err := lib.CreateGroup(name); err != nil {
-					logrus.Error(errors.Wrap(err, "failed in creating group: "+name))
-				} else {
-					logrus.Infof("Created Azure Active Directory Group '%s' for SMC Roles", name)
+			return err
+		}
+		previous := state.Results("groups")
+		_, err = state.RunStep("groups", groupNames, func() (map[string]string, error) {
+			// existing groups are reused, only the missing ones are created
+			groups, err := AzureCLIInstance.EnsureGroups(groupNames, viper.GetInt("GROUPS_PARALLELISM"))
+			if err != nil {
+				return nil, err
+			}
+			lib.PrintGroupSummary(ReporterInstance.Writer(), groups)
+			results := make(map[string]string)
+			var failed []string
+			for _, group := range groups {
+				event := lib.Event{Type: lib.EventResourceStatus, ResourceType: "group", Resource: group.Name,
+					Status: group.Status, Message: group.ID}
+				if group.Err != nil {
+					event.Error = group.Err.Error()
+				}
+				ReporterInstance.Report(event)
+				if group.Status == lib.GroupFailed {
+					logrus.Error(errors.Wrap(group.Err, "failed in creating group: "+group.Name))
+					failed = append(failed, group.Name)
+					continue
 				}
-				time.Sleep(3 * time.Second)
+				// a group created by an earlier run which failed later on is still ours
+				if group.Status == lib.GroupExisting && previous[group.Name] == group.ID &&
+					previous[groupStatusKey(group.Name)] == lib.GroupCreated {
+					group.Status = lib.GroupCreated
+				}
+				results[group.Name] = group.ID
+				results[groupStatusKey(group.Name)] = group.Status
+			}
+			if len(failed) != 0 {
+				return results, fmt.Errorf("failed in creating the groups: %s", strings.Join(failed, ", "))
 			}
+			return results, nil
+		})
+		if err != nil {
+			logrus.Error(err)
 		}
+	}
 
-		if !resourceExists {
-			//create resource group
-			c := fmt.Sprintf("az group create -l %s -n '%s'", viper.GetString("LOCATION"),
-				viper.GetString("RESOURCE_GROUP"))
-			_, err := lib.ExecuteCmd(c)
+	resourceGroup := viper.GetString("RESOURCE_GROUP")
+	_, err := state.RunStep("resource-group", []string{resourceGroup, viper.GetString("LOCATION")},
+		func() (map[string]string, error) {
+			armClient, err := AzureCLIInstance.ArmClient()
 			if err != nil {
-				logrus.Fatal(errors.Wrap(err, "failed in creating resource group"))
+				return nil, err
 			}
-		}
-		parameters, err := lib.GenerateParameters()
+			resourceExists, err := armClient.ResourceGroupExists(resourceGroup)
+			if err != nil {
+				return nil, errors.Wrap(err, "failed in reading all exists resource groups")
+			}
+			// destroy only deletes the group when it was created here, a rerun keeps what the first run found
+			created := !resourceExists || resourceGroupCreated(state, resourceGroup)
+			if !resourceExists {
+				//create resource group
+				if _, err := armClient.CreateResourceGroup(resourceGroup, viper.GetString("LOCATION")); err != nil {
+					return nil, errors.Wrap(err, "failed in creating resource group")
+				}
+			}
+			return map[string]string{"resourceGroup": resourceGroup, "created": strconv.FormatBool(created)}, nil
+		})
+	if err != nil {
+		return err
+	}
+
+	if lib.ExistingVnet() {
+		networkInputs := []string{lib.VnetResourceGroup(), viper.GetString("DOMAIN_SERVICES_VNET_NAME"),
+			viper.GetString("DOMAIN_SERVICES_SUBNET_NAME"), viper.GetString("EXISTING_NSG_MODE"),
+			viper.GetString("NSG_PROFILE")}
+		ldapsSources, err := lib.LdapsAllowedCIDRs()
 		if err != nil {
-			logrus.Fatal(err.Error())
+			return err
 		}
-		c = fmt.Sprintf("az group deployment create --resource-group %s --template-file %s --parameters %s --no-wait",
-			viper.GetString("RESOURCE_GROUP"),
-			viper.GetString("DEPLOYMENT_TEMPLATE"),
-			parameters)
-		_, err = lib.ExecuteCmd(c)
+		networkInputs = append(networkInputs, ldapsSources...)
+		_, err = state.RunStep("existing-network", networkInputs, prepareExistingSubnet)
 		if err != nil {
-			if !strings.Contains(err.Error(), "deprecated") {
-				logrus.Fatal(err)
-			}
+			return err
 		}
-		err = os.Remove(parameters)
-		logrus.Info("Preparing for deployment...")
-		time.Sleep(30 * time.Second)
-		logrus.Info("Starting Deployment...")
-		time.Sleep(40 * time.Second)
-		logrus.Info("Starting Deployment Monitoring...")
-		count := (55 * 60) / RUNNING_DEPLOYMENT
-		inerCount := 0
-		//tmpl := `{{ red "Deploying:" }} {{ bar . "┣" "┃" (cycle . "↖" "↗" "↘" "↙" ) "." "┫"}} {{speed . | rndcolor }} {{percent .}}`
-		tmpl := `{{ red "Deploying:" }} {{ bar . "┣" "┃" (cycle . "↖" "↗" "↘" "↙" ) "." "┫"}}  {{percent . | rndcolor }}`
-
-		// start bar based on our template
-		bar := pb.ProgressBarTemplate(tmpl).Start(count)
-		// set values for string elements
-		bar.Set("my_green_string", "green").
-			Set("my_blue_string", "blue")
-		time.Sleep(20 * time.Second)
-		for i := range lib.MonitorDeployment() {
-			if i == lib.CommandFailed {
-				if err := AzureCLIInstance.Logout(); err != nil {
-					logrus.Error(err)
-				}
-				logrus.Fatal("Failed In monitoring the deployment")
+	}
+
+	parameters, err := lib.GenerateParameters()
+	if err != nil {
+		return err
+	}
+	deploymentInputs := []interface{}{resourceGroup, viper.GetString("DEPLOYMENT_TEMPLATE"), parameters}
+	results, err := state.RunStep("template-deployment", deploymentInputs, func() (map[string]string, error) {
+		deploymentName := lib.NewDeploymentName()
+		if err := AzureCLIInstance.DeployTemplate(deploymentName, parameters); err != nil {
+			return nil, err
+		}
+		ReporterInstance.Report(lib.Event{Type: lib.EventResourceStatus, ResourceType: "Microsoft.Resources/deployments",
+			Resource: deploymentName, Status: "Submitted",
+			Message: "re-attach with: deploy-azure --attach " + deploymentName})
+		return map[string]string{"deploymentName": deploymentName}, nil
+	})
+	if err != nil {
+		return err
+	}
+	return followDeployment(state, results["deploymentName"])
+}
+
+// check the existing subnet of the config and add the NSG rules it misses when EXISTING_NSG_MODE is attach
+func prepareExistingSubnet() (map[string]string, error) {
+	check, err := AzureCLIInstance.CheckExistingSubnet()
+	if err != nil {
+		return nil, err
+	}
+	for _, warning := range check.Warnings {
+		logrus.Warn(warning)
+	}
+	if err := check.Err(); err != nil {
+		return nil, err
+	}
+	if len(check.MissingRules) != 0 {
+		if err := AzureCLIInstance.AttachSecurityRules(check); err != nil {
+			return nil, err
+		}
+		// a deny rule with a lower priority number can still block an added rule
+		if check, err = AzureCLIInstance.CheckExistingSubnet(); err != nil {
+			return nil, err
+		}
+		if len(check.MissingRules) != 0 {
+			return nil, fmt.Errorf("the NSG %s still blocks the rules %s, check its deny rules",
+				check.NetworkSecurityGroupID, securityRuleNames(check.MissingRules))
+		}
+	}
+	return map[string]string{"subnetId": check.SubnetID, "networkSecurityGroupId": check.NetworkSecurityGroupID}, nil
+}
+
+func securityRuleNames(rules []lib.SecurityRule) string {
+	var names []string
+	for _, rule := range rules {
+		names = append(names, rule.Name)
+	}
+	return strings.Join(names, ", ")
+}
+
+// monitor a submitted deployment and run the steps which need the deployed resources
+func followDeployment(state *lib.DeploymentState, deploymentName string) error {
+	resourceGroup := viper.GetString("RESOURCE_GROUP")
+	_, err := state.RunStep("monitor", []string{resourceGroup, deploymentName}, func() (map[string]string, error) {
+		if err := monitorDeployment(deploymentName); err != nil {
+			if errors.Cause(err) == lib.ErrDeploymentFailed {
+				// a failed deployment is submitted again by the next run
+				state.Forget("template-deployment")
 			}
-			// deployment failed
-			if i == lib.FailedDeployment {
-				output, err := lib.ReadError()
+			return nil, err
+		}
+		return map[string]string{"provisioningState": arm.StateSucceeded}, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	adminName := viper.GetString("AZURE_ADMIN_LOGIN_NAME")
+	_, err = state.RunStep("aad-dc-admins", []string{adminName}, func() (map[string]string, error) {
+		if err := AzureCLIInstance.AddMemberToGroup("AAD DC Administrators", adminName); err != nil {
+			return nil, err
+		}
+		return map[string]string{"member": adminName}, nil
+	})
+	if err != nil {
+		logrus.Error(err)
+	}
+
+	if viper.GetBool("WAIT_HEALTHY") {
+		_, err = state.RunStep("domain-services-healthy", []string{resourceGroup, deploymentName},
+			func() (map[string]string, error) {
+				logrus.Info("Waiting for the managed domain to be healthy...")
+				domainService, err := AzureCLIInstance.WaitForHealthyDomainService(ReporterInstance,
+					viper.GetDuration("WAIT_HEALTHY_TIMEOUT"), HEALTH_POLL_INTERVAL*time.Second)
 				if err != nil {
-					if err := AzureCLIInstance.Logout(); err != nil {
-						logrus.Error(err)
-					}
-					logrus.Fatal(err.Error())
-				}
-				outputStr := strings.ReplaceAll(string(output), "\\r\\n", "")
-				parts := strings.Split(outputStr, "\"details\\\":")
-				bar.Finish()
-				if err := AzureCLIInstance.Logout(); err != nil {
-					logrus.Error(err)
-				}
-				logrus.Fatal(parts[1])
-				break
-			} else if i == lib.RunningDeployment {
-				bar.Increment()
-				inerCount++
-				time.Sleep(RUNNING_DEPLOYMENT * time.Second)
-				continue
-			} else if i == lib.SucceededDeployment {
-				for i := inerCount; i <= count; i++ {
-					bar.Increment()
-					inerCount++
-					time.Sleep(FINISHED_DEPLOYMENT * time.Millisecond)
+					return nil, err
 				}
-				bar.Finish()
-				logrus.Println("The Template Deployment process is finished.")
-				logrus.Printf("The Deployment for azure AD DS(%s) is started this process can take up to 30 minutes.\n You can use azure portal to monitor this process",
-					viper.GetString("DOMAIN_NAME"))
-				break
+				return map[string]string{
+					"ldapsExternalAccessIpAddress": domainService.Properties.LdapsSettings.ExternalAccessIpAddress,
+				}, nil
+			})
+		if err != nil {
+			return err
+		}
+		logrus.Infof("The managed domain %s is healthy, deploy-smc can run now", viper.GetString("DOMAIN_NAME"))
+	}
+
+	if lib.ExistingVnet() && !viper.GetBool("UPDATE_EXISTING_VNET_DNS") {
+		// the DNS servers of a shared VNet serve other workloads as well
+		ReporterInstance.Report(lib.Event{Type: lib.EventStepSkipped, Step: "vnet-dns",
+			Message: "the DNS servers of the existing VNet are kept, set UPDATE_EXISTING_VNET_DNS to replace them"})
+		return nil
+	}
+	_, err = state.RunStep("vnet-dns", []string{resourceGroup, deploymentName}, updateVnetDNS)
+	if err != nil {
+		// the domain controllers may not have addresses yet, the next run tries again
+		logrus.Warn(err)
+	}
+	return nil
+}
+
+// point the DNS servers of the VNet at the domain controllers of the managed domain
+func updateVnetDNS() (map[string]string, error) {
+	domainService, err := AzureCLIInstance.GetDomainService()
+	if err != nil {
+		return nil, err
+	}
+	servers := domainService.DomainControllerIPs()
+	if len(servers) == 0 {
+		return nil, errors.New("the managed domain has no domain controller addresses yet, " +
+			"run deploy-azure again to update the DNS servers of the VNet")
+	}
+	previous, err := AzureCLIInstance.UpdateVnetDNSServers(servers)
+	if err != nil {
+		return nil, err
+	}
+	if strings.Join(previous, ",") != strings.Join(servers, ",") {
+		logrus.Infof("The DNS servers of the VNet %s are changed from %v to %v",
+			viper.GetString("DOMAIN_SERVICES_VNET_NAME"), previous, servers)
+		if configured, err := lib.DNSServers(); err == nil && strings.Join(configured, ",") != strings.Join(servers, ",") {
+			logrus.Warnf("set DNS_SERVERS to %s so that a later deployment keeps them",
+				strings.Join(servers, ","))
+		}
+	}
+	return map[string]string{"dnsServers": strings.Join(servers, ",")}, nil
+}
+
+// re-attach to a deployment submitted by another run, it must exist already
+func attachDeployment(state *lib.DeploymentState, deploymentName string) error {
+	armClient, err := AzureCLIInstance.ArmClient()
+	if err != nil {
+		return err
+	}
+	deployment, err := armClient.GetDeployment(viper.GetString("RESOURCE_GROUP"), deploymentName)
+	if err != nil {
+		return errors.Wrap(err, "failed in reading the deployment "+deploymentName)
+	}
+	logrus.Infof("Attaching to the deployment %s (%s)", deploymentName, deployment.Properties.ProvisioningState)
+	return followDeployment(state, deploymentName)
+}
+
+// follow the template deployment through its operations until it succeeds or fails
+func monitorDeployment(deploymentName string) error {
+	logrus.Info("Waiting for the deployment to start...")
+	if err := AzureCLIInstance.WaitForDeployment(deploymentName, DEPLOYMENT_VISIBLE_TIMEOUT*time.Minute); err != nil {
+		return err
+	}
+	logrus.Info("Starting Deployment Monitoring...")
+	states := make(map[string]string)
+	for progress := range AzureCLIInstance.MonitorDeployment(deploymentName, RUNNING_DEPLOYMENT*time.Second) {
+		if progress.Err != nil {
+			return errors.Wrap(progress.Err, "Failed In monitoring the deployment")
+		}
+		for _, resource := range progress.Resources {
+			if states[resource.Type] != resource.State && resource.State != lib.ResourceWaiting {
+				ReporterInstance.Report(lib.Event{
+					Type:           lib.EventResourceStatus,
+					ResourceType:   resource.Type,
+					Resource:       resource.Name,
+					Status:         resource.State,
+					ElapsedSeconds: resource.Elapsed.Seconds(),
+				})
 			}
+			states[resource.Type] = resource.State
 		}
-		if err := lib.AddMemberToGroup("AAD DC Administrators",
-			viper.GetString("AZURE_ADMIN_LOGIN_NAME")); err != nil {
-			logrus.Error(err)
+		ReporterInstance.Report(lib.ProgressEvent(progress))
+		if !progress.Done() {
+			continue
 		}
-		if err := AzureCLIInstance.Logout(); err != nil {
-			logrus.Error(err)
+		if progress.State != arm.StateSucceeded {
+			deploymentErr, err := AzureCLIInstance.DeploymentError(deploymentName)
+			if err != nil {
+				return errors.Wrap(lib.ErrDeploymentFailed, err.Error())
+			}
+			return deploymentErr
 		}
-	},
+		logrus.Println("The Template Deployment process is finished.")
+		if !viper.GetBool("WAIT_HEALTHY") {
+			logrus.Printf("The Deployment for azure AD DS(%s) is started this process can take up to 30 minutes.\n You can use azure portal to monitor this process or run deploy-azure with --wait-healthy",
+				viper.GetString("DOMAIN_NAME"))
+		}
+	}
+	return nil
 }
 
 func init() {
@@ -167,8 +423,198 @@ func init() {
 		deployCmd.Flags().Lookup("azure-admin-password")); err != nil {
 		logrus.Fatal(err.Error())
 	}
+	deployCmd.Flags().Bool("restart", false, "ignore the state file of a previous run and start from the first step")
+	deployCmd.Flags().String("attach", "", "monitor the given in-flight deployment instead of submitting a new one")
+	deployCmd.Flags().Bool("plan", false, "print what the deployment would change without changing anything")
+	deployCmd.Flags().Bool("wait-healthy", false,
+		"wait until the managed domain is healthy and LDAPS is reachable after the template deployment")
+	if err := viper.BindPFlag("WAIT_HEALTHY", deployCmd.Flags().Lookup("wait-healthy")); err != nil {
+		logrus.Fatal(err.Error())
+	}
+	deployCmd.Flags().Bool("update-vnet-dns", false,
+		"replace the DNS servers of the existing VNet with the domain controller addresses")
+	if err := viper.BindPFlag("UPDATE_EXISTING_VNET_DNS", deployCmd.Flags().Lookup("update-vnet-dns")); err != nil {
+		logrus.Fatal(err.Error())
+	}
 	deployCmd.Flags().BoolP("create-groups", "g", false, "Create groups for SMC roles")
 	if err := viper.BindPFlag("CREATE_GROUPS_SMC", deployCmd.Flags().Lookup("create-groups")); err != nil {
 		logrus.Fatal(err.Error())
 	}
 }
+
+// the printer of a --plan run, the items are events with the json output
+func newPlanPrinter() *lib.PlanPrinter {
+	plan := &lib.PlanPrinter{Out: ReporterInstance.Writer()}
+	if viper.GetString("OUTPUT") == lib.OutputJSON {
+		plan.Events = ReporterInstance
+	}
+	return plan
+}
+
+// print everything deploy-azure would do, nothing is changed
+func planDeployAzure() error {
+	plan := newPlanPrinter()
+	armClient, err := AzureCLIInstance.ArmClient()
+	if err != nil {
+		return err
+	}
+	resourceGroup := viper.GetString("RESOURCE_GROUP")
+	plan.Section("Resource group")
+	resourceExists, err := armClient.ResourceGroupExists(resourceGroup)
+	if err != nil {
+		return errors.Wrap(err, "failed in reading the resource group")
+	}
+	if resourceExists {
+		plan.Item(lib.PlanNoChange, "%s exists", resourceGroup)
+	} else {
+		plan.Item(lib.PlanCreate, "%s will be created in %s", resourceGroup, viper.GetString("LOCATION"))
+	}
+
+	if viper.GetBool("CREATE_GROUPS_SMC") {
+		plan.Section("SMC role groups")
+		graphClient, err := AzureCLIInstance.GraphClient()
+		if err != nil {
+			return err
+		}
+		mappings, err := lib.RoleMappings()
+		if err != nil {
+			return err
+		}
+		for _, mapping := range mappings {
+			if mapping.GroupID != "" {
+				if _, err := graphClient.GetGroup(mapping.GroupID); err != nil {
+					plan.Item(lib.PlanWarning, "%s not found, mapped to the SMC role %s in %s", mapping.GroupID,
+						mapping.Role, mapping.Domain)
+				} else {
+					plan.Item(lib.PlanNoChange, "%s exists, mapped to the SMC role %s in %s", mapping.GroupID,
+						mapping.Role, mapping.Domain)
+				}
+				continue
+			}
+			name := mapping.GroupName()
+			groups, err := graphClient.FindGroups(name)
+			if err != nil {
+				return errors.Wrap(err, "failed in reading the group "+name)
+			}
+			if len(groups) != 0 {
+				plan.Item(lib.PlanNoChange, "%s exists (%s), mapped to the SMC role %s in %s", name, groups[0].ID,
+					mapping.Role, mapping.Domain)
+			} else {
+				plan.Item(lib.PlanCreate, "%s will be created, mapped to the SMC role %s in %s", name,
+					mapping.Role, mapping.Domain)
+			}
+		}
+		plan.Section("SCIM provisioning")
+		if err := AzureCLIInstance.PlanAppScim(plan, viper.GetString("SCIM_TEMPLATE"),
+			"WindowsAzureActiveDirectoryOnPremApp"); err != nil {
+			return err
+		}
+	}
+
+	plan.Section("Network")
+	if lib.ExistingVnet() {
+		if err := planExistingSubnet(plan); err != nil {
+			return err
+		}
+	} else {
+		for _, warning := range lib.NetworkWarnings() {
+			plan.Item(lib.PlanWarning, "%s", warning)
+		}
+		dnsServers, err := lib.DNSServers()
+		if err != nil {
+			return err
+		}
+		plan.Item(lib.PlanModify, "the VNet DNS servers will be %s, updated to the domain controller addresses "+
+			"once the managed domain is deployed", strings.Join(dnsServers, ", "))
+	}
+
+	plan.Section("Domain settings")
+	if err := planDomainSettings(plan); err != nil {
+		return err
+	}
+
+	plan.Section("Network security rules")
+	securityRules, err := lib.RequiredSecurityRules()
+	if err != nil {
+		return err
+	}
+	plan.SecurityRules(securityRules)
+
+	parameters, err := lib.GenerateParameters()
+	if err != nil {
+		return err
+	}
+	plan.Section("Template parameters")
+	plan.Parameters(lib.MaskedParameters(parameters))
+
+	plan.Section("Template changes")
+	if !resourceExists {
+		plan.Item(lib.PlanCreate, "all resources of %s will be created in the new resource group",
+			viper.GetString("DEPLOYMENT_TEMPLATE"))
+	} else {
+		result, err := AzureCLIInstance.WhatIfTemplate(lib.NewDeploymentName(), parameters)
+		if err != nil {
+			return err
+		}
+		plan.WhatIf(result)
+	}
+
+	plan.Section("Group members")
+	plan.Item(lib.PlanCreate, "%s will be added to AAD DC Administrators", viper.GetString("AZURE_ADMIN_LOGIN_NAME"))
+	return nil
+}
+
+// print the result of checking the existing subnet and the NSG changes of EXISTING_NSG_MODE attach
+func planExistingSubnet(plan *lib.PlanPrinter) error {
+	check, err := AzureCLIInstance.CheckExistingSubnet()
+	if err != nil {
+		return err
+	}
+	if check.AddressPrefix != "" {
+		plan.Item(lib.PlanNoChange, "the managed domain will use the existing subnet %s (%s)", check.SubnetID,
+			check.AddressPrefix)
+	}
+	for _, problem := range check.Errors {
+		plan.Item(lib.PlanWarning, "error: %s", problem)
+	}
+	for _, warning := range check.Warnings {
+		plan.Item(lib.PlanWarning, "%s", warning)
+	}
+	if len(check.Errors) == 0 {
+		for _, rule := range check.MissingRules {
+			plan.Item(lib.PlanCreate, "NSG rule %s allowing TCP %s", rule.Name, rule.Properties.DestinationPortRange)
+		}
+	}
+	if viper.GetBool("UPDATE_EXISTING_VNET_DNS") {
+		plan.Item(lib.PlanWarning, "the DNS servers of the existing VNet will be replaced by the domain controller "+
+			"addresses once the managed domain is deployed, for every workload of the VNet")
+	} else {
+		plan.Item(lib.PlanWarning, "the DNS servers of the existing VNet are kept, point them at the domain "+
+			"controller addresses or set UPDATE_EXISTING_VNET_DNS")
+	}
+	return nil
+}
+
+// print the configured settings of the managed domain, and what changes when it is deployed already
+func planDomainSettings(plan *lib.PlanPrinter) error {
+	settings, err := lib.ConfiguredDomainSettings()
+	if err != nil {
+		return err
+	}
+	security := settings.DomainSecuritySettings
+	plan.Item(lib.PlanNoChange, "sku %s, filtered sync %s", settings.Sku, settings.FilteredSync)
+	plan.Item(lib.PlanNoChange, "NTLMv1 %s, TLS 1.0 %s, Kerberos RC4 %s, Kerberos armoring %s", security.NtlmV1,
+		security.TlsV1, security.KerberosRc4Encryption, security.KerberosArmoring)
+	plan.Item(lib.PlanNoChange, "password sync NTLM %s, Kerberos %s, on-premises %s", security.SyncNtlmPasswords,
+		security.SyncKerberosPasswords, security.SyncOnPremPasswords)
+	domainService, err := AzureCLIInstance.GetDomainService()
+	if arm.IsStatus(errors.Cause(err), http.StatusNotFound) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, change := range settings.Changes(&domainService.Properties) {
+		plan.Item(lib.PlanModify, "%s", change)
+	}
+	return nil
+}
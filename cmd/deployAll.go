@@ -0,0 +1,283 @@
+package cmd
+
+import (
+	"encoding/base64"
+	"fmt"
+	"github.cicd.cloud.fpdev.io/BD/bd-azure-smc-deployment/lib"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	PhaseCompleted = "completed"
+	PhaseFailed    = "failed"
+	PhaseNotRun    = "not run"
+	PhaseSkipped   = "skipped"
+)
+
+// the phases of deploy-all in the order they run
+var deployPhases = []string{"cert", "app", "azure", "smc"}
+
+// the outcome of one phase of deploy-all
+type phaseResult struct {
+	name     string
+	status   string
+	duration time.Duration
+	outputs  map[string]string
+}
+
+var deployAllCmd = &cobra.Command{
+	Use:   "deploy-all",
+	Short: "Run generate-ssl-cert, deploy-app, deploy-azure and deploy-smc in one go",
+	Long: `Run the phases cert, app, azure and smc in order. The outputs of a phase, such as the generated
+certificate or the LDAPS ip address, are passed to the next ones without editing the config.
+Use --from and --to to run only some of the phases`,
+	Run: func(cmd *cobra.Command, args []string) {
+		from, _ := cmd.Flags().GetString("from")
+		to, _ := cmd.Flags().GetString("to")
+		phases, err := selectPhases(from, to)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		// deploy-smc needs the LDAPS ip address, so the azure phase waits for the managed domain
+		if contains(phases, "azure") && contains(phases, "smc") {
+			viper.Set("WAIT_HEALTHY", true)
+		}
+		if err := AzureCLIInstance.Login(); err != nil {
+			logrus.Fatal(err)
+		}
+		state, err := loadState()
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		if restart, _ := cmd.Flags().GetBool("restart"); restart {
+			if err := state.Reset(); err != nil {
+				logrus.Fatal(err)
+			}
+		}
+		results, err := deployAll(state, phases)
+		printPhaseReport(results)
+		if err := AzureCLIInstance.Logout(); err != nil {
+			logrus.Error(err)
+		}
+		smcLogout()
+		if err != nil {
+			logrus.Fatal(err)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(deployAllCmd)
+	deployAllCmd.Flags().String("from", deployPhases[0],
+		fmt.Sprintf("the first phase to run, one of: %s", strings.Join(deployPhases, ", ")))
+	deployAllCmd.Flags().String("to", deployPhases[len(deployPhases)-1],
+		fmt.Sprintf("the last phase to run, one of: %s", strings.Join(deployPhases, ", ")))
+	deployAllCmd.Flags().Bool("restart", false, "ignore the state file of a previous run and start from the first step")
+	deployAllCmd.Flags().String("pfx-out", "",
+		"write the generated certificate to this PFX file and reuse it on the next runs, "+
+			"it is only kept in memory by default")
+	if err := viper.BindPFlag("PFX_OUT_FILE", deployAllCmd.Flags().Lookup("pfx-out")); err != nil {
+		logrus.Fatal(err.Error())
+	}
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// the phases between from and to, both included
+func selectPhases(from string, to string) ([]string, error) {
+	index := func(name string) (int, error) {
+		for i, phase := range deployPhases {
+			if phase == name {
+				return i, nil
+			}
+		}
+		return 0, fmt.Errorf("unknown phase '%s', expected one of: %s", name, strings.Join(deployPhases, ", "))
+	}
+	first, err := index(from)
+	if err != nil {
+		return nil, err
+	}
+	last, err := index(to)
+	if err != nil {
+		return nil, err
+	}
+	if first > last {
+		return nil, fmt.Errorf("the phase '%s' runs after '%s'", from, to)
+	}
+	return deployPhases[first : last+1], nil
+}
+
+// run the selected phases in order, it stops at the first failing phase
+func deployAll(state *lib.DeploymentState, phases []string) ([]phaseResult, error) {
+	run := map[string]func() (map[string]string, error){
+		"cert": func() (map[string]string, error) {
+			return certificatePhase(state)
+		},
+		"app": func() (map[string]string, error) {
+			return deployApp(state)
+		},
+		"azure": func() (map[string]string, error) {
+			if err := deployAzure(state); err != nil {
+				return nil, err
+			}
+			outputs := state.Results("domain-services-healthy")
+			if ip := outputs["ldapsExternalAccessIpAddress"]; ip != "" {
+				viper.Set("LDAPS_EXTERNAL_IP_ADDRESS", ip)
+			}
+			return outputs, nil
+		},
+		"smc": func() (map[string]string, error) {
+			if err := smcLogin(); err != nil {
+				return nil, errors.Wrap(err, "failed in login to SMC")
+			}
+			if err := deploySmc(); err != nil {
+				return nil, err
+			}
+			return map[string]string{"ldapDomain": viper.GetString("DOMAIN_NAME")}, nil
+		},
+	}
+	var results []phaseResult
+	for _, phase := range deployPhases {
+		if !contains(phases, phase) {
+			results = append(results, phaseResult{name: phase, status: PhaseSkipped})
+		}
+	}
+	for i, phase := range phases {
+		started := time.Now()
+		ReporterInstance.Report(lib.Event{Type: lib.EventStepStarted, Step: "phase " + phase})
+		outputs, err := run[phase]()
+		result := phaseResult{name: phase, status: PhaseCompleted, duration: time.Since(started), outputs: outputs}
+		if err != nil {
+			result.status = PhaseFailed
+			results = append(results, result)
+			ReporterInstance.Report(lib.Event{Type: lib.EventStepFailed, Step: "phase " + phase, Error: err.Error(),
+				ElapsedSeconds: result.duration.Seconds()})
+			for _, notRun := range phases[i+1:] {
+				results = append(results, phaseResult{name: notRun, status: PhaseNotRun})
+			}
+			return sortPhaseResults(results), errors.Wrap(err, "the phase "+phase+" failed")
+		}
+		results = append(results, result)
+		ReporterInstance.Report(lib.Event{Type: lib.EventStepFinished, Step: "phase " + phase,
+			ElapsedSeconds: result.duration.Seconds()})
+	}
+	return sortPhaseResults(results), nil
+}
+
+// the certificate is generated for the run and only kept in memory. With PFX_OUT_FILE it is also written
+// to that file, protected by its password, and the next runs reuse the file. A certificate of the
+// config is used as is
+func certificatePhase(state *lib.DeploymentState) (map[string]string, error) {
+	if viper.GetString("PFX_CERTIFICATE_BASE64") != "" {
+		return map[string]string{"certificate": "from the config"}, nil
+	}
+	password := viper.GetString("PFX_CERTIFICATE_PASSWORD")
+	if password == "" {
+		return nil, errors.New("PFX_CERTIFICATE_PASSWORD is empty, it is needed to protect the generated certificate")
+	}
+	outputs := map[string]string{"certificate": viper.GetString("CERT_MODE") + " for *." +
+		viper.GetString("DOMAIN_NAME")}
+	pfxFile := viper.GetString("PFX_OUT_FILE")
+	if pfxFile == "" {
+		pfxBase64, err := generateCertificate("")
+		if err != nil {
+			return nil, err
+		}
+		viper.Set("PFX_CERTIFICATE_BASE64", pfxBase64)
+		return outputs, nil
+	}
+	// the state only keeps the hash of the inputs, so the password can be one of them
+	inputs := []string{viper.GetString("DOMAIN_NAME"), viper.GetString("PFX_CERTIFICATE_EXPIRY_DAYS"),
+		viper.GetString("CERT_MODE"), viper.GetString("CA_CERT_FILE"), viper.GetString("CERT_KEY_TYPE"),
+		strings.Join(viper.GetStringSlice("CERT_SANS"), ","), viper.GetString("CERT_SUBJECT"), password, pfxFile}
+	generate := func() (map[string]string, error) {
+		pfxBase64, err := generateCertificate("")
+		if err != nil {
+			return nil, err
+		}
+		pfx, err := base64.StdEncoding.DecodeString(pfxBase64)
+		if err != nil {
+			return nil, err
+		}
+		if err := ioutil.WriteFile(pfxFile, pfx, 0600); err != nil {
+			return nil, errors.Wrap(err, "failed in writing the certificate")
+		}
+		return map[string]string{"pfxFile": pfxFile}, nil
+	}
+	if _, err := state.RunStep("certificate", inputs, generate); err != nil {
+		return nil, err
+	}
+	pfx, err := ioutil.ReadFile(pfxFile)
+	if os.IsNotExist(err) {
+		// the PFX of the completed step is gone, a new certificate replaces it
+		state.Forget("certificate")
+		if _, err := state.RunStep("certificate", inputs, generate); err != nil {
+			return nil, err
+		}
+		pfx, err = ioutil.ReadFile(pfxFile)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed in reading the certificate")
+	}
+	viper.Set("PFX_CERTIFICATE_BASE64", base64.StdEncoding.EncodeToString(pfx))
+	outputs["pfxFile"] = pfxFile
+	return outputs, nil
+}
+
+func sortPhaseResults(results []phaseResult) []phaseResult {
+	var sorted []phaseResult
+	for _, phase := range deployPhases {
+		for _, result := range results {
+			if result.name == phase {
+				sorted = append(sorted, result)
+			}
+		}
+	}
+	return sorted
+}
+
+// print which phases completed, with their outputs. With the json output every phase is an event
+func printPhaseReport(results []phaseResult) {
+	if viper.GetString("OUTPUT") == lib.OutputJSON {
+		for _, result := range results {
+			outputs := make(map[string]interface{}, len(result.outputs))
+			for key, value := range result.outputs {
+				outputs[key] = value
+			}
+			ReporterInstance.Report(lib.Event{Type: lib.EventPhaseResult, Step: result.name, Status: result.status,
+				ElapsedSeconds: result.duration.Seconds(), Fields: outputs})
+		}
+		return
+	}
+	w := tabwriter.NewWriter(ReporterInstance.Writer(), 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PHASE\tSTATUS\tDURATION\tOUTPUTS")
+	for _, result := range results {
+		var outputs []string
+		for key, value := range result.outputs {
+			outputs = append(outputs, key+"="+value)
+		}
+		sort.Strings(outputs)
+		duration := ""
+		if result.duration != 0 {
+			duration = result.duration.Round(time.Second).String()
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", result.name, result.status, duration, strings.Join(outputs, " "))
+	}
+	w.Flush()
+}
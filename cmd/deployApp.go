@@ -1,6 +1,7 @@
 package cmd
 
 import (
+	"github.cicd.cloud.fpdev.io/BD/bd-azure-smc-deployment/lib"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -17,10 +18,15 @@ var deployAppCmd = &cobra.Command{
 				logrus.Fatal(err)
 			}
 		}
-		if err := AzureCLIInstance.CreateApp(viper.GetString("APP_NAME")); err != nil {
+		state, err := loadState()
+		if err != nil {
 			logrus.Fatal(err)
 		}
-		if err := AzureCLIInstance.CreateSP(viper.GetString("APP_NAME")); err != nil {
+		_, err = deployApp(state)
+		if err := AzureCLIInstance.Logout(); err != nil {
+			logrus.Error(err)
+		}
+		if err != nil {
 			logrus.Fatal(err)
 		}
 	},
@@ -30,3 +36,16 @@ func init() {
 	rootCmd.AddCommand(deployAppCmd)
 
 }
+
+// create the app of APP_NAME and its service principal unless they exist, reported as the step app. Their
+// object ids are recorded in the state so that destroy deletes only them
+func deployApp(state *lib.DeploymentState) (map[string]string, error) {
+	appName := viper.GetString("APP_NAME")
+	return state.RunStep("app", appName, func() (map[string]string, error) {
+		appID, spID, err := AzureCLIInstance.EnsureApp(appName)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]string{"appName": appName, "appObjectId": appID, "servicePrincipalId": spID}, nil
+	})
+}
@@ -1,24 +1,29 @@
 package cmd
 
 import (
-	"bytes"
+	"crypto/x509"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"github.cicd.cloud.fpdev.io/BD/bd-azure-smc-deployment/lib"
+	"github.cicd.cloud.fpdev.io/BD/bd-azure-smc-deployment/lib/graph"
 	"github.cicd.cloud.fpdev.io/BD/fp-smc-golang/src/smc"
+	"github.cicd.cloud.fpdev.io/BD/fp-smc-golang/src/utils"
 	errorWraper "github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 	"io/ioutil"
-	"log"
 	"net/http"
-	"os/exec"
 	"strings"
+	"time"
 )
 
 var SmcInstance smc.Smc
 
+// the session of the SMC calls fp-smc-golang does not offer, see smcSession
+var smcSessionInstance *lib.SmcSession
+
 var deploySmcCmd = &cobra.Command{
 	Use:   "deploy-smc",
 	Short: "Create external LDAP user in Forcepoint SMC",
@@ -27,46 +32,103 @@ var deploySmcCmd = &cobra.Command{
 		if err := AzureCLIInstance.Login(); err != nil {
 			logrus.Fatal(err)
 		}
-
-		SmcInstance = smc.Smc{
-			APIVersion:  viper.GetString("SMC.API_VERSION"),
-			Hostname:    viper.GetString("SMC.IP_ADDRESS"),
-			Port:        viper.GetString("SMC.PORT"),
-			AccessKey:   viper.GetString("SMC.KEY"),
-			EntryPoints: nil,
-			SetCookie:   false,
+		if err := smcLogin(); err != nil {
+			logrus.Fatal(err)
 		}
-		err := SmcInstance.Login()
-		if err != nil {
-			log.Fatal(err.Error())
+		err := deploySmc()
+		if err := AzureCLIInstance.Logout(); err != nil {
+			logrus.Error(err)
 		}
-		err = createAD()
+		smcLogout()
 		if err != nil {
 			logrus.Fatal(err)
 		}
+	},
+}
 
-		logrus.Infof("An external active directory server with name '%s' is been created",
-			viper.GetString("DOMAIN_NAME"))
-		err = createExternalUser()
-		if err != nil {
-			logrus.Fatal(err)
-		}
-		logrus.Infof("An external Users Authentication directory server with name '%s' is been created",
-			viper.GetString("DOMAIN_NAME"))
-		if err := AzureCLIInstance.Logout(); err != nil {
-			logrus.Error(err)
+// create the SMC elements, a failure of the role admins is reported but does not fail the
+// deployment since a later run creates them once the groups are synchronized
+func deploySmc() error {
+	steps := []struct {
+		name string
+		run  func() error
+	}{
+		{"smc-trusted-ca", createTrustedCA},
+		{"smc-ad-server", createAD},
+		{"smc-ldap-domain", createExternalUser},
+		{"smc-role-admins", createRoleAdmins},
+	}
+	for _, step := range steps {
+		if step.name == "smc-role-admins" && !lib.RoleMappingsConfigured() {
+			ReporterInstance.Report(lib.Event{Type: lib.EventStepSkipped, Step: step.name,
+				Message: "neither ROLE_MAPPINGS nor CREATE_GROUPS_SMC is set"})
+			continue
 		}
-		if err := SmcInstance.Logout(); err != nil {
-			log.Fatal(err.Error())
+		ReporterInstance.Report(lib.Event{Type: lib.EventStepStarted, Step: step.name})
+		started := time.Now()
+		if err := step.run(); err != nil {
+			ReporterInstance.Report(lib.Event{Type: lib.EventStepFailed, Step: step.name, Error: err.Error(),
+				ElapsedSeconds: time.Since(started).Seconds()})
+			if step.name == "smc-role-admins" {
+				continue
+			}
+			return err
 		}
-	},
+		ReporterInstance.Report(lib.Event{Type: lib.EventStepFinished, Step: step.name,
+			ElapsedSeconds: time.Since(started).Seconds(), Message: viper.GetString("DOMAIN_NAME")})
+	}
+	return nil
 }
 
 func init() {
 	rootCmd.AddCommand(deploySmcCmd)
 	deploySmcCmd.Flags().StringP("azure-admin-password", "u", "", "Azure admin login password")
 	if err := viper.BindPFlag("AZURE_ADMIN_LOGIN_PASSWORD", deployCmd.Flags().Lookup("azure-admin-password")); err != nil {
-		log.Fatal(err.Error())
+		logrus.Fatal(err.Error())
+	}
+}
+
+// login to the SMC instance of the config
+func smcLogin() error {
+	SmcInstance = smc.Smc{
+		APIVersion:  viper.GetString("SMC.API_VERSION"),
+		Hostname:    viper.GetString("SMC.IP_ADDRESS"),
+		Port:        viper.GetString("SMC.PORT"),
+		AccessKey:   viper.GetString("SMC.KEY"),
+		EntryPoints: nil,
+		SetCookie:   false,
+	}
+	return SmcInstance.Login()
+}
+
+// the session of the SMC of the config for the calls fp-smc-golang does not offer, it logs in once
+// and is shared by all the steps of a run
+func smcSession() (*lib.SmcSession, error) {
+	if smcSessionInstance == nil {
+		smcSessionInstance = &lib.SmcSession{
+			Hostname:   viper.GetString("SMC.IP_ADDRESS"),
+			Port:       viper.GetString("SMC.PORT"),
+			APIVersion: viper.GetString("SMC.API_VERSION"),
+			AccessKey:  viper.GetString("SMC.KEY"),
+		}
+	}
+	if err := smcSessionInstance.Login(); err != nil {
+		return nil, err
+	}
+	return smcSessionInstance, nil
+}
+
+// close the SMC sessions of the run, the ones which were never opened are left alone
+func smcLogout() {
+	if SmcInstance.SetCookie {
+		if err := SmcInstance.Logout(); err != nil {
+			logrus.Error(err)
+		}
+	}
+	if smcSessionInstance != nil {
+		if err := smcSessionInstance.Logout(); err != nil {
+			logrus.Error(err)
+		}
 	}
 }
 
@@ -75,21 +137,26 @@ func createAD() error {
 		return errors.New("DOMAIN_NAME field is empty in the file. Please add your azure domain name to the config file")
 	}
 	baseOn := getBaseOn(viper.GetString("DOMAIN_NAME"))
+	// SMC binds to LDAPS as the azure admin whatever the auth mode of the deployment
+	bindPassword, err := lib.AdminPassword()
+	if err != nil {
+		return errorWraper.Wrap(err, "the LDAPS bind user is the azure admin")
+	}
 	ldapIpAddress, err := GetLDAPExternalIpAddress()
 	if err != nil {
-		logrus.Fatal(err)
+		return err
 	}
 	ldapIpAddress = strings.TrimSpace(ldapIpAddress)
 	displayName, err := GetDisplayName(viper.GetString("AZURE_ADMIN_LOGIN_NAME"))
 	if err != nil {
-		logrus.Fatal(err)
+		return err
 	}
 	displayName = strings.TrimSpace(displayName)
 	bindUserId := fmt.Sprintf("CN=%s,OU=AADDC Users,%s", displayName, baseOn)
 	ad := smc.ActiveDirectoryLDAPS{
 		Address:                   ldapIpAddress,
 		BaseDn:                    baseOn,
-		BindPassword:              viper.GetString("AZURE_ADMIN_LOGIN_PASSWORD"),
+		BindPassword:              bindPassword,
 		BindUserId:                bindUserId,
 		Name:                      viper.GetString("DOMAIN_NAME"),
 		Protocol:                  "ldaps",
@@ -115,19 +182,14 @@ func createAD() error {
 }
 
 func GetLDAPExternalIpAddress() (string, error) {
-	c := fmt.Sprintf("az resource list --resource-group %s --resource-type Microsoft.AAD/domainServices --name %s --query [].id --output tsv",
-		viper.GetString("RESOURCE_GROUP"), viper.GetString("DOMAIN_NAME"))
-	id, err := lib.ExecuteCmd(c)
-	if err != nil {
-		logrus.Fatal(errorWraper.Wrap(err, "Failed in getting the domainServices id"))
+	if ip := viper.GetString("LDAPS_EXTERNAL_IP_ADDRESS"); ip != "" {
+		return ip, nil
 	}
-	id = strings.TrimSpace(id)
-	c = fmt.Sprintf("az resource show --ids '%s' --query properties.ldapsSettings.externalAccessIpAddress --output tsv", id)
-	ipAddress, err := lib.ExecuteCmd(c)
+	domainService, err := AzureCLIInstance.GetDomainService()
 	if err != nil {
-		logrus.Fatal(errorWraper.Wrap(err, "Failed in getting the LDAP ip address"))
+		return "", errorWraper.Wrap(err, "Failed in getting the LDAP ip address")
 	}
-	return ipAddress, nil
+	return domainService.Properties.LdapsSettings.ExternalAccessIpAddress, nil
 }
 
 func getBaseOn(domain string) string {
@@ -140,40 +202,22 @@ func getBaseOn(domain string) string {
 }
 
 func matchDisplayNameToPrincipalName() error {
-	var stdout, stderr bytes.Buffer
-	c2 := "az ad user list | grep userPrincipalName | awk -F':' '{print $2}'| tr -d \" \\n\""
-	exe := exec.Command("sh", "-c", c2)
-	exe.Stderr = &stderr
-	exe.Stdout = &stdout
-	err := exe.Run()
+	client, err := AzureCLIInstance.GraphClient()
 	if err != nil {
 		return err
 	}
-	errorResult := string(stderr.Bytes())
-	if len(errorResult) != 0 {
-		return errors.New(errorResult)
+	users, err := client.ListUsers()
+	if err != nil {
+		return err
 	}
-	output := string(stdout.Bytes())
-	output = strings.ReplaceAll(output, "\"", "")
-	parts := strings.Split(output, ",")
-	if len(parts) == 0 {
+	if len(users) == 0 {
 		return errors.New("failed to extract userPrincipalName in order to make them to user DisplayName")
 	}
-	for _, v := range parts {
-		if v != "" {
-			stdout.Reset()
-			stderr.Reset()
-			c := fmt.Sprintf("az ad user update --id %s --display-name '%s'", v, v)
-			exe := exec.Command("sh", "-c", c)
-			exe.Stderr = &stderr
-			exe.Stdout = &stdout
-			err := exe.Run()
-			if err != nil {
-				return errorWraper.Wrapf(err, "failed in updating the display name for ", v)
-			}
-			errorResult := string(stderr.Bytes())
-			if len(errorResult) != 0 {
-				return errors.New(errorResult)
+	for _, user := range users {
+		if user.UserPrincipalName != "" {
+			update := &graph.User{DisplayName: user.UserPrincipalName}
+			if err := client.UpdateUser(user.ID, update); err != nil {
+				return errorWraper.Wrapf(err, "failed in updating the display name for %s", user.UserPrincipalName)
 			}
 		}
 	}
@@ -181,12 +225,15 @@ func matchDisplayNameToPrincipalName() error {
 }
 
 func GetDisplayName(useId string) (string, error) {
-	c := fmt.Sprintf("az ad user show --id %s --query displayName --output tsv", useId)
-	output, err := lib.ExecuteCmd(c)
+	client, err := AzureCLIInstance.GraphClient()
 	if err != nil {
-		logrus.Fatal(err)
+		return "", err
 	}
-	return strings.TrimSpace(output), nil
+	user, err := client.GetUser(useId)
+	if err != nil {
+		return "", errorWraper.Wrap(err, "failed in reading the azure admin "+useId)
+	}
+	return strings.TrimSpace(user.DisplayName), nil
 }
 
 func createExternalUser() error {
@@ -219,24 +266,253 @@ func createExternalUser() error {
 	return nil
 }
 
-func changePassword(newPassword string) bool {
-	var stdout, stderr bytes.Buffer
-	c := fmt.Sprintf("az ad user update")
-	fmt.Println(c)
-	exe := exec.Command("sh", "-c", "az ad user update")
-	exe.Stderr = &stderr
-	exe.Stdout = &stdout
-	err := exe.Run()
+// the name and href of every element of an SMC collection
+func smcElementsByName(href string) (map[string]string, error) {
+	response, err := SmcInstance.GetHttp(href)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed in reading %s with http status: %d", href, response.StatusCode)
+	}
+	elements, err := utils.ResponseToMap(response.Body)
+	if err != nil {
+		return nil, err
+	}
+	byName := make(map[string]string)
+	for _, element := range elements["result"] {
+		byName[element["name"]] = element["href"]
+	}
+	return byName, nil
+}
+
+// find a group of the external LDAP user domain, the organizational units are browsed
+// down to a few levels
+func findLdapGroup(href string, name string, depth int) (string, error) {
+	response, err := SmcInstance.GetHttp(href + "/browse")
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+	elements, err := utils.ResponseToMap(response.Body)
+	if err != nil {
+		return "", err
+	}
+	for _, element := range elements["result"] {
+		if element["type"] == "external_ldap_user_group" && element["name"] == name {
+			return element["href"], nil
+		}
+	}
+	if depth == 0 {
+		return "", nil
+	}
+	for _, element := range elements["result"] {
+		if element["type"] == "external_ldap_user" || element["type"] == "external_ldap_user_group" {
+			continue
+		}
+		if found, err := findLdapGroup(element["href"], name, depth-1); err != nil || found != "" {
+			return found, err
+		}
+	}
+	return "", nil
+}
+
+// create an SMC admin for every group of ROLE_MAPPINGS, with the mapped role in the granted domain.
+// Existing admins are kept, groups not yet synchronized to the LDAP domain are reported and skipped
+func createRoleAdmins() error {
+	mappings, err := lib.RoleMappings()
+	if err != nil {
+		return err
+	}
+	ldapAuthService, err := SmcInstance.FindExternalLdap()
+	if err != nil {
+		return err
+	}
+	ldapDomain, err := SmcInstance.ExternalLdapDomain(viper.GetString("DOMAIN_NAME"))
+	if err != nil {
+		return err
+	}
+	roles, err := smcElementsByName(SmcInstance.EntryPoints["role"])
+	if err != nil {
+		return errorWraper.Wrap(err, "failed in reading the SMC roles")
+	}
+	adminDomains, err := smcElementsByName(SmcInstance.EntryPoints["admin_domain"])
+	if err != nil {
+		return errorWraper.Wrap(err, "failed in reading the SMC admin domains")
+	}
+	admins, err := smcElementsByName(SmcInstance.EntryPoints["admin_user"])
+	if err != nil {
+		return errorWraper.Wrap(err, "failed in reading the SMC admins")
+	}
+	graphClient, err := AzureCLIInstance.GraphClient()
+	if err != nil {
+		return err
+	}
+	var failed []string
+	for _, mapping := range mappings {
+		groupName, err := roleAdminName(graphClient, mapping)
+		if err != nil {
+			logrus.Error(err)
+			failed = append(failed, mapping.GroupID)
+			continue
+		}
+		if _, ok := admins[groupName]; ok {
+			logrus.Infof("The SMC admin '%s' already exists", groupName)
+			continue
+		}
+		if err := createRoleAdmin(mapping, groupName, ldapAuthService["href"], ldapDomain["href"], roles,
+			adminDomains); err != nil {
+			logrus.Error(errorWraper.Wrap(err, "failed in creating the SMC admin "+groupName))
+			failed = append(failed, groupName)
+			continue
+		}
+		logrus.Infof("The SMC admin '%s' is been created with the role %s in %s", groupName, mapping.Role,
+			mapping.Domain)
+	}
+	if len(failed) != 0 {
+		return fmt.Errorf("failed in creating the SMC admins for the groups: %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// the SMC admin of a role mapping is named after its Azure AD group
+func roleAdminName(graphClient *graph.Client, mapping lib.RoleMapping) (string, error) {
+	if mapping.GroupID == "" {
+		return mapping.GroupName(), nil
+	}
+	group, err := graphClient.GetGroup(mapping.GroupID)
+	if err != nil {
+		return "", errorWraper.Wrap(err, "failed in reading the group "+mapping.GroupID)
+	}
+	return group.DisplayName, nil
+}
+
+func createRoleAdmin(mapping lib.RoleMapping, groupName string, authMethod string, ldapDomain string,
+	roles map[string]string, adminDomains map[string]string) error {
+	ldapGroup, err := findLdapGroup(ldapDomain, groupName, 3)
+	if err != nil {
+		return err
+	}
+	if ldapGroup == "" {
+		return fmt.Errorf("the group is not synchronized to the LDAP domain yet, run deploy-smc again later")
+	}
+	admin := smc.UserCreation{
+		Name:       groupName,
+		Enabled:    true,
+		AuthMethod: authMethod,
+		LdapUser:   ldapGroup,
+		Comment:    "created by bd-azure-smc-deployment",
+	}
+	if mapping.Role == lib.SuperuserRole {
+		admin.Superuser = true
+	} else {
+		roleRef, ok := roles[mapping.Role]
+		if !ok {
+			return fmt.Errorf("no SMC role found with the name '%s'", mapping.Role)
+		}
+		domainRef, ok := adminDomains[mapping.Domain]
+		if !ok {
+			return fmt.Errorf("no SMC admin domain found with the name '%s'", mapping.Domain)
+		}
+		admin.Permissions = map[string][]smc.Permission{
+			"permission": {{GrantedDomainRef: domainRef, RoleRef: roleRef, GrantedElements: []string{}}},
+		}
+	}
+	body, status, err := SmcInstance.CreateAdmin(&admin)
+	if err != nil {
+		return err
+	}
+	if status != http.StatusCreated {
+		r, _ := ioutil.ReadAll(body)
+		return errors.New(string(r))
+	}
+	return nil
+}
+
+// the name of the SMC trusted CA of the LDAPS certificate
+func trustedCAName(domainName string) string {
+	return domainName + " LDAPS CA"
+}
+
+// the certificate SMC must trust for LDAPS, the root of CA_CERT_FILE or the self-signed certificate of
+// the managed domain. It is nil when the certificate is signed by a CA the config does not know
+func ldapsTrustedCertificate() (*x509.Certificate, error) {
+	if caFile := viper.GetString("CA_CERT_FILE"); caFile != "" {
+		certificates, err := lib.ReadCertificates(caFile)
+		if err != nil {
+			return nil, err
+		}
+		return certificates[len(certificates)-1], nil
+	}
+	domainService, err := AzureCLIInstance.GetDomainService()
+	if err != nil {
+		return nil, err
+	}
+	der, err := base64.StdEncoding.DecodeString(domainService.Properties.LdapsSettings.PublicCertificate)
+	if err != nil {
+		return nil, errorWraper.Wrap(err, "failed in decoding the LDAPS certificate of the managed domain")
+	}
+	certificate, err := x509.ParseCertificate(der)
 	if err != nil {
-		logrus.Fatal("Failed in executing command dor changing password")
+		return nil, errorWraper.Wrap(err, "failed in reading the LDAPS certificate of the managed domain")
 	}
-	errorResult := string(stderr.Bytes())
-	if len(errorResult) != 0 {
-		if strings.Contains(errorResult, "specified password does not") {
-			logrus.Error("Strong password required. Combine at least three of the following: uppercase letters, lowercase letters, numbers, and symbols.")
-		} else {
-			logrus.Error(errorResult)
+	if !lib.SelfSigned(certificate) {
+		return nil, nil
+	}
+	return certificate, nil
+}
+
+// import the CA of the LDAPS certificate into SMC so that it trusts the managed domain, a trusted CA
+// with another certificate is replaced
+func createTrustedCA() error {
+	certificate, err := ldapsTrustedCertificate()
+	if err != nil {
+		return err
+	}
+	if certificate == nil {
+		logrus.Warn("The LDAPS certificate is signed by a CA which is not in CA_CERT_FILE, import its root " +
+			"into SMC as a trusted CA")
+		return nil
+	}
+	name := trustedCAName(viper.GetString("DOMAIN_NAME"))
+	certificatePEM := string(lib.EncodeCertificates([]*x509.Certificate{certificate}))
+	session, err := smcSession()
+	if err != nil {
+		return err
+	}
+	href, err := session.FindElement(lib.SmcTrustedCAType, name)
+	if err != nil {
+		return err
+	}
+	if href == "" {
+		_, err = session.CreateElement(lib.SmcTrustedCAType, map[string]string{
+			"name":        name,
+			"certificate": certificatePEM,
+		})
+		return err
+	}
+	var existing struct {
+		Certificate string `json:"certificate"`
+	}
+	if err := session.GetElement(href, &existing); err != nil {
+		return err
+	}
+	if existing.Certificate != "" {
+		if current, err := lib.ParseCertificates([]byte(existing.Certificate)); err == nil && current[0].Equal(certificate) {
+			logrus.Infof("SMC trusted CA '%s' exists", name)
+			return nil
 		}
 	}
-	return false
+	logrus.Infof("Replacing the certificate of the SMC trusted CA '%s'", name)
+	return session.UpdateElement(href, map[string]interface{}{"certificate": certificatePEM})
+}
+
+// the href of an SMC element by its type and name, empty when it does not exist
+func findSmcElement(elementType string, name string) (string, error) {
+	session, err := smcSession()
+	if err != nil {
+		return "", err
+	}
+	return session.FindElement(elementType, name)
 }
@@ -0,0 +1,609 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"github.cicd.cloud.fpdev.io/BD/bd-azure-smc-deployment/lib"
+	"github.cicd.cloud.fpdev.io/BD/bd-azure-smc-deployment/lib/arm"
+	"github.cicd.cloud.fpdev.io/BD/bd-azure-smc-deployment/lib/graph"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// one step of destroy, plan prints what run would delete
+type destroyStep struct {
+	name string
+	plan func(plan *lib.PlanPrinter) error
+	run  func() error
+}
+
+var destroyCmd = &cobra.Command{
+	Use:   "destroy",
+	Short: "Remove everything the deployment created",
+	Long: `Remove, in reverse order, the SMC admins of the role mappings, the SMC external LDAP user domain and Active Directory server,
+the AAD DS resource, VNet, NSG and resource group, the SCIM provisioning job, the service principal
+and app, and the SMC role groups. Every step can be skipped with --skip`,
+	Run: func(cmd *cobra.Command, args []string) {
+		skip, _ := cmd.Flags().GetStringSlice("skip")
+		planOnly, _ := cmd.Flags().GetBool("plan")
+		yes, _ := cmd.Flags().GetBool("yes")
+		if viper.GetString("OUTPUT") == lib.OutputJSON && !planOnly && !yes {
+			// the confirmation cannot be asked on a stream of events
+			logrus.Fatal("destroy with the json output needs --yes")
+		}
+		steps, err := destroySteps(skip)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		if err := AzureCLIInstance.Login(); err != nil {
+			logrus.Fatal(err)
+		}
+		if needsSmc(steps) {
+			if err := smcLogin(); err != nil {
+				logrus.Fatal(errors.Wrap(err, "failed in login to SMC"))
+			}
+		}
+		plan := newPlanPrinter()
+		plan.Section("Destroy plan")
+		var planFailed []string
+		for _, step := range steps {
+			if err := step.plan(plan); err != nil {
+				logrus.Error(errors.Wrap(err, "failed in planning the step "+step.name))
+				planFailed = append(planFailed, step.name)
+			}
+		}
+		for _, name := range skip {
+			plan.Item(lib.PlanNoChange, "skipped: %s", name)
+		}
+		var failed []string
+		if !planOnly && (yes || confirm("Do you really want to destroy these resources? Only 'yes' will be accepted: ")) {
+			failed = runDestroySteps(steps)
+			if len(failed) == 0 && len(skip) == 0 {
+				resetState()
+			}
+		}
+		if err := AzureCLIInstance.Logout(); err != nil {
+			logrus.Error(err)
+		}
+		smcLogout()
+		if planOnly && len(planFailed) != 0 {
+			logrus.Fatalf("The plan of the following destroy steps failed: %s", strings.Join(planFailed, ", "))
+		}
+		if len(failed) != 0 {
+			logrus.Fatalf("The following destroy steps failed: %s", strings.Join(failed, ", "))
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(destroyCmd)
+	destroyCmd.Flags().Bool("plan", false, "print what would be removed without removing anything")
+	destroyCmd.Flags().BoolP("yes", "y", false, "do not ask for a confirmation")
+	destroyCmd.Flags().StringSlice("skip", nil, fmt.Sprintf("steps to skip, any of: %s",
+		strings.Join(destroyStepNames, ", ")))
+}
+
+// the destroy steps, in the order they are executed
+var destroyStepNames = []string{"smc-role-admins", "smc-ldap-domain", "smc-ad-server", "smc-trusted-ca",
+	"domain-services", "vnet", "nsg", "resource-group", "scim-job", "app", "groups"}
+
+func needsSmc(steps []destroyStep) bool {
+	for _, step := range steps {
+		if strings.HasPrefix(step.name, "smc-") {
+			return true
+		}
+	}
+	return false
+}
+
+func confirm(question string) bool {
+	fmt.Fprint(ReporterInstance.Writer(), question)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	return strings.TrimSpace(answer) == "yes"
+}
+
+// run every step, a failing step does not stop the ones after it
+func runDestroySteps(steps []destroyStep) []string {
+	var failed []string
+	for _, step := range steps {
+		ReporterInstance.Report(lib.Event{Type: lib.EventStepStarted, Step: step.name})
+		started := time.Now()
+		if err := step.run(); err != nil {
+			ReporterInstance.Report(lib.Event{Type: lib.EventStepFailed, Step: step.name, Error: err.Error(),
+				ElapsedSeconds: time.Since(started).Seconds()})
+			failed = append(failed, step.name)
+			continue
+		}
+		ReporterInstance.Report(lib.Event{Type: lib.EventStepFinished, Step: step.name,
+			ElapsedSeconds: time.Since(started).Seconds()})
+	}
+	return failed
+}
+
+// the deployment state is meaningless once everything is removed
+func resetState() {
+	state, err := lib.LoadState(viper.GetString("STATE_FILE"))
+	if err == nil {
+		err = state.Reset()
+	}
+	if err != nil {
+		logrus.Error(err)
+	}
+}
+
+func destroySteps(skip []string) ([]destroyStep, error) {
+	skipped := make(map[string]bool)
+	for _, name := range skip {
+		found := false
+		for _, known := range destroyStepNames {
+			found = found || known == name
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown destroy step '%s', expected any of: %s", name,
+				strings.Join(destroyStepNames, ", "))
+		}
+		skipped[name] = true
+	}
+	all := map[string]destroyStep{
+		"smc-role-admins": smcRoleAdminsDestroyStep(),
+		"smc-ldap-domain": smcDestroyStep("smc-ldap-domain", "SMC external LDAP user domain",
+			lib.SmcLdapDomainType, viper.GetString("DOMAIN_NAME")),
+		"smc-ad-server": smcDestroyStep("smc-ad-server", "SMC Active Directory server",
+			lib.SmcActiveDirectoryType, viper.GetString("DOMAIN_NAME")),
+		"smc-trusted-ca": smcDestroyStep("smc-trusted-ca", "SMC trusted CA", lib.SmcTrustedCAType,
+			trustedCAName(viper.GetString("DOMAIN_NAME"))),
+		"domain-services": resourceDestroyStep("domain-services", lib.DomainServicesType,
+			viper.GetString("DOMAIN_NAME"), lib.DomainServicesApiVersion),
+		"vnet": resourceDestroyStep("vnet", lib.VirtualNetworkType,
+			viper.GetString("DOMAIN_SERVICES_VNET_NAME"), lib.NetworkApiVersion),
+		"nsg": resourceDestroyStep("nsg", lib.NetworkSecurityGroupType,
+			lib.NetworkSecurityGroupName(), lib.NetworkApiVersion),
+		"resource-group": resourceGroupDestroyStep(),
+		"scim-job":       scimJobDestroyStep(),
+		"app":            appDestroyStep(),
+		"groups":         groupsDestroyStep(),
+	}
+	if !lib.RoleMappingsConfigured() {
+		// deploy-smc created no admins, the admins named after the default roles are not ours
+		all["smc-role-admins"] = keptDestroyStep("smc-role-admins", "the SMC admins",
+			"neither ROLE_MAPPINGS nor CREATE_GROUPS_SMC is set")
+	}
+	if lib.ExistingVnet() {
+		// the network existed before the deployment, it is not ours to delete
+		existed := "it existed before the deployment"
+		all["vnet"] = keptDestroyStep("vnet", "the existing VNet "+viper.GetString("DOMAIN_SERVICES_VNET_NAME"),
+			existed)
+		all["nsg"] = keptDestroyStep("nsg", "the NSG of the existing subnet", existed)
+		if strings.EqualFold(lib.VnetResourceGroup(), viper.GetString("RESOURCE_GROUP")) {
+			all["resource-group"] = keptDestroyStep("resource-group",
+				"the resource group "+viper.GetString("RESOURCE_GROUP")+" with the existing VNet", existed)
+		}
+	}
+	var steps []destroyStep
+	for _, name := range destroyStepNames {
+		if !skipped[name] {
+			steps = append(steps, all[name])
+		}
+	}
+	return steps, nil
+}
+
+// an SMC element found by its type and name, a failing lookup is an error and not an absent element
+func smcDestroyStep(name string, description string, elementType string, elementName string) destroyStep {
+	return destroyStep{
+		name: name,
+		plan: func(plan *lib.PlanPrinter) error {
+			href, err := findSmcElement(elementType, elementName)
+			if err != nil {
+				return err
+			}
+			if href == "" {
+				plan.Item(lib.PlanNoChange, "%s '%s' not found", description, elementName)
+				return nil
+			}
+			plan.Item(lib.PlanDelete, "%s '%s'", description, elementName)
+			return nil
+		},
+		run: func() error {
+			href, err := findSmcElement(elementType, elementName)
+			if err != nil {
+				return errors.Wrap(err, "failed in finding the "+description)
+			}
+			if href == "" {
+				logrus.Infof("%s '%s' not found", description, elementName)
+				return nil
+			}
+			return deleteSmcElements([]string{href})
+		},
+	}
+}
+
+// delete SMC elements by href, fp-smc-golang has no delete so the SMC session of the run is used
+func deleteSmcElements(hrefs []string) error {
+	session, err := smcSession()
+	if err != nil {
+		return err
+	}
+	for _, href := range hrefs {
+		if err := session.Delete(href); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// the SMC admins created for ROLE_MAPPINGS, by name
+func roleAdmins() (map[string]string, error) {
+	mappings, err := lib.RoleMappings()
+	if err != nil {
+		return nil, err
+	}
+	admins, err := smcElementsByName(SmcInstance.EntryPoints["admin_user"])
+	if err != nil {
+		return nil, err
+	}
+	graphClient, err := AzureCLIInstance.GraphClient()
+	if err != nil {
+		return nil, err
+	}
+	found := make(map[string]string)
+	for _, mapping := range mappings {
+		name, err := roleAdminName(graphClient, mapping)
+		if err != nil {
+			return nil, err
+		}
+		if href, ok := admins[name]; ok {
+			found[name] = href
+		}
+	}
+	return found, nil
+}
+
+func smcRoleAdminsDestroyStep() destroyStep {
+	return destroyStep{
+		name: "smc-role-admins",
+		plan: func(plan *lib.PlanPrinter) error {
+			admins, err := roleAdmins()
+			if err != nil {
+				return err
+			}
+			if len(admins) == 0 {
+				plan.Item(lib.PlanNoChange, "no SMC admin found for the role mappings")
+			}
+			for name := range admins {
+				plan.Item(lib.PlanDelete, "SMC admin '%s'", name)
+			}
+			return nil
+		},
+		run: func() error {
+			admins, err := roleAdmins()
+			if err != nil {
+				return err
+			}
+			var hrefs []string
+			for _, href := range admins {
+				hrefs = append(hrefs, href)
+			}
+			return deleteSmcElements(hrefs)
+		},
+	}
+}
+
+// a resource of the deployment template
+func resourceDestroyStep(name string, resourceType string, resourceName string, apiVersion string) destroyStep {
+	resourceID := func() (*arm.Client, string, error) {
+		client, err := AzureCLIInstance.ArmClient()
+		if err != nil {
+			return nil, "", err
+		}
+		return client, client.ResourceID(viper.GetString("RESOURCE_GROUP"), resourceType, resourceName), nil
+	}
+	return destroyStep{
+		name: name,
+		plan: func(plan *lib.PlanPrinter) error {
+			client, id, err := resourceID()
+			if err != nil {
+				return err
+			}
+			if _, err := client.GetResource(id, apiVersion); arm.IsStatus(err, http.StatusNotFound) {
+				plan.Item(lib.PlanNoChange, "%s not found", id)
+				return nil
+			} else if err != nil {
+				return err
+			}
+			plan.Item(lib.PlanDelete, "%s", id)
+			return nil
+		},
+		run: func() error {
+			client, id, err := resourceID()
+			if err != nil {
+				return err
+			}
+			if err := client.DeleteResource(id, apiVersion); err != nil && !arm.IsStatus(err, http.StatusNotFound) {
+				return err
+			}
+			return nil
+		},
+	}
+}
+
+// a step which leaves a resource the tool did not create alone
+func keptDestroyStep(name string, description string, reason string) destroyStep {
+	return destroyStep{
+		name: name,
+		plan: func(plan *lib.PlanPrinter) error {
+			plan.Item(lib.PlanNoChange, "%s is kept, %s", description, reason)
+			return nil
+		},
+		run: func() error {
+			logrus.Infof("%s is kept, %s", description, reason)
+			return nil
+		},
+	}
+}
+
+// the resource group, it is only deleted when deploy-azure created it. A group which existed before
+// keeps everything but the resources of the template, which the other steps delete one by one
+func resourceGroupDestroyStep() destroyStep {
+	resourceGroup := viper.GetString("RESOURCE_GROUP")
+	created := func() (bool, error) {
+		state, err := loadState()
+		if err != nil {
+			return false, err
+		}
+		return resourceGroupCreated(state, resourceGroup), nil
+	}
+	return destroyStep{
+		name: "resource-group",
+		plan: func(plan *lib.PlanPrinter) error {
+			client, err := AzureCLIInstance.ArmClient()
+			if err != nil {
+				return err
+			}
+			exists, err := client.ResourceGroupExists(resourceGroup)
+			if err != nil {
+				return err
+			}
+			if !exists {
+				plan.Item(lib.PlanNoChange, "resource group %s not found", resourceGroup)
+				return nil
+			}
+			ours, err := created()
+			if err != nil {
+				return err
+			}
+			if !ours {
+				plan.Item(lib.PlanNoChange, "resource group %s is kept, the deployment did not create it", resourceGroup)
+				return nil
+			}
+			plan.Item(lib.PlanDelete, "resource group %s with all its remaining resources", resourceGroup)
+			return nil
+		},
+		run: func() error {
+			ours, err := created()
+			if err != nil {
+				return err
+			}
+			if !ours {
+				logrus.Infof("The resource group %s is kept, the deployment did not create it", resourceGroup)
+				return nil
+			}
+			client, err := AzureCLIInstance.ArmClient()
+			if err != nil {
+				return err
+			}
+			if err := client.DeleteResourceGroup(resourceGroup); err != nil && !arm.IsStatus(err, http.StatusNotFound) {
+				return err
+			}
+			return nil
+		},
+	}
+}
+
+// the object ids of the app and of its service principal: the ones deploy-app recorded in the state
+// file, or else the single app named APP_NAME and its service principal. An id is empty when the
+// object does not exist
+func findApp() (*graph.Client, string, string, error) {
+	appName := viper.GetString("APP_NAME")
+	client, err := AzureCLIInstance.GraphClient()
+	if err != nil {
+		return nil, "", "", err
+	}
+	state, err := loadState()
+	if err != nil {
+		return nil, "", "", err
+	}
+	if results := state.Results("app"); results["appName"] == appName && results["appObjectId"] != "" {
+		appID, spID := results["appObjectId"], results["servicePrincipalId"]
+		if _, err := client.GetApplication(appID); graph.IsStatus(err, http.StatusNotFound) {
+			appID = ""
+		} else if err != nil {
+			return nil, "", "", err
+		}
+		if _, err := client.GetServicePrincipal(spID); graph.IsStatus(err, http.StatusNotFound) {
+			spID = ""
+		} else if err != nil {
+			return nil, "", "", err
+		}
+		return client, appID, spID, nil
+	}
+	apps, err := client.FindApplications(appName)
+	if err != nil {
+		return nil, "", "", err
+	}
+	if len(apps) > 1 {
+		return nil, "", "", fmt.Errorf("%d apps are named '%s' and the state file does not record which one "+
+			"deploy-app created, delete it by hand", len(apps), appName)
+	}
+	servicePrincipals, err := client.FindServicePrincipals(appName)
+	if err != nil {
+		return nil, "", "", err
+	}
+	var appID string
+	var matching []graph.ServicePrincipal
+	for _, sp := range servicePrincipals {
+		if len(apps) == 0 || sp.AppID == apps[0].AppID {
+			matching = append(matching, sp)
+		}
+	}
+	if len(matching) > 1 {
+		return nil, "", "", fmt.Errorf("%d service principals are named '%s' and the state file does not record "+
+			"which one deploy-app created, delete it by hand", len(matching), appName)
+	}
+	if len(apps) != 0 {
+		appID = apps[0].ID
+	}
+	if len(matching) == 0 {
+		return client, appID, "", nil
+	}
+	return client, appID, matching[0].ID, nil
+}
+
+func scimJobDestroyStep() destroyStep {
+	return destroyStep{
+		name: "scim-job",
+		plan: func(plan *lib.PlanPrinter) error {
+			client, _, spID, err := findApp()
+			if err != nil {
+				return err
+			}
+			if spID == "" {
+				plan.Item(lib.PlanNoChange, "no service principal found for the app '%s'", viper.GetString("APP_NAME"))
+				return nil
+			}
+			jobs, err := client.ListSynchronizationJobs(spID)
+			if err != nil {
+				return err
+			}
+			if len(jobs) == 0 {
+				plan.Item(lib.PlanNoChange, "no SCIM provisioning job found")
+			}
+			for _, job := range jobs {
+				plan.Item(lib.PlanDelete, "SCIM provisioning job %s", job.ID)
+			}
+			return nil
+		},
+		run: func() error {
+			client, _, spID, err := findApp()
+			if err != nil || spID == "" {
+				return err
+			}
+			jobs, err := client.ListSynchronizationJobs(spID)
+			if err != nil {
+				return err
+			}
+			for _, job := range jobs {
+				if err := client.DeleteSynchronizationJob(spID, job.ID); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	}
+}
+
+func appDestroyStep() destroyStep {
+	appName := viper.GetString("APP_NAME")
+	return destroyStep{
+		name: "app",
+		plan: func(plan *lib.PlanPrinter) error {
+			_, appID, spID, err := findApp()
+			if err != nil {
+				return err
+			}
+			if spID != "" {
+				plan.Item(lib.PlanDelete, "service principal %s of the app '%s'", spID, appName)
+			}
+			if appID == "" {
+				plan.Item(lib.PlanNoChange, "app '%s' not found", appName)
+			} else {
+				plan.Item(lib.PlanDelete, "app '%s' (%s)", appName, appID)
+			}
+			return nil
+		},
+		run: func() error {
+			client, appID, spID, err := findApp()
+			if err != nil {
+				return err
+			}
+			if spID != "" {
+				if err := client.DeleteServicePrincipal(spID); err != nil && !graph.IsStatus(err, http.StatusNotFound) {
+					return err
+				}
+			}
+			if appID != "" {
+				if err := client.DeleteApplication(appID); err != nil && !graph.IsStatus(err, http.StatusNotFound) {
+					return err
+				}
+			}
+			return nil
+		},
+	}
+}
+
+// the SMC role groups and the object ids and statuses deploy-azure recorded for them. Only the groups
+// it created are deleted, the groups which existed before and the ones mapped by object id are kept
+func roleGroups() ([]string, map[string]string, error) {
+	names, err := smcGroups()
+	if err != nil {
+		return nil, nil, err
+	}
+	state, err := loadState()
+	if err != nil {
+		return nil, nil, err
+	}
+	return names, state.Results("groups"), nil
+}
+
+func groupsDestroyStep() destroyStep {
+	return destroyStep{
+		name: "groups",
+		plan: func(plan *lib.PlanPrinter) error {
+			names, recorded, err := roleGroups()
+			if err != nil {
+				return err
+			}
+			for _, name := range names {
+				switch {
+				case recorded[groupStatusKey(name)] == lib.GroupCreated && recorded[name] != "":
+					plan.Item(lib.PlanDelete, "group '%s' (%s)", name, recorded[name])
+				case recorded[groupStatusKey(name)] == lib.GroupExisting:
+					plan.Item(lib.PlanNoChange, "group '%s' is kept, it existed before the deployment", name)
+				default:
+					plan.Item(lib.PlanNoChange, "group '%s' was not created by deploy-azure", name)
+				}
+			}
+			return nil
+		},
+		run: func() error {
+			names, recorded, err := roleGroups()
+			if err != nil {
+				return err
+			}
+			client, err := AzureCLIInstance.GraphClient()
+			if err != nil {
+				return err
+			}
+			var failed []string
+			for _, name := range names {
+				if recorded[groupStatusKey(name)] != lib.GroupCreated || recorded[name] == "" {
+					continue
+				}
+				if err := client.DeleteGroup(recorded[name]); err != nil && !graph.IsStatus(err, http.StatusNotFound) {
+					logrus.Error(errors.Wrap(err, "failed in deleting the group "+name))
+					failed = append(failed, name)
+				}
+			}
+			if len(failed) != 0 {
+				return fmt.Errorf("failed in deleting the groups: %s", strings.Join(failed, ", "))
+			}
+			return nil
+		},
+	}
+}
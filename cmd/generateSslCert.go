@@ -7,43 +7,243 @@ import (
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
 )
 
+// the output formats of generate-ssl-cert
+var certFormats = []string{lib.CertFormatBase64, lib.CertFormatPFX, lib.CertFormatPEM, lib.CertFormatConfig}
+
 var generateSslCertCmd = &cobra.Command{
 	Use:   "generate-ssl-cert",
 	Short: "Generate PFX Base64 certificate",
-	Long:  `This certificate will be used for Azure AD DS LDAP`,
+	Long: `This certificate will be used for Azure AD DS LDAP. It is generated in memory,
+use --out-dir to keep the private key, the certificate and the PFX as files.
+
+CERT_MODE selects how the certificate is signed:
+  self-signed  the certificate signs itself (default)
+  ca           the CA of CA_CERT_FILE and CA_KEY_FILE signs it, the PFX holds the chain
+  csr          run with --csr --out-dir to get a certificate request and its key, then with
+               --import-cert once the request is signed
+
+--format selects where the certificate goes, the formats can be combined:
+  base64  the base64 PFX is printed (default)
+  pfx     cert.pfx in --out-dir
+  pem     private.pem, public.pem and ca.pem in --out-dir
+  config  PFX_CERTIFICATE_BASE64 of the config file is set to the base64 PFX`,
 	Run: func(cmd *cobra.Command, args []string) {
-		generator := lib.SSLCertGenerator{
-			Days:         viper.GetInt("PFX_CERTIFICATE_EXPIRY_DAYS"),
-			Domain:       viper.GetString("DOMAIN_NAME"),
-			Password:     viper.GetString("PFX_CERTIFICATE_PASSWORD"),
-			TmpDirectory: "",
-		}
-		if err := generator.CreateTempFile(); err != nil {
-			logrus.Error(errors.Wrap(err, "failed in creating temp file"))
+		outDir, _ := cmd.Flags().GetString("out-dir")
+		csr, _ := cmd.Flags().GetBool("csr")
+		importCert, _ := cmd.Flags().GetString("import-cert")
+		keyFile, _ := cmd.Flags().GetString("key")
+		formats, _ := cmd.Flags().GetStringSlice("format")
+		if !cmd.Flags().Changed("format") && outDir != "" {
+			formats = []string{lib.CertFormatBase64, lib.CertFormatPFX, lib.CertFormatPEM}
 		}
-		if err := generator.GeneratePrivateKey(); err != nil {
-			logrus.Error(errors.Wrap(err, "failed in creating private key"))
+		if csr {
+			output, err := generateCertificateRequest(outDir)
+			if err != nil {
+				logrus.Fatal(err)
+			}
+			fmt.Println(output)
+			return
 		}
-		if err := generator.GeneratePublicKey(); err != nil {
-			logrus.Error(errors.Wrap(err, "failed in creating public key"))
+		var generator *lib.SSLCertGenerator
+		var err error
+		if importCert != "" {
+			if keyFile == "" && outDir != "" {
+				keyFile = filepath.Join(outDir, "private.pem")
+			}
+			generator, err = importedCertificate(importCert, keyFile)
+		} else {
+			generator, err = newCertificate()
 		}
-		if err := generator.GeneratePFX(); err != nil {
-			logrus.Error(errors.Wrap(err, "failed in generating PFX"))
-		}
-		if err := generator.ConvertToBase64(); err != nil {
-			logrus.Error(errors.Wrap(err, "failed in converting to base64"))
-		}
-		output, err := generator.OutputBase64()
 		if err != nil {
-			fmt.Println(err)
+			logrus.Fatal(err)
+		}
+		if err := outputCertificate(generator, formats, outDir); err != nil {
+			logrus.Fatal(err)
 		}
-		fmt.Println(string(output))
-		generator.CleanUp()
 	},
 }
 
 func init() {
 	rootCmd.AddCommand(generateSslCertCmd)
+	generateSslCertCmd.Flags().String("out-dir", "",
+		"write private.pem, public.pem, ca.pem and cert.pfx into this directory, nothing is written by default")
+	generateSslCertCmd.Flags().Bool("csr", false,
+		"write a certificate request and its private key into --out-dir instead of a certificate")
+	generateSslCertCmd.Flags().String("import-cert", "",
+		"a PEM file with the certificate signed from the request and its chain, it is bundled with the key into the PFX")
+	generateSslCertCmd.Flags().String("key", "", "the private key of the request, private.pem of --out-dir by default")
+	generateSslCertCmd.Flags().StringSlice("format", []string{lib.CertFormatBase64},
+		fmt.Sprintf("where the certificate goes, one or more of: %s", strings.Join(certFormats, ", ")))
+	generateSslCertCmd.Flags().String("key-type", "",
+		"the type of the key: rsa2048, rsa3072, rsa4096 or ecdsa-p256, ecdsa-p384")
+	if err := viper.BindPFlag("CERT_KEY_TYPE", generateSslCertCmd.Flags().Lookup("key-type")); err != nil {
+		logrus.Fatal(err.Error())
+	}
+	generateSslCertCmd.Flags().StringSlice("san", nil,
+		"a DNS name or ip address the certificate is issued for besides *.<domain>, the flag can be repeated")
+	if err := viper.BindPFlag("CERT_SANS", generateSslCertCmd.Flags().Lookup("san")); err != nil {
+		logrus.Fatal(err.Error())
+	}
+	generateSslCertCmd.Flags().String("subject", "", "the subject fields besides the common name, like O=Forcepoint,C=US")
+	if err := viper.BindPFlag("CERT_SUBJECT", generateSslCertCmd.Flags().Lookup("subject")); err != nil {
+		logrus.Fatal(err.Error())
+	}
+}
+
+// the generator of the config, its key type, subject and SANs are validated
+func certificateGenerator() (*lib.SSLCertGenerator, error) {
+	keyType, err := lib.KeyType(viper.GetString("CERT_KEY_TYPE"))
+	if err != nil {
+		return nil, err
+	}
+	subject, err := lib.ParseSubject(viper.GetString("CERT_SUBJECT"))
+	if err != nil {
+		return nil, err
+	}
+	return &lib.SSLCertGenerator{
+		Days:     viper.GetInt("PFX_CERTIFICATE_EXPIRY_DAYS"),
+		Domain:   viper.GetString("DOMAIN_NAME"),
+		Password: viper.GetString("PFX_CERTIFICATE_PASSWORD"),
+		KeyType:  keyType,
+		Subject:  subject,
+		SANs:     viper.GetStringSlice("CERT_SANS"),
+	}, nil
+}
+
+// generate the LDAPS certificate of the domain as a base64 PFX, the files are only written when
+// outDir is set
+func generateCertificate(outDir string) (string, error) {
+	generator, err := newCertificate()
+	if err != nil {
+		return "", err
+	}
+	if outDir != "" {
+		if err := generator.WriteFiles(outDir); err != nil {
+			return "", errors.Wrap(err, "failed in writing the certificate files")
+		}
+	}
+	return generator.Base64(), nil
+}
+
+// generate the LDAPS certificate of the domain in memory, self-signed or signed by the CA of CERT_MODE
+func newCertificate() (*lib.SSLCertGenerator, error) {
+	mode, err := lib.CertMode(viper.GetString("CERT_MODE"))
+	if err != nil {
+		return nil, err
+	}
+	generator, err := certificateGenerator()
+	if err != nil {
+		return nil, err
+	}
+	switch mode {
+	case lib.CertModeCSR:
+		return nil, errors.New("CERT_MODE is csr, run generate-ssl-cert with --csr and then with --import-cert")
+	case lib.CertModeCA:
+		generator.CACertificates, generator.CAKey, err = lib.ReadCA(viper.GetString("CA_CERT_FILE"),
+			viper.GetString("CA_KEY_FILE"))
+		if err != nil {
+			return nil, errors.Wrap(err, "failed in reading the CA")
+		}
+	}
+	if err := generator.Generate(); err != nil {
+		return nil, errors.Wrap(err, "failed in generating the certificate")
+	}
+	return generator, nil
+}
+
+// send the certificate to the outputs of the formats, the files go into outDir
+func outputCertificate(generator *lib.SSLCertGenerator, formats []string, outDir string) error {
+	for _, format := range formats {
+		format = strings.ToLower(strings.TrimSpace(format))
+		if !contains(certFormats, format) {
+			return fmt.Errorf("unknown format '%s', expected one of: %s", format, strings.Join(certFormats, ", "))
+		}
+		if (format == lib.CertFormatPFX || format == lib.CertFormatPEM) && outDir == "" {
+			return fmt.Errorf("the format %s needs --out-dir", format)
+		}
+	}
+	for _, format := range formats {
+		switch strings.ToLower(strings.TrimSpace(format)) {
+		case lib.CertFormatBase64:
+			fmt.Println(generator.Base64())
+		case lib.CertFormatPFX:
+			if err := generator.WritePFX(outDir); err != nil {
+				return errors.Wrap(err, "failed in writing the PFX")
+			}
+			logrus.Infof("The PFX is in %s", filepath.Join(outDir, "cert.pfx"))
+		case lib.CertFormatPEM:
+			if err := generator.WritePEM(outDir); err != nil {
+				return errors.Wrap(err, "failed in writing the PEM files")
+			}
+			logrus.Infof("The certificate is in %s, the private key in %s", filepath.Join(outDir, "public.pem"),
+				filepath.Join(outDir, "private.pem"))
+		case lib.CertFormatConfig:
+			if err := lib.SetConfigValue(viper.ConfigFileUsed(), "PFX_CERTIFICATE_BASE64", generator.Base64()); err != nil {
+				return errors.Wrap(err, "failed in writing the certificate into the config")
+			}
+			logrus.Infof("PFX_CERTIFICATE_BASE64 of %s is set", viper.ConfigFileUsed())
+		}
+	}
+	return nil
+}
+
+// write a certificate request for the domain with its private key, the key stays in outDir until the
+// signed certificate is imported
+func generateCertificateRequest(outDir string) (string, error) {
+	if outDir == "" {
+		return "", errors.New("--csr needs --out-dir to keep the private key of the request")
+	}
+	generator, err := certificateGenerator()
+	if err != nil {
+		return "", err
+	}
+	if err := generator.GenerateCSR(); err != nil {
+		return "", errors.Wrap(err, "failed in generating the certificate request")
+	}
+	if err := generator.WriteFiles(outDir); err != nil {
+		return "", errors.Wrap(err, "failed in writing the certificate request")
+	}
+	logrus.Infof("The certificate request is in %s, the private key in %s", filepath.Join(outDir, "request.csr"),
+		filepath.Join(outDir, "private.pem"))
+	return string(generator.CSR), nil
+}
+
+// bundle a certificate signed from the request with the key of the request into a PFX, the
+// certificates of CA_CERT_FILE complete its chain
+func importedCertificate(certificateFile string, keyFile string) (*lib.SSLCertGenerator, error) {
+	if keyFile == "" {
+		return nil, errors.New("--import-cert needs --key or the --out-dir of the request")
+	}
+	generator, err := certificateGenerator()
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	if generator.PrivateKey, err = lib.ParsePrivateKey(keyPEM); err != nil {
+		return nil, errors.Wrap(err, "failed in reading the private key "+keyFile)
+	}
+	if caFile := viper.GetString("CA_CERT_FILE"); caFile != "" {
+		if generator.CACertificates, err = lib.ReadCertificates(caFile); err != nil {
+			return nil, err
+		}
+	}
+	certificatePEM, err := ioutil.ReadFile(certificateFile)
+	if err != nil {
+		return nil, err
+	}
+	if err := generator.ImportCertificate(certificatePEM); err != nil {
+		return nil, errors.Wrap(err, "failed in importing the certificate")
+	}
+	if err := generator.GeneratePFX(); err != nil {
+		return nil, errors.Wrap(err, "failed in generating PFX")
+	}
+	return generator, nil
 }
@@ -9,16 +9,21 @@ import (
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 	"os"
+	"path/filepath"
 )
 
 var cfgFile string
 var AzureCLIInstance lib.AzureCLI
+var ReporterInstance lib.Reporter
 
 var rootCmd = &cobra.Command{
 	Use:   "bd-azure-smc-deployment",
 	Short: "Deployment application",
 	Long: `Deployment application is used to deploy Azure template for Azure AD DS with external LDAP 
 enabled, Create required elements in Forcepoint SMC and generate BASE64 certificate for Azure AD DS LDAP `,
+	PersistentPostRun: func(cmd *cobra.Command, args []string) {
+		ReporterInstance.Close()
+	},
 }
 
 func Execute() {
@@ -31,6 +36,26 @@ func Execute() {
 func init() {
 	cobra.OnInitialize(initConfig)
 	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "the config file)")
+	rootCmd.PersistentFlags().String("auth-mode", "",
+		"azure auth mode: password, client-secret, client-certificate, device-code or session")
+	if err := viper.BindPFlag("AZURE_AUTH_MODE", rootCmd.PersistentFlags().Lookup("auth-mode")); err != nil {
+		logrus.Fatal(err.Error())
+	}
+	rootCmd.PersistentFlags().String("executor", "",
+		"how azure commands and the ARM and Graph calls are executed: cli, record or replay")
+	if err := viper.BindPFlag("AZURE_EXECUTOR", rootCmd.PersistentFlags().Lookup("executor")); err != nil {
+		logrus.Fatal(err.Error())
+	}
+	rootCmd.PersistentFlags().String("fixtures", "",
+		"the fixtures file used by the record and replay executors")
+	if err := viper.BindPFlag("AZURE_FIXTURES", rootCmd.PersistentFlags().Lookup("fixtures")); err != nil {
+		logrus.Fatal(err.Error())
+	}
+	rootCmd.PersistentFlags().String("output", "",
+		"how progress is reported: auto, bar, text or json, auto picks bar on a terminal and text otherwise")
+	if err := viper.BindPFlag("OUTPUT", rootCmd.PersistentFlags().Lookup("output")); err != nil {
+		logrus.Fatal(err.Error())
+	}
 	//if err := rootCmd.MarkPersistentFlagRequired("config"); err != nil {
 	//	log.Fatal(err.Error())
 	//}
@@ -41,6 +66,12 @@ func initConfig() {
 	viper.SetDefault("AZURE_ADMIN_LOGIN_NAME", "")
 	viper.SetDefault("APP_NAME", "")
 	viper.SetDefault("AZURE_ADMIN_LOGIN_PASSWORD", "")
+	viper.SetDefault("AZURE_AUTH_MODE", lib.AuthPassword)
+	viper.SetDefault("AZURE_AUTHORITY", "https://login.microsoftonline.com")
+	viper.SetDefault("AZURE_TENANT_ID", "")
+	viper.SetDefault("AZURE_CLIENT_ID", "")
+	viper.SetDefault("AZURE_CLIENT_SECRET", "")
+	viper.SetDefault("AZURE_CLIENT_CERTIFICATE", "")
 	viper.SetDefault("RESOURCE_GROUP", "forcepoint-smc-integration")
 	viper.SetDefault("LOCATION", "westeurope")
 	viper.SetDefault("DOMAIN_SERVICES_VNET_NAME", "domain-services-vnet")
@@ -50,11 +81,52 @@ func initConfig() {
 	viper.SetDefault("LOGGER_JSON_FORMAT", false)
 	viper.SetDefault("DEPLOYMENT_TEMPLATE", "/app/azure_smc_template.json")
 	viper.SetDefault("SCIM_TEMPLATE", "/app/scim_template.json")
-	viper.SetDefault("PARAMETERS_PATH", "/tmp")
+	viper.SetDefault("DEPLOYMENT_NAME_PREFIX", "")
+	viper.SetDefault("ARM_ENDPOINT", "https://management.azure.com")
+	viper.SetDefault("SUBSCRIPTION_ID", "")
+	viper.SetDefault("GRAPH_ENDPOINT", "https://graph.microsoft.com")
 	viper.SetDefault("CREATE_GROUPS_SMC", false)
+	viper.SetDefault("WAIT_HEALTHY", false)
+	viper.SetDefault("WAIT_HEALTHY_TIMEOUT", "90m")
+	viper.SetDefault("LDAPS_EXTERNAL_IP_ADDRESS", "")
+	viper.SetDefault("PFX_CERTIFICATE_EXPIRY_DAYS", 365)
+	viper.SetDefault("CERT_MODE", lib.CertModeSelfSigned)
+	viper.SetDefault("CA_CERT_FILE", "")
+	viper.SetDefault("CA_KEY_FILE", "")
+	viper.SetDefault("CERT_KEY_TYPE", lib.DefaultKeyType)
+	viper.SetDefault("CERT_SANS", []string{})
+	viper.SetDefault("CERT_SUBJECT", "")
+	viper.SetDefault("CERT_EXPIRY_WINDOW_DAYS", 30)
+	viper.SetDefault("PFX_OUT_FILE", "")
 	viper.SetDefault("SMC.PORT", "8082")
 	viper.SetDefault("SMC.API_VERSION", "6.7")
 	viper.SetDefault("app.url", "https://217.182.25.38")
+	viper.SetDefault("AZURE_EXECUTOR", lib.CLIExecutorName)
+	viper.SetDefault("AZURE_FIXTURES", "")
+	viper.SetDefault("GROUPS_PARALLELISM", 4)
+	viper.SetDefault("GROUP_PREFIX", "")
+	viper.SetDefault("DNS_SERVERS", []string{})
+	viper.SetDefault("EXISTING_VNET", false)
+	viper.SetDefault("UPDATE_EXISTING_VNET_DNS", false)
+	viper.SetDefault("VNET_RESOURCE_GROUP", "")
+	viper.SetDefault("EXISTING_NSG_MODE", lib.NsgModeValidate)
+	viper.SetDefault("LDAPS_ALLOWED_CIDRS", []string{})
+	viper.SetDefault("NSG_PROFILE", lib.NsgProfileDefault)
+	viper.SetDefault("DOMAIN_SECURITY_PRESET", lib.DomainSecurityPresetLegacy)
+	viper.SetDefault("DOMAIN_SKU", "Enterprise")
+	viper.SetDefault("FILTERED_SYNC", false)
+	viper.SetDefault("NOTIFY_GLOBAL_ADMINS", true)
+	viper.SetDefault("NOTIFY_DC_ADMINS", true)
+	viper.SetDefault("NOTIFICATION_RECIPIENTS", []string{})
+	viper.SetDefault("OUTPUT", lib.OutputAuto)
+
+	if home, err := homedir.Dir(); err == nil {
+		viper.SetDefault("STATE_FILE", filepath.Join(home, "deployment.state.json"))
+		viper.SetDefault("DEPLOYMENT_HISTORY_FILE", filepath.Join(home, "deployment.history.json"))
+	} else {
+		viper.SetDefault("STATE_FILE", "deployment.state.json")
+		viper.SetDefault("DEPLOYMENT_HISTORY_FILE", "deployment.history.json")
+	}
 
 	if cfgFile != "" {
 		viper.SetConfigFile(cfgFile)
@@ -83,5 +155,25 @@ func initConfig() {
 		logrus.SetFormatter(&logrus.JSONFormatter{})
 	}
 	logrus.SetOutput(os.Stdout)
-	AzureCLIInstance = lib.AzureCLI{}
+	reporter, err := lib.NewReporter(viper.GetString("OUTPUT"), os.Stdout)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	if viper.GetString("OUTPUT") == lib.OutputJSON {
+		// stdout only carries the events
+		logrus.SetOutput(os.Stderr)
+	}
+	ReporterInstance = reporter
+	logrus.RegisterExitHandler(ReporterInstance.Close)
+	executor, err := lib.NewAzureExecutor(viper.GetString("AZURE_EXECUTOR"), viper.GetString("AZURE_FIXTURES"))
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	AzureCLIInstance = lib.AzureCLI{Executor: executor, Reporter: ReporterInstance}
+	// a fatal error skips the logout of the command
+	logrus.RegisterExitHandler(func() {
+		if err := AzureCLIInstance.Logout(); err != nil {
+			logrus.Error(err)
+		}
+	})
 }
@@ -0,0 +1,147 @@
+package cmd
+
+import (
+	"encoding/base64"
+	"github.cicd.cloud.fpdev.io/BD/bd-azure-smc-deployment/lib"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"io/ioutil"
+	"time"
+)
+
+var rotateLdapsCertCmd = &cobra.Command{
+	Use:   "rotate-ldaps-cert",
+	Short: "Replace the LDAPS certificate of the managed domain",
+	Long: `Generate a new LDAPS certificate the way generate-ssl-cert does, or take the PFX of --pfx-file,
+and install it on the managed domain. The command waits until LDAPS serves the new certificate and
+updates the SMC trusted CA when the certificate is signed by another CA.
+
+With --if-expiring-within the certificate is only replaced when it expires within that many days,
+which lets the command run from a scheduler.
+
+PFX_CERTIFICATE_BASE64 of the config is then set to the new certificate, deploy-azure would install
+the old one again otherwise`,
+	Run: func(cmd *cobra.Command, args []string) {
+		pfxFile, _ := cmd.Flags().GetString("pfx-file")
+		outDir, _ := cmd.Flags().GetString("out-dir")
+		expiringWithin, _ := cmd.Flags().GetInt("if-expiring-within")
+		skipSmc, _ := cmd.Flags().GetBool("skip-smc")
+		if err := AzureCLIInstance.Login(); err != nil {
+			logrus.Fatal(err)
+		}
+		err := rotateLdapsCertificate(pfxFile, outDir, expiringWithin, skipSmc)
+		if err := AzureCLIInstance.Logout(); err != nil {
+			logrus.Error(err)
+		}
+		smcLogout()
+		if err != nil {
+			logrus.Fatal(err)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(rotateLdapsCertCmd)
+	rotateLdapsCertCmd.Flags().String("pfx-file", "",
+		"install this PFX, protected by PFX_CERTIFICATE_PASSWORD, instead of generating a certificate")
+	rotateLdapsCertCmd.Flags().String("out-dir", "", "write the files of the generated certificate into this directory")
+	rotateLdapsCertCmd.Flags().Int("if-expiring-within", 0,
+		"only replace the certificate when it expires within this many days, 0 always replaces it")
+	rotateLdapsCertCmd.Flags().Bool("skip-smc", false, "do not update the SMC trusted CA")
+}
+
+// replace the LDAPS certificate of the managed domain and check that it is served
+func rotateLdapsCertificate(pfxFile string, outDir string, expiringWithin int, skipSmc bool) error {
+	domainService, err := AzureCLIInstance.GetDomainService()
+	if err != nil {
+		return err
+	}
+	previous := domainService.Properties.LdapsSettings.CertificateThumbprint
+	if expiringWithin > 0 {
+		expiry, err := domainService.CertificateExpiry()
+		if err != nil {
+			return err
+		}
+		if remaining := time.Until(expiry); remaining > time.Duration(expiringWithin)*24*time.Hour {
+			logrus.Infof("The LDAPS certificate %s expires on %s, in %d days, nothing to rotate", previous,
+				expiry.Format("2006-01-02"), int(remaining.Hours()/24))
+			return nil
+		}
+	}
+	if pfxFile == "" && outDir == "" && viper.ConfigFileUsed() == "" {
+		// the generated certificate would only be in memory and lost once the domain uses it
+		return errors.New("pass --config or --out-dir to keep the generated certificate")
+	}
+	var pfxBase64 string
+	var rotated *lib.DomainService
+	steps := []struct {
+		name string
+		run  func() error
+	}{
+		{"ldaps-certificate", func() error {
+			if pfxFile == "" {
+				pfxBase64, err = generateCertificate(outDir)
+				return err
+			}
+			pfx, err := ioutil.ReadFile(pfxFile)
+			if err != nil {
+				return errors.Wrap(err, "failed in reading the PFX file")
+			}
+			pfxBase64 = base64.StdEncoding.EncodeToString(pfx)
+			return nil
+		}},
+		{"ldaps-update", func() error {
+			logrus.Infof("Replacing the LDAPS certificate %s", previous)
+			if err := AzureCLIInstance.UpdateLdapsCertificate(pfxBase64,
+				viper.GetString("PFX_CERTIFICATE_PASSWORD")); err != nil {
+				return err
+			}
+			rotated, err = AzureCLIInstance.WaitForLdapsCertificate(previous, viper.GetDuration("WAIT_HEALTHY_TIMEOUT"),
+				HEALTH_POLL_INTERVAL*time.Second)
+			return err
+		}},
+		{"ldaps-served", func() error {
+			address := rotated.Properties.LdapsSettings.ExternalAccessIpAddress
+			if address == "" {
+				return errors.New("the managed domain has no LDAPS external access ip address")
+			}
+			return lib.WaitForServedCertificate(address, rotated.Properties.LdapsSettings.CertificateThumbprint,
+				viper.GetDuration("WAIT_HEALTHY_TIMEOUT"), HEALTH_POLL_INTERVAL*time.Second)
+		}},
+		{"smc-trusted-ca", func() error {
+			if skipSmc || viper.GetString("SMC.IP_ADDRESS") == "" {
+				logrus.Info("SMC is not updated, import the CA of the new certificate into SMC if it changed")
+				return nil
+			}
+			return createTrustedCA()
+		}},
+	}
+	for _, step := range steps {
+		ReporterInstance.Report(lib.Event{Type: lib.EventStepStarted, Step: step.name})
+		started := time.Now()
+		if err := step.run(); err != nil {
+			ReporterInstance.Report(lib.Event{Type: lib.EventStepFailed, Step: step.name, Error: err.Error(),
+				ElapsedSeconds: time.Since(started).Seconds()})
+			return errors.Wrap(err, "the rotation of the LDAPS certificate failed at "+step.name)
+		}
+		ReporterInstance.Report(lib.Event{Type: lib.EventStepFinished, Step: step.name,
+			ElapsedSeconds: time.Since(started).Seconds()})
+	}
+	logrus.Infof("The managed domain serves the LDAPS certificate %s, it expires on %s",
+		rotated.Properties.LdapsSettings.CertificateThumbprint, rotated.Properties.LdapsSettings.CertificateNotAfter)
+	// deploy-azure installs the old certificate again unless the config has the new one
+	configFile := viper.ConfigFileUsed()
+	if configFile == "" {
+		logrus.Warn("No config file is used, set PFX_CERTIFICATE_BASE64 to the new certificate in the config of " +
+			"deploy-azure")
+		return nil
+	}
+	if err := lib.SetConfigValue(configFile, "PFX_CERTIFICATE_BASE64", pfxBase64); err != nil {
+		return errors.Wrap(err, "the LDAPS certificate is replaced but the config is not, set PFX_CERTIFICATE_BASE64 "+
+			"to the new certificate by hand")
+	}
+	logrus.Infof("PFX_CERTIFICATE_BASE64 of %s is set", configFile)
+	return nil
+}
@@ -0,0 +1,146 @@
+// Package arm is a small client for the Azure Resource Manager REST API.
+// It only covers what the deployment needs: resource groups, template deployments,
+// deployment operations and generic resources.
+package arm
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultBaseURL = "https://management.azure.com"
+	// the resource used to request access tokens for ARM
+	TokenResource = "https://management.azure.com/"
+
+	resourcesApiVersion = "2019-10-01"
+
+	// how long a long running operation is followed before giving up
+	DefaultOperationTimeout = 2 * time.Hour
+	// the delay between two polls of an operation when ARM does not send Retry-After
+	DefaultPollInterval = 10 * time.Second
+)
+
+type Client struct {
+	// BaseURL can point to a local stand-in of the ARM endpoints
+	BaseURL        string
+	SubscriptionID string
+	// Token returns a valid bearer token for ARM
+	Token      func() (string, error)
+	HTTPClient *http.Client
+	// OperationTimeout bounds the wait for a long running operation
+	OperationTimeout time.Duration
+	// PollInterval is the delay between two polls when ARM does not ask for one
+	PollInterval time.Duration
+}
+
+func NewClient(baseURL string, subscriptionID string, token func() (string, error)) *Client {
+	if baseURL == "" {
+		baseURL = DefaultBaseURL
+	}
+	return &Client{
+		BaseURL:          strings.TrimRight(baseURL, "/"),
+		SubscriptionID:   subscriptionID,
+		Token:            token,
+		HTTPClient:       &http.Client{Timeout: 60 * time.Second},
+		OperationTimeout: DefaultOperationTimeout,
+		PollInterval:     DefaultPollInterval,
+	}
+}
+
+// Error is the error body returned by ARM
+type Error struct {
+	StatusCode int     `json:"-"`
+	Code       string  `json:"code"`
+	Message    string  `json:"message"`
+	Target     string  `json:"target,omitempty"`
+	Details    []Error `json:"details,omitempty"`
+}
+
+func (e *Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("azure resource manager returned http status %d: %s", e.StatusCode, e.Message)
+	}
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+// check if an error is an ARM error with the given http status
+func IsStatus(err error, status int) bool {
+	armErr, ok := err.(*Error)
+	return ok && armErr.StatusCode == status
+}
+
+func (c *Client) subscriptionPath() string {
+	return "/subscriptions/" + c.SubscriptionID
+}
+
+// send a request to ARM and decode the JSON response into out when it is not nil
+func (c *Client) do(method string, path string, apiVersion string, in interface{}, out interface{}) (*http.Response, error) {
+	url := path
+	if !strings.HasPrefix(path, "http") {
+		url = c.BaseURL + path
+	}
+	if apiVersion != "" {
+		separator := "?"
+		if strings.Contains(url, "?") {
+			separator = "&"
+		}
+		url = url + separator + "api-version=" + apiVersion
+	}
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewBuffer(b)
+	}
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	token, err := c.Token()
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return resp, err
+	}
+	if resp.StatusCode >= http.StatusBadRequest {
+		return resp, decodeError(resp.StatusCode, b)
+	}
+	if out != nil && len(b) != 0 {
+		if err := json.Unmarshal(b, out); err != nil {
+			return resp, fmt.Errorf("failed in decoding the response of %s %s: %s", method, path, err)
+		}
+	}
+	return resp, nil
+}
+
+func decodeError(statusCode int, body []byte) error {
+	var errorResponse struct {
+		Error Error `json:"error"`
+	}
+	armErr := &Error{StatusCode: statusCode}
+	if err := json.Unmarshal(body, &errorResponse); err == nil && errorResponse.Error.Code != "" {
+		*armErr = errorResponse.Error
+		armErr.StatusCode = statusCode
+	} else if len(body) != 0 {
+		armErr.Message = strings.TrimSpace(string(body))
+	}
+	return armErr
+}
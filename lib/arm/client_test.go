@@ -0,0 +1,160 @@
+package arm
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testSubscription = "00000000-0000-0000-0000-000000000000"
+
+// a client of a local ARM stand-in which polls without waiting
+func testClient(handler http.HandlerFunc) (*Client, *httptest.Server) {
+	server := httptest.NewServer(handler)
+	client := NewClient(server.URL, testSubscription, func() (string, error) { return "token", nil })
+	client.PollInterval = time.Millisecond
+	return client, server
+}
+
+func TestCreateDeployment(t *testing.T) {
+	client, server := testClient(func(w http.ResponseWriter, r *http.Request) {
+		want := "/subscriptions/" + testSubscription + "/resourcegroups/smc/providers/Microsoft.Resources/deployments/ldaps"
+		if r.Method != http.MethodPut || r.URL.Path != want {
+			t.Errorf("the deployment was sent as %s %s, want PUT %s", r.Method, r.URL.Path, want)
+		}
+		if version := r.URL.Query().Get("api-version"); version != resourcesApiVersion {
+			t.Errorf("the deployment was sent with the api-version %s", version)
+		}
+		if r.Header.Get("Authorization") != "Bearer token" {
+			t.Errorf("the deployment was sent with the authorization %q", r.Header.Get("Authorization"))
+		}
+		var request Deployment
+		b, _ := ioutil.ReadAll(r.Body)
+		if err := json.Unmarshal(b, &request); err != nil {
+			t.Fatal(err)
+		}
+		if request.Properties.Mode != "Incremental" || string(request.Properties.Template) != `{"resources":[]}` {
+			t.Errorf("the deployment request is %s", b)
+		}
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"name":"ldaps","properties":{"provisioningState":"Accepted"}}`))
+	})
+	defer server.Close()
+	deployment, err := client.CreateDeployment("smc", "ldaps", json.RawMessage(`{"resources":[]}`),
+		map[string]interface{}{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deployment.Properties.ProvisioningState != StateAccepted {
+		t.Errorf("the deployment is %s, want Accepted", deployment.Properties.ProvisioningState)
+	}
+}
+
+// a PUT answered with Azure-AsyncOperation, the operation is Running until the third poll
+func asyncOperationHandler(final string) http.HandlerFunc {
+	polls := 0
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut {
+			w.Header().Set("Azure-AsyncOperation", "http://"+r.Host+"/operations/1")
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		polls++
+		if polls < 3 {
+			w.Write([]byte(`{"status":"Running"}`))
+			return
+		}
+		w.Write([]byte(final))
+	}
+}
+
+func TestPutResourceWaitsForTheAsyncOperation(t *testing.T) {
+	client, server := testClient(asyncOperationHandler(`{"status":"Succeeded"}`))
+	defer server.Close()
+	if err := client.PutResource("/subscriptions/s/resourceGroups/smc/providers/Microsoft.Network/vnet",
+		"2020-05-01", &Resource{Location: "westeurope"}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPutResourceFailedAsyncOperation(t *testing.T) {
+	client, server := testClient(asyncOperationHandler(
+		`{"status":"Failed","error":{"code":"InvalidSubnet","message":"the subnet is in use"}}`))
+	defer server.Close()
+	err := client.PutResource("/subscriptions/s/resourceGroups/smc/providers/Microsoft.Network/vnet",
+		"2020-05-01", &Resource{Location: "westeurope"})
+	armErr, ok := err.(*Error)
+	if !ok || armErr.Code != "InvalidSubnet" || armErr.Message != "the subnet is in use" {
+		t.Errorf("PutResource() = %v, want the error of the operation", err)
+	}
+}
+
+func TestWaitAsyncDeadline(t *testing.T) {
+	client, server := testClient(func(w http.ResponseWriter, r *http.Request) {
+		// the operation is never finished, every poll is accepted again
+		w.Header().Set("Location", "http://"+r.Host+"/operations/1")
+		w.WriteHeader(http.StatusAccepted)
+	})
+	defer server.Close()
+	client.OperationTimeout = 50 * time.Millisecond
+	client.PollInterval = 10 * time.Millisecond
+	err := client.DeleteResourceGroup("smc")
+	if err == nil || !strings.Contains(err.Error(), "did not finish") {
+		t.Errorf("DeleteResourceGroup() = %v, want a timeout", err)
+	}
+}
+
+func TestWhatIf(t *testing.T) {
+	client, server := testClient(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			if !strings.HasSuffix(r.URL.Path, "/deployments/ldaps/whatIf") ||
+				r.URL.Query().Get("api-version") != whatIfApiVersion {
+				t.Errorf("the what-if was sent to %s", r.URL)
+			}
+			w.Header().Set("Location", "http://"+r.Host+"/operations/whatif")
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+		w.Write([]byte(`{"status":"Succeeded","properties":{"changes":[{"resourceId":"/nsg","changeType":"Modify",
+			"delta":[{"path":"properties.securityRules","propertyChangeType":"Array"}]}]}}`))
+	})
+	defer server.Close()
+	result, err := client.WhatIf("smc", "ldaps", json.RawMessage(`{}`), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	changes := result.Properties.Changes
+	if len(changes) != 1 || changes[0].ChangeType != ChangeModify || len(changes[0].Delta) != 1 {
+		t.Errorf("WhatIf() returned the changes %+v", changes)
+	}
+}
+
+func TestDecodeError(t *testing.T) {
+	client, server := testClient(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/missing") {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error":{"code":"ResourceNotFound","message":"not found",` +
+				`"details":[{"code":"Inner","message":"the inner error"}]}}`))
+			return
+		}
+		w.WriteHeader(http.StatusBadGateway)
+		w.Write([]byte("bad gateway\n"))
+	})
+	defer server.Close()
+	_, err := client.GetResource("/missing", "2020-05-01")
+	if !IsStatus(err, http.StatusNotFound) {
+		t.Fatalf("GetResource() = %v, want a 404", err)
+	}
+	armErr := err.(*Error)
+	if armErr.Code != "ResourceNotFound" || len(armErr.Details) != 1 || armErr.Details[0].Code != "Inner" {
+		t.Errorf("the error is decoded as %+v", armErr)
+	}
+	_, err = client.GetResource("/gateway", "2020-05-01")
+	if !IsStatus(err, http.StatusBadGateway) || err.(*Error).Message != "bad gateway" {
+		t.Errorf("GetResource() = %v, want the body of the 502 as the message", err)
+	}
+}
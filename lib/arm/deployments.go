@@ -0,0 +1,312 @@
+package arm
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+const (
+	StateAccepted  = "Accepted"
+	StateRunning   = "Running"
+	StateSucceeded = "Succeeded"
+	StateFailed    = "Failed"
+	StateCanceled  = "Canceled"
+)
+
+type ResourceGroup struct {
+	ID         string `json:"id,omitempty"`
+	Name       string `json:"name,omitempty"`
+	Location   string `json:"location"`
+	Properties struct {
+		ProvisioningState string `json:"provisioningState,omitempty"`
+	} `json:"properties"`
+}
+
+type DeploymentProperties struct {
+	Mode              string          `json:"mode,omitempty"`
+	Template          json.RawMessage `json:"template,omitempty"`
+	Parameters        interface{}     `json:"parameters,omitempty"`
+	ProvisioningState string          `json:"provisioningState,omitempty"`
+	CorrelationID     string          `json:"correlationId,omitempty"`
+	Timestamp         *time.Time      `json:"timestamp,omitempty"`
+	Duration          string          `json:"duration,omitempty"`
+	Error             *Error          `json:"error,omitempty"`
+}
+
+type Deployment struct {
+	ID         string               `json:"id,omitempty"`
+	Name       string               `json:"name,omitempty"`
+	Properties DeploymentProperties `json:"properties"`
+}
+
+type TargetResource struct {
+	ID           string `json:"id"`
+	ResourceType string `json:"resourceType"`
+	ResourceName string `json:"resourceName"`
+}
+
+type DeploymentOperation struct {
+	ID          string `json:"id"`
+	OperationID string `json:"operationId"`
+	Properties  struct {
+		ProvisioningState     string          `json:"provisioningState"`
+		ProvisioningOperation string          `json:"provisioningOperation"`
+		Timestamp             time.Time       `json:"timestamp"`
+		Duration              string          `json:"duration"`
+		StatusCode            string          `json:"statusCode"`
+		StatusMessage         json.RawMessage `json:"statusMessage,omitempty"`
+		TargetResource        *TargetResource `json:"targetResource,omitempty"`
+	} `json:"properties"`
+}
+
+// a generic ARM resource, Properties is decoded by the caller
+type Resource struct {
+	ID         string            `json:"id,omitempty"`
+	Name       string            `json:"name,omitempty"`
+	Type       string            `json:"type,omitempty"`
+	Location   string            `json:"location,omitempty"`
+	Tags       map[string]string `json:"tags,omitempty"`
+	Properties json.RawMessage   `json:"properties,omitempty"`
+}
+
+type Subscription struct {
+	ID             string `json:"id"`
+	SubscriptionID string `json:"subscriptionId"`
+	DisplayName    string `json:"displayName"`
+	State          string `json:"state"`
+}
+
+// list the subscriptions the token has access to
+func (c *Client) ListSubscriptions() ([]Subscription, error) {
+	var subscriptions []Subscription
+	path := "/subscriptions"
+	apiVersion := resourcesApiVersion
+	for path != "" {
+		var page struct {
+			Value    []Subscription `json:"value"`
+			NextLink string         `json:"nextLink"`
+		}
+		if _, err := c.do(http.MethodGet, path, apiVersion, nil, &page); err != nil {
+			return nil, err
+		}
+		subscriptions = append(subscriptions, page.Value...)
+		path = page.NextLink
+		apiVersion = ""
+	}
+	return subscriptions, nil
+}
+
+func (c *Client) resourceGroupPath(name string) string {
+	return fmt.Sprintf("%s/resourcegroups/%s", c.subscriptionPath(), name)
+}
+
+func (c *Client) deploymentPath(resourceGroup string, name string) string {
+	return fmt.Sprintf("%s/providers/Microsoft.Resources/deployments/%s", c.resourceGroupPath(resourceGroup), name)
+}
+
+// check if a resource group exists
+func (c *Client) ResourceGroupExists(name string) (bool, error) {
+	resp, err := c.do(http.MethodHead, c.resourceGroupPath(name), resourcesApiVersion, nil, nil)
+	if IsStatus(err, http.StatusNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusOK, nil
+}
+
+// create or update a resource group
+func (c *Client) CreateResourceGroup(name string, location string) (*ResourceGroup, error) {
+	group := &ResourceGroup{}
+	_, err := c.do(http.MethodPut, c.resourceGroupPath(name), resourcesApiVersion,
+		&ResourceGroup{Location: location}, group)
+	if err != nil {
+		return nil, err
+	}
+	return group, nil
+}
+
+// submit a template deployment, ARM runs it asynchronously
+func (c *Client) CreateDeployment(resourceGroup string, name string, template json.RawMessage,
+	parameters interface{}) (*Deployment, error) {
+	request := &Deployment{
+		Properties: DeploymentProperties{
+			Mode:       "Incremental",
+			Template:   template,
+			Parameters: parameters,
+		},
+	}
+	deployment := &Deployment{}
+	if _, err := c.do(http.MethodPut, c.deploymentPath(resourceGroup, name), resourcesApiVersion,
+		request, deployment); err != nil {
+		return nil, err
+	}
+	return deployment, nil
+}
+
+func (c *Client) GetDeployment(resourceGroup string, name string) (*Deployment, error) {
+	deployment := &Deployment{}
+	if _, err := c.do(http.MethodGet, c.deploymentPath(resourceGroup, name), resourcesApiVersion,
+		nil, deployment); err != nil {
+		return nil, err
+	}
+	return deployment, nil
+}
+
+// list all operations of a deployment, following the nextLink pages
+func (c *Client) ListDeploymentOperations(resourceGroup string, name string) ([]DeploymentOperation, error) {
+	var operations []DeploymentOperation
+	path := c.deploymentPath(resourceGroup, name) + "/operations"
+	apiVersion := resourcesApiVersion
+	for path != "" {
+		var page struct {
+			Value    []DeploymentOperation `json:"value"`
+			NextLink string                `json:"nextLink"`
+		}
+		if _, err := c.do(http.MethodGet, path, apiVersion, nil, &page); err != nil {
+			return nil, err
+		}
+		operations = append(operations, page.Value...)
+		// the nextLink already carries the api-version
+		path = page.NextLink
+		apiVersion = ""
+	}
+	return operations, nil
+}
+
+// read a resource by its full id
+func (c *Client) GetResource(id string, apiVersion string) (*Resource, error) {
+	resource := &Resource{}
+	if _, err := c.do(http.MethodGet, id, apiVersion, nil, resource); err != nil {
+		return nil, err
+	}
+	return resource, nil
+}
+
+// the id of a resource in a resource group of the client subscription
+func (c *Client) ResourceID(resourceGroup string, resourceType string, name string) string {
+	return fmt.Sprintf("%s/resourceGroups/%s/providers/%s/%s", c.subscriptionPath(), resourceGroup, resourceType, name)
+}
+
+// delete a resource by its full id and wait until ARM has removed it
+func (c *Client) DeleteResource(id string, apiVersion string) error {
+	resp, err := c.do(http.MethodDelete, id, apiVersion, nil, nil)
+	if err != nil {
+		return err
+	}
+	return c.waitAsync(resp)
+}
+
+// delete a resource group with everything in it and wait until ARM has removed it
+func (c *Client) DeleteResourceGroup(name string) error {
+	resp, err := c.do(http.MethodDelete, c.resourceGroupPath(name), resourcesApiVersion, nil, nil)
+	if err != nil {
+		return err
+	}
+	return c.waitAsync(resp)
+}
+
+// follow a long running operation until it is finished, it fails once OperationTimeout has passed
+func (c *Client) waitAsync(resp *http.Response) error {
+	deadline := time.Now().Add(c.OperationTimeout)
+	if asyncOperation := resp.Header.Get("Azure-AsyncOperation"); asyncOperation != "" {
+		for {
+			var status struct {
+				Status string `json:"status"`
+				Error  *Error `json:"error,omitempty"`
+			}
+			if _, err := c.do(http.MethodGet, asyncOperation, "", nil, &status); err != nil {
+				return err
+			}
+			switch status.Status {
+			case StateSucceeded:
+				return nil
+			case StateFailed, StateCanceled:
+				if status.Error != nil {
+					return status.Error
+				}
+				return fmt.Errorf("the operation finished with the status %s", status.Status)
+			}
+			if err := c.sleepUntil(resp, deadline); err != nil {
+				return err
+			}
+		}
+	}
+	for resp.StatusCode == http.StatusAccepted {
+		location := resp.Header.Get("Location")
+		if location == "" {
+			return nil
+		}
+		if err := c.sleepUntil(resp, deadline); err != nil {
+			return err
+		}
+		var err error
+		if resp, err = c.do(http.MethodGet, location, "", nil, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// wait before the next poll of an operation, an error when the deadline is reached first
+func (c *Client) sleepUntil(resp *http.Response, deadline time.Time) error {
+	delay := c.retryAfter(resp)
+	if time.Now().Add(delay).After(deadline) {
+		return fmt.Errorf("the operation did not finish within %s", c.OperationTimeout)
+	}
+	time.Sleep(delay)
+	return nil
+}
+
+func (c *Client) retryAfter(resp *http.Response) time.Duration {
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	return c.PollInterval
+}
+
+var isoDuration = regexp.MustCompile(`^P(?:(\d+)D)?(?:T(?:(\d+)H)?(?:(\d+)M)?(?:([\d.]+)S)?)?$`)
+
+// parse the ISO 8601 durations ARM reports, such as PT1M30.5S
+func ParseDuration(duration string) (time.Duration, error) {
+	parts := isoDuration.FindStringSubmatch(duration)
+	if parts == nil {
+		return 0, fmt.Errorf("invalid duration '%s'", duration)
+	}
+	var total time.Duration
+	units := []time.Duration{24 * time.Hour, time.Hour, time.Minute, time.Second}
+	for i, unit := range units {
+		if parts[i+1] == "" {
+			continue
+		}
+		value, err := strconv.ParseFloat(parts[i+1], 64)
+		if err != nil {
+			return 0, err
+		}
+		total += time.Duration(value * float64(unit))
+	}
+	return total, nil
+}
+
+// create or replace a resource by its full id and wait until ARM has applied it
+func (c *Client) PutResource(id string, apiVersion string, resource *Resource) error {
+	resp, err := c.do(http.MethodPut, id, apiVersion, resource, nil)
+	if err != nil {
+		return err
+	}
+	return c.waitAsync(resp)
+}
+
+// update some properties of a resource by its full id and wait until ARM has applied them
+func (c *Client) PatchResource(id string, apiVersion string, patch interface{}) error {
+	resp, err := c.do(http.MethodPatch, id, apiVersion, patch, nil)
+	if err != nil {
+		return err
+	}
+	return c.waitAsync(resp)
+}
@@ -0,0 +1,80 @@
+package arm
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+)
+
+const whatIfApiVersion = "2020-06-01"
+
+const (
+	ChangeCreate      = "Create"
+	ChangeDelete      = "Delete"
+	ChangeDeploy      = "Deploy"
+	ChangeIgnore      = "Ignore"
+	ChangeModify      = "Modify"
+	ChangeNoChange    = "NoChange"
+	ChangeUnsupported = "Unsupported"
+)
+
+type WhatIfPropertyChange struct {
+	Path               string                 `json:"path"`
+	PropertyChangeType string                 `json:"propertyChangeType"`
+	Before             interface{}            `json:"before,omitempty"`
+	After              interface{}            `json:"after,omitempty"`
+	Children           []WhatIfPropertyChange `json:"children,omitempty"`
+}
+
+type WhatIfChange struct {
+	ResourceID        string                 `json:"resourceId"`
+	ChangeType        string                 `json:"changeType"`
+	UnsupportedReason string                 `json:"unsupportedReason,omitempty"`
+	Delta             []WhatIfPropertyChange `json:"delta,omitempty"`
+}
+
+type WhatIfResult struct {
+	Status     string `json:"status"`
+	Properties struct {
+		Changes []WhatIfChange `json:"changes"`
+	} `json:"properties"`
+	Error *Error `json:"error,omitempty"`
+}
+
+// preview the changes a template deployment would make, nothing is deployed
+func (c *Client) WhatIf(resourceGroup string, name string, template json.RawMessage,
+	parameters interface{}) (*WhatIfResult, error) {
+	request := &Deployment{
+		Properties: DeploymentProperties{
+			Mode:       "Incremental",
+			Template:   template,
+			Parameters: parameters,
+		},
+	}
+	result := &WhatIfResult{}
+	resp, err := c.do(http.MethodPost, c.deploymentPath(resourceGroup, name)+"/whatIf", whatIfApiVersion,
+		request, result)
+	if err != nil {
+		return nil, err
+	}
+	// the what-if operation is asynchronous, the Location header is polled for the result
+	deadline := time.Now().Add(c.OperationTimeout)
+	for resp.StatusCode == http.StatusAccepted {
+		location := resp.Header.Get("Location")
+		if location == "" {
+			return nil, errors.New("the what-if operation did not return a location to poll")
+		}
+		if err := c.sleepUntil(resp, deadline); err != nil {
+			return nil, err
+		}
+		result = &WhatIfResult{}
+		if resp, err = c.do(http.MethodGet, location, "", nil, result); err != nil {
+			return nil, err
+		}
+	}
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return result, nil
+}
@@ -0,0 +1,360 @@
+package lib
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	errorWrapper "github.com/pkg/errors"
+	"github.com/spf13/viper"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	AuthPassword          = "password"
+	AuthClientSecret      = "client-secret"
+	AuthClientCertificate = "client-certificate"
+	AuthDeviceCode        = "device-code"
+	AuthSession           = "session"
+
+	// the public client id of the Azure CLI, used for the device code and password flows
+	azureCLIClientID = "04b07795-8ddb-461a-bbee-02f9e1bf7b46"
+)
+
+// a credential obtains access tokens without the Azure CLI
+type credential interface {
+	token(resource string) (accessToken, error)
+}
+
+// the response of the microsoft identity platform token endpoint
+type tokenResponse struct {
+	AccessToken      string `json:"access_token"`
+	RefreshToken     string `json:"refresh_token"`
+	ExpiresIn        int64  `json:"expires_in"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+func (t *tokenResponse) accessToken() accessToken {
+	return accessToken{
+		value:     t.AccessToken,
+		expiresOn: time.Now().Add(time.Duration(t.ExpiresIn) * time.Second),
+	}
+}
+
+// the v2 scope of an azure resource
+func resourceScope(resource string) string {
+	return strings.TrimRight(resource, "/") + "/.default"
+}
+
+func tokenEndpoint(tenant string) string {
+	return fmt.Sprintf("%s/%s/oauth2/v2.0/token", strings.TrimRight(viper.GetString("AZURE_AUTHORITY"), "/"), tenant)
+}
+
+// post a form to the identity platform and decode the token response
+func postTokenForm(endpoint string, form url.Values) (*tokenResponse, error) {
+	client := &http.Client{Timeout: 60 * time.Second}
+	resp, err := client.PostForm(endpoint, form)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	response := &tokenResponse{}
+	if err := json.Unmarshal(b, response); err != nil {
+		return nil, fmt.Errorf("failed in decoding the token response with http status %d", resp.StatusCode)
+	}
+	if response.Error != "" {
+		return response, fmt.Errorf("%s: %s", response.Error, response.ErrorDescription)
+	}
+	return response, nil
+}
+
+// create the credential of a non interactive or device code auth mode, the device code sign in
+// message goes to the reporter
+func newCredential(mode string, reporter Reporter) (credential, error) {
+	tenant := viper.GetString("AZURE_TENANT_ID")
+	clientID := viper.GetString("AZURE_CLIENT_ID")
+	switch mode {
+	case AuthPassword:
+		password, err := AdminPassword()
+		if err != nil {
+			return nil, err
+		}
+		if tenant == "" {
+			tenant = "organizations"
+		}
+		return &passwordCredential{tenant: tenant, username: viper.GetString("AZURE_ADMIN_LOGIN_NAME"),
+			password: password}, nil
+	case AuthClientSecret:
+		if tenant == "" || clientID == "" || viper.GetString("AZURE_CLIENT_SECRET") == "" {
+			return nil, errors.New("the client-secret auth mode requires AZURE_TENANT_ID, AZURE_CLIENT_ID and AZURE_CLIENT_SECRET")
+		}
+		return &clientSecretCredential{tenant: tenant, clientID: clientID,
+			secret: viper.GetString("AZURE_CLIENT_SECRET")}, nil
+	case AuthClientCertificate:
+		if tenant == "" || clientID == "" || viper.GetString("AZURE_CLIENT_CERTIFICATE") == "" {
+			return nil, errors.New("the client-certificate auth mode requires AZURE_TENANT_ID, AZURE_CLIENT_ID and AZURE_CLIENT_CERTIFICATE")
+		}
+		return newClientCertificateCredential(tenant, clientID, viper.GetString("AZURE_CLIENT_CERTIFICATE"))
+	case AuthDeviceCode:
+		if tenant == "" {
+			tenant = "organizations"
+		}
+		if clientID == "" {
+			clientID = azureCLIClientID
+		}
+		return &deviceCodeCredential{tenant: tenant, clientID: clientID, reporter: reporter}, nil
+	}
+	return nil, fmt.Errorf("the auth mode '%s' does not use a native credential", mode)
+}
+
+// the azure admin with its password, the password only goes to the token endpoint. Accounts with
+// MFA cannot use it, the device code flow works for them
+type passwordCredential struct {
+	tenant       string
+	username     string
+	password     string
+	refreshToken string
+}
+
+func (c *passwordCredential) token(resource string) (accessToken, error) {
+	form := url.Values{
+		"client_id": {azureCLIClientID},
+		"scope":     {resourceScope(resource) + " offline_access"},
+	}
+	if c.refreshToken != "" {
+		form.Set("grant_type", "refresh_token")
+		form.Set("refresh_token", c.refreshToken)
+	} else {
+		form.Set("grant_type", "password")
+		form.Set("username", c.username)
+		form.Set("password", c.password)
+	}
+	response, err := postTokenForm(tokenEndpoint(c.tenant), form)
+	if err != nil {
+		if response != nil && response.Error == "invalid_grant" && strings.Contains(response.ErrorDescription, "AADSTS50126") {
+			return accessToken{}, errors.New("error in validating credentials due to invalid username or password")
+		}
+		return accessToken{}, errorWrapper.Wrap(err, "failed in getting a token with the admin password")
+	}
+	if response.RefreshToken != "" {
+		c.refreshToken = response.RefreshToken
+	}
+	return response.accessToken(), nil
+}
+
+// service principal with a client secret
+type clientSecretCredential struct {
+	tenant   string
+	clientID string
+	secret   string
+}
+
+func (c *clientSecretCredential) token(resource string) (accessToken, error) {
+	response, err := postTokenForm(tokenEndpoint(c.tenant), url.Values{
+		"grant_type":    {"client_credentials"},
+		"client_id":     {c.clientID},
+		"client_secret": {c.secret},
+		"scope":         {resourceScope(resource)},
+	})
+	if err != nil {
+		return accessToken{}, errorWrapper.Wrap(err, "failed in getting a token with the client secret")
+	}
+	return response.accessToken(), nil
+}
+
+// service principal with a client certificate, the PEM file holds the certificate and its RSA key
+type clientCertificateCredential struct {
+	tenant      string
+	clientID    string
+	certificate *x509.Certificate
+	key         *rsa.PrivateKey
+}
+
+func newClientCertificateCredential(tenant string, clientID string, path string) (*clientCertificateCredential, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errorWrapper.Wrap(err, "failed in reading the client certificate")
+	}
+	c := &clientCertificateCredential{tenant: tenant, clientID: clientID}
+	for block, rest := pem.Decode(b); block != nil; block, rest = pem.Decode(rest) {
+		switch block.Type {
+		case "CERTIFICATE":
+			if c.certificate == nil {
+				if c.certificate, err = x509.ParseCertificate(block.Bytes); err != nil {
+					return nil, errorWrapper.Wrap(err, "failed in parsing the client certificate")
+				}
+			}
+		case "RSA PRIVATE KEY":
+			if c.key, err = x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
+				return nil, errorWrapper.Wrap(err, "failed in parsing the client certificate key")
+			}
+		case "PRIVATE KEY":
+			key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+			if err != nil {
+				return nil, errorWrapper.Wrap(err, "failed in parsing the client certificate key")
+			}
+			rsaKey, ok := key.(*rsa.PrivateKey)
+			if !ok {
+				return nil, errors.New("the client certificate key must be an RSA key")
+			}
+			c.key = rsaKey
+		}
+	}
+	if c.certificate == nil || c.key == nil {
+		return nil, errors.New("AZURE_CLIENT_CERTIFICATE must be a PEM file with the certificate and its private key")
+	}
+	return c, nil
+}
+
+// a signed JWT proving the possession of the certificate key
+func (c *clientCertificateCredential) assertion(audience string) (string, error) {
+	thumbprint := sha1.Sum(c.certificate.Raw)
+	jti := make([]byte, 16)
+	if _, err := rand.Read(jti); err != nil {
+		return "", err
+	}
+	now := time.Now()
+	header, _ := json.Marshal(map[string]string{
+		"alg": "RS256",
+		"typ": "JWT",
+		"x5t": base64.RawURLEncoding.EncodeToString(thumbprint[:]),
+	})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"aud": audience,
+		"iss": c.clientID,
+		"sub": c.clientID,
+		"jti": hex.EncodeToString(jti),
+		"nbf": now.Unix(),
+		"exp": now.Add(10 * time.Minute).Unix(),
+	})
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, c.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+func (c *clientCertificateCredential) token(resource string) (accessToken, error) {
+	endpoint := tokenEndpoint(c.tenant)
+	assertion, err := c.assertion(endpoint)
+	if err != nil {
+		return accessToken{}, errorWrapper.Wrap(err, "failed in signing the client assertion")
+	}
+	response, err := postTokenForm(endpoint, url.Values{
+		"grant_type":            {"client_credentials"},
+		"client_id":             {c.clientID},
+		"client_assertion_type": {"urn:ietf:params:oauth:client-assertion-type:jwt-bearer"},
+		"client_assertion":      {assertion},
+		"scope":                 {resourceScope(resource)},
+	})
+	if err != nil {
+		return accessToken{}, errorWrapper.Wrap(err, "failed in getting a token with the client certificate")
+	}
+	return response.accessToken(), nil
+}
+
+// interactive device code flow, the refresh token is used for every further resource
+type deviceCodeCredential struct {
+	tenant       string
+	clientID     string
+	refreshToken string
+	reporter     Reporter
+}
+
+func (c *deviceCodeCredential) token(resource string) (accessToken, error) {
+	if c.refreshToken != "" {
+		response, err := postTokenForm(tokenEndpoint(c.tenant), url.Values{
+			"grant_type":    {"refresh_token"},
+			"client_id":     {c.clientID},
+			"refresh_token": {c.refreshToken},
+			"scope":         {resourceScope(resource) + " offline_access"},
+		})
+		if err != nil {
+			return accessToken{}, errorWrapper.Wrap(err, "failed in refreshing the device code token")
+		}
+		if response.RefreshToken != "" {
+			c.refreshToken = response.RefreshToken
+		}
+		return response.accessToken(), nil
+	}
+	return c.authorize(resource)
+}
+
+func (c *deviceCodeCredential) authorize(resource string) (accessToken, error) {
+	endpoint := fmt.Sprintf("%s/%s/oauth2/v2.0/devicecode", strings.TrimRight(viper.GetString("AZURE_AUTHORITY"), "/"), c.tenant)
+	client := &http.Client{Timeout: 60 * time.Second}
+	resp, err := client.PostForm(endpoint, url.Values{
+		"client_id": {c.clientID},
+		"scope":     {resourceScope(resource) + " offline_access"},
+	})
+	if err != nil {
+		return accessToken{}, err
+	}
+	defer resp.Body.Close()
+	var deviceCode struct {
+		DeviceCode string `json:"device_code"`
+		Message    string `json:"message"`
+		ExpiresIn  int64  `json:"expires_in"`
+		Interval   int64  `json:"interval"`
+		Error      string `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&deviceCode); err != nil {
+		return accessToken{}, errorWrapper.Wrap(err, "failed in decoding the device code response")
+	}
+	if deviceCode.Error != "" || deviceCode.DeviceCode == "" {
+		return accessToken{}, fmt.Errorf("failed in requesting a device code: %s", deviceCode.Error)
+	}
+	if c.reporter != nil {
+		c.reporter.Report(Event{Type: EventDeviceCode, Message: deviceCode.Message})
+	} else {
+		fmt.Println(deviceCode.Message)
+	}
+	interval := time.Duration(deviceCode.Interval) * time.Second
+	if interval == 0 {
+		interval = 5 * time.Second
+	}
+	deadline := time.Now().Add(time.Duration(deviceCode.ExpiresIn) * time.Second)
+	for time.Now().Before(deadline) {
+		time.Sleep(interval)
+		response, err := postTokenForm(tokenEndpoint(c.tenant), url.Values{
+			"grant_type":  {"urn:ietf:params:oauth:grant-type:device_code"},
+			"client_id":   {c.clientID},
+			"device_code": {deviceCode.DeviceCode},
+		})
+		if err == nil {
+			c.refreshToken = response.RefreshToken
+			return response.accessToken(), nil
+		}
+		if response == nil {
+			return accessToken{}, err
+		}
+		switch response.Error {
+		case "authorization_pending":
+			continue
+		case "slow_down":
+			interval += 5 * time.Second
+			continue
+		}
+		return accessToken{}, errorWrapper.Wrap(err, "the device code login failed")
+	}
+	return accessToken{}, errors.New("the device code expired before the login was completed")
+}
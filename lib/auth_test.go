@@ -0,0 +1,72 @@
+package lib
+
+import (
+	"encoding/json"
+	"github.com/spf13/viper"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPasswordCredential(t *testing.T) {
+	var grants []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Fatal(err)
+		}
+		if r.URL.Path != "/organizations/oauth2/v2.0/token" {
+			t.Errorf("unexpected token endpoint %s", r.URL.Path)
+		}
+		grants = append(grants, r.PostForm.Get("grant_type"))
+		response := map[string]interface{}{"access_token": "token", "refresh_token": "refresh", "expires_in": 3600}
+		switch {
+		case r.PostForm.Get("grant_type") == "password" && r.PostForm.Get("password") != "Secr3t":
+			response = map[string]interface{}{"error": "invalid_grant",
+				"error_description": "AADSTS50126: Error validating credentials due to invalid username or password."}
+			w.WriteHeader(http.StatusBadRequest)
+		case r.PostForm.Get("grant_type") == "refresh_token" && r.PostForm.Get("refresh_token") != "refresh":
+			t.Errorf("the refresh token %q was not the one returned", r.PostForm.Get("refresh_token"))
+		}
+		_ = json.NewEncoder(w).Encode(response)
+	}))
+	defer server.Close()
+	viper.Set("AZURE_AUTHORITY", server.URL)
+	viper.Set("AZURE_ADMIN_LOGIN_NAME", "admin@example.com")
+	viper.Set("AZURE_ADMIN_LOGIN_PASSWORD", "Secr3t")
+	defer viper.Reset()
+
+	credential, err := newCredential(AuthPassword, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, resource := range []string{"https://management.azure.com/", GraphResource} {
+		token, err := credential.token(resource)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token.value != "token" {
+			t.Errorf("token() = %q", token.value)
+		}
+	}
+	if strings.Join(grants, ",") != "password,refresh_token" {
+		t.Errorf("the grants were %v, the password must only be sent once", grants)
+	}
+
+	viper.Set("AZURE_ADMIN_LOGIN_PASSWORD", "wrong")
+	credential, err = newCredential(AuthPassword, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := credential.token(GraphResource); err == nil || !strings.Contains(err.Error(), "invalid username or password") {
+		t.Errorf("token() error = %v, want invalid username or password", err)
+	}
+}
+
+func TestAdminPasswordNeedsTheAdmin(t *testing.T) {
+	viper.Set("AZURE_ADMIN_LOGIN_NAME", "")
+	defer viper.Reset()
+	if _, err := AdminPassword(); err == nil {
+		t.Error("AdminPassword() must fail without AZURE_ADMIN_LOGIN_NAME")
+	}
+}
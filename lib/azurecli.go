@@ -1,293 +1,458 @@
 package lib
 
 import (
-	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"github.cicd.cloud.fpdev.io/BD/bd-azure-smc-deployment/lib/arm"
+	"github.cicd.cloud.fpdev.io/BD/bd-azure-smc-deployment/lib/graph"
 	errorWrapper "github.com/pkg/errors"
-	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 	"golang.org/x/crypto/ssh/terminal"
 	"io/ioutil"
 	"net/http"
-	"os/exec"
+	"os"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 )
 
+const (
+	GraphResource = "https://graph.microsoft.com"
+	// the provisioning job id of the SCIM template is this prefix followed by the app SCIM id
+	ScimJobPrefix = "scim.7868462e3eae47bb9d58896e03ce6c43."
+)
+
 type AzureCLI struct {
-	IsLogin bool
+	IsLogin        bool
+	Executor       AzureExecutor
+	subscriptionID string
+	armClient      *arm.Client
+	graphClient    *graph.Client
+	credential     credential
+	tokens         map[string]accessToken
+	tokenLock      sync.Mutex
+	// the service principal ids by app name, known from creating them in this run
+	servicePrincipals map[string]string
+	// Reporter receives the device code sign in message, it can be nil
+	Reporter Reporter
+}
+
+type accessToken struct {
+	value     string
+	expiresOn time.Time
+}
+
+// run an az command through the configured executor
+func (a *AzureCLI) Run(args ...string) (string, error) {
+	if a.Executor == nil {
+		a.Executor = &CLIExecutor{}
+	}
+	return a.Executor.Run(args...)
 }
 
-// login to azure
-func (a AzureCLI) Login() error {
-	if !a.IsLogin {
-		var stdout, stderr bytes.Buffer
-		if viper.GetString("AZURE_ADMIN_LOGIN_NAME") == "" {
-			logrus.Fatal("the field AZURE_ADMIN_LOGIN_NAME in the config file is empty. Please add your azure administrator login name to the config file")
+// read the azure admin password from the config or prompt for it
+func AdminPassword() (string, error) {
+	if viper.GetString("AZURE_ADMIN_LOGIN_NAME") == "" {
+		return "", errors.New("the field AZURE_ADMIN_LOGIN_NAME in the config file is empty. Please add your azure administrator login name to the config file")
+	}
+	if viper.GetString("AZURE_ADMIN_LOGIN_PASSWORD") == "" {
+		// the prompt stays off stdout, which carries the events with the json output
+		fmt.Fprintf(os.Stderr, "Enter the current password for '%s' and press Enter: ",
+			viper.GetString("AZURE_ADMIN_LOGIN_NAME"))
+		bytePassword, err := terminal.ReadPassword(syscall.Stdin)
+		if err != nil {
+			return "", err
 		}
-		if viper.GetString("AZURE_ADMIN_LOGIN_PASSWORD") == "" {
-			fmt.Printf("Enter the current password for '%s' and press Enter: ",
-				viper.GetString("AZURE_ADMIN_LOGIN_NAME"))
-			bytePassword, err := terminal.ReadPassword(syscall.Stdin)
-			if err != nil {
-				return err
-			}
-			password := string(bytePassword)
-			fmt.Println() // do not remove it
-			if len(password) == 0 {
-				return errors.New("please enter a valid password")
-			}
-			viper.Set("AZURE_ADMIN_LOGIN_PASSWORD", strings.TrimSpace(password))
+		password := string(bytePassword)
+		fmt.Fprintln(os.Stderr) // do not remove it
+		if len(password) == 0 {
+			return "", errors.New("please enter a valid password")
+		}
+		viper.Set("AZURE_ADMIN_LOGIN_PASSWORD", strings.TrimSpace(password))
+	}
+	return viper.GetString("AZURE_ADMIN_LOGIN_PASSWORD"), nil
+}
+
+// login to azure with the auth mode selected by AZURE_AUTH_MODE, the tokens come from the identity
+// platform except in the session mode which reuses the login of the Azure CLI
+func (a *AzureCLI) Login() error {
+	if a.IsLogin {
+		return nil
+	}
+	mode := viper.GetString("AZURE_AUTH_MODE")
+	switch mode {
+	case AuthSession:
+		if _, err := a.Run("account", "show"); err != nil {
+			return errorWrapper.Wrap(err, "no azure session to reuse, please run 'az login' first")
 		}
-		//login to azure
-		c1 := fmt.Sprintf("az login -u %s -p '%s'",
-			viper.GetString("AZURE_ADMIN_LOGIN_NAME"),
-			viper.GetString("AZURE_ADMIN_LOGIN_PASSWORD"))
-		exe := exec.Command("sh", "-c", c1)
-		exe.Stderr = &stderr
-		exe.Stdout = &stdout
-		err := exe.Run()
-		errorResult := string(stderr.Bytes())
-		if len(errorResult) != 0 {
-			if strings.Contains(errorResult, "Error validating credentials due to invalid username or password") {
-				return errors.New("error in validating credentials due to invalid username or password")
-			}
-			return errors.New(errorResult)
+	case "", AuthPassword, AuthClientSecret, AuthClientCertificate, AuthDeviceCode:
+		if mode == "" {
+			mode = AuthPassword
 		}
+		credential, err := newCredential(mode, a.Reporter)
 		if err != nil {
-			return errors.New("failed in executing the azure login command")
+			return err
 		}
-		a.IsLogin = true
+		a.credential = credential
+		// request the first token now so credential errors are reported at login
+		if _, err := a.GetAccessToken(arm.TokenResource); err != nil {
+			a.credential = nil
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown AZURE_AUTH_MODE '%s', expected one of: %s, %s, %s, %s, %s", mode,
+			AuthPassword, AuthClientSecret, AuthClientCertificate, AuthDeviceCode, AuthSession)
 	}
+	a.IsLogin = true
 	return nil
 }
 
-// azure logout
-func (a AzureCLI) Logout() error {
-	exe := exec.Command("sh", "-c", "az logout")
-	err := exe.Run()
-	if err != nil {
-		err = errorWrapper.Wrap(err, "Failed in executing the azure logout command")
-		return err
-	}
+// azure logout, the tokens and the credential of the run are dropped. A reused session of the
+// Azure CLI belongs to the operator and is never logged out
+func (a *AzureCLI) Logout() error {
+	a.tokenLock.Lock()
+	a.tokens = nil
+	a.tokenLock.Unlock()
+	a.credential = nil
 	a.IsLogin = false
 	return nil
 }
 
-// create an app in azure
-func (a *AzureCLI) CreateApp(appDisplayName string) error {
-	c := fmt.Sprintf("az ad app create --display-name '%s' --available-to-other-tenants true --homepage %s --reply-urls %s",
-		appDisplayName, viper.GetString("app.url"), viper.GetString("app.url"))
-	_, err := ExecuteCmd(c)
+// create the app and its service principal unless they already exist, the ids of both are returned.
+// An app name shared by several apps is an error rather than a guess
+func (a *AzureCLI) EnsureApp(appDisplayName string) (string, string, error) {
+	client, err := a.GraphClient()
 	if err != nil {
-		return err
+		return "", "", err
 	}
-	return nil
+	apps, err := client.FindApplications(appDisplayName)
+	if err != nil {
+		return "", "", err
+	}
+	if len(apps) > 1 {
+		return "", "", fmt.Errorf("%d apps are named '%s', rename the others or choose another APP_NAME",
+			len(apps), appDisplayName)
+	}
+	var app *graph.Application
+	if len(apps) != 0 {
+		app = &apps[0]
+	} else {
+		app, err = client.CreateApplication(&graph.Application{
+			DisplayName:    appDisplayName,
+			SignInAudience: "AzureADMultipleOrgs",
+			Web: &graph.WebApplication{
+				HomePageURL:  viper.GetString("app.url"),
+				RedirectURIs: []string{viper.GetString("app.url")},
+			},
+		})
+		if err != nil {
+			return "", "", err
+		}
+	}
+	servicePrincipals, err := client.FindServicePrincipals(appDisplayName)
+	if err != nil {
+		return "", "", err
+	}
+	var sp *graph.ServicePrincipal
+	for i := range servicePrincipals {
+		if servicePrincipals[i].AppID == app.AppID {
+			sp = &servicePrincipals[i]
+		}
+	}
+	if sp == nil {
+		if sp, err = client.CreateServicePrincipal(app.AppID); err != nil {
+			return "", "", err
+		}
+		if err := client.AddServicePrincipalTag(sp, "WindowsAzureActiveDirectoryIntegratedApp"); err != nil {
+			return "", "", err
+		}
+	}
+	a.rememberServicePrincipal(appDisplayName, sp.ID)
+	return app.ID, sp.ID, nil
 }
 
-// execute a bash command
-func ExecuteCmd(cmd string) (string, error) {
-	var stdout, stderr bytes.Buffer
-	exe := exec.Command("sh", "-c", cmd)
-	exe.Stderr = &stderr
-	exe.Stdout = &stdout
-	err := exe.Run()
-	errorResult := string(stderr.Bytes())
-	if len(errorResult) != 0 && !strings.Contains(errorResult, "deprecated") {
-		return "", errors.New(errorResult)
-	}
-	if err != nil && !strings.Contains(errorResult, "deprecated") {
-		return "", errors.New(fmt.Sprintf("failed in executing the azure command: %s", cmd))
-	}
-	output := string(stdout.Bytes())
-	if len(output) != 0 {
-		return output, nil
-	}
-	return "", nil
+func (a *AzureCLI) rememberServicePrincipal(appName string, id string) {
+	if a.servicePrincipals == nil {
+		a.servicePrincipals = make(map[string]string)
+	}
+	a.servicePrincipals[appName] = id
 }
 
-// create Sp for an azure app
-func (a *AzureCLI) CreateSP(appDisplayName string) error {
-	c := fmt.Sprintf("az ad app list  --display-name '%s' --query [].objectId -o tsv", appDisplayName)
-	output, err := ExecuteCmd(c)
+func (a *AzureCLI) GenerateAppScimTemplate(template string) error {
+	client, err := a.GraphClient()
 	if err != nil {
 		return err
 	}
-	appId := strings.ReplaceAll(output, "\n", "")
-	appId = strings.TrimSpace(appId)
-	c = fmt.Sprintf("az ad sp create --id %s", appId)
-	output, err = ExecuteCmd(c)
+	appSpId, err := a.GetSpId(viper.GetString("APP_NAME"))
 	if err != nil {
 		return err
 	}
-	c = fmt.Sprintf("az ad sp list --display-name '%s' --query [].objectId -o tsv", appDisplayName)
-	output, err = ExecuteCmd(c)
+	appSpScimId, err := a.GetSpScimId(viper.GetString("APP_NAME"))
 	if err != nil {
 		return err
 	}
-	appSpId := strings.ReplaceAll(output, "\n", "")
-	appSpId = strings.TrimSpace(appSpId)
-	c = fmt.Sprintf("az ad sp update --id %s --add tags 'WindowsAzureActiveDirectoryIntegratedApp'", appSpId)
-	output, err = ExecuteCmd(c)
+	b, err := ioutil.ReadFile(template)
+	if err != nil {
+		return err
+	}
+	text := string(b)
+	text = strings.ReplaceAll(text, "APP_SP_ID", appSpId)
+	text = strings.ReplaceAll(text, "APP_SP_SCIM_IP", appSpScimId)
+	buff := []byte(text)
+	job, err := client.CreateSynchronizationJob(appSpId, "scim")
 	if err != nil {
+		return errorWrapper.Wrap(err, "failed in creating a provision job")
+	}
+	jobId := job.ID
+	if jobId == "" {
+		jobId = ScimJobPrefix + appSpScimId
+	}
+	if err := client.PutSynchronizationSchema(appSpId, jobId, buff); err != nil {
+		return errorWrapper.Wrap(err, "failed in deploying app SCIM schema")
+	}
+	nginxSmcUrl := fmt.Sprintf("https://%s/smc/", viper.GetString("NGINX_PUBLIC_IP_ADDRESS"))
+	update := &graph.Application{
+		Web: &graph.WebApplication{HomePageURL: nginxSmcUrl, RedirectURIs: []string{nginxSmcUrl}},
+	}
+	if err := a.UpdateApp(viper.GetString("APP_NAME"), update); err != nil {
 		return err
 	}
+
 	return nil
 }
 
-func GenerateAppScimTemplate(template string) error {
-	accessToken, err := GetGraphAccessToken()
-	accessToken = "Bearer " + accessToken
-	if err != nil {
-		return errorWrapper.Wrap(err, "failed in getting an access token for Graph API")
-	}
-	appSpId, err := GetSpId(viper.GetString("APP_NAME"))
+// print the changes GenerateAppScimTemplate and AddSpTag would make to the app, nothing is changed
+func (a *AzureCLI) PlanAppScim(plan *PlanPrinter, template string, tag string) error {
+	client, err := a.GraphClient()
 	if err != nil {
 		return err
 	}
-	appSpScimId, err := GetSpScimId(viper.GetString("APP_NAME"))
+	appName := viper.GetString("APP_NAME")
+	sp, err := client.FindServicePrincipal(appName)
 	if err != nil {
-		return err
+		plan.Item(PlanWarning, "no service principal found for the app '%s', run deploy-app first", appName)
+		return nil
 	}
-	b, err := ioutil.ReadFile(template)
+	jobs, err := client.ListSynchronizationJobs(sp.ID)
 	if err != nil {
 		return err
 	}
-	text := string(b)
-	text = strings.ReplaceAll(text, "APP_SP_ID", appSpId)
-	text = strings.ReplaceAll(text, "APP_SP_SCIM_IP", appSpScimId)
-	buff := []byte(text)
-	if err := CreateProvisioningJob(accessToken, appSpId); err != nil {
-		return err
+	plan.Item(PlanCreate, "create a SCIM provisioning job for the service principal %s (%d existing jobs)",
+		sp.ID, len(jobs))
+	scimId := ""
+	if len(sp.ServicePrincipalNames) != 0 {
+		scimId = sp.ServicePrincipalNames[0]
 	}
-	if err := DeployAppSchema(buff, appSpId, appSpScimId, accessToken); err != nil {
+	plan.Item(PlanModify, "replace the schema of the job %s%s with %s", ScimJobPrefix, scimId, template)
+	app, err := client.FindApplication(appName)
+	if err != nil {
 		return err
 	}
 	nginxSmcUrl := fmt.Sprintf("https://%s/smc/", viper.GetString("NGINX_PUBLIC_IP_ADDRESS"))
-	args := []string{"--homepage", nginxSmcUrl, "--reply-urls", nginxSmcUrl}
-	if err := UpdateApp(viper.GetString("APP_NAME"), args); err != nil {
-		return err
+	current := &graph.WebApplication{}
+	if app.Web != nil {
+		current = app.Web
 	}
-
+	if current.HomePageURL == nginxSmcUrl {
+		plan.Item(PlanNoChange, "app homepage %s", nginxSmcUrl)
+	} else {
+		plan.Item(PlanModify, "app homepage: %s => %s", current.HomePageURL, nginxSmcUrl)
+	}
+	redirectUris := strings.Join(current.RedirectURIs, ",")
+	if redirectUris == nginxSmcUrl {
+		plan.Item(PlanNoChange, "app reply urls %s", nginxSmcUrl)
+	} else {
+		plan.Item(PlanModify, "app reply urls: %s => %s", redirectUris, nginxSmcUrl)
+	}
+	for _, existing := range sp.Tags {
+		if existing == tag {
+			plan.Item(PlanNoChange, "service principal tag %s", tag)
+			return nil
+		}
+	}
+	plan.Item(PlanCreate, "service principal tag %s", tag)
 	return nil
 }
 
-func AddSpTag(appName string, tag string) error {
-	appId, err := GetSpId(appName)
+func (a *AzureCLI) AddSpTag(appName string, tag string) error {
+	client, err := a.GraphClient()
 	if err != nil {
 		return err
 	}
-	c := fmt.Sprintf("az ad sp update --id %s --add tags '%s'", appId, tag)
-	_, err = ExecuteCmd(c)
+	sp, err := client.FindServicePrincipal(appName)
 	if err != nil {
 		return err
 	}
-	return nil
+	return client.AddServicePrincipalTag(sp, tag)
 }
 
-func GetGraphAccessToken() (string, error) {
-	c := "az account get-access-token --resource https://graph.microsoft.com --query accessToken -o tsv"
-	accessToken, err := ExecuteCmd(c)
-	accessToken = strings.TrimSpace(accessToken)
-	return accessToken, err
+func (a *AzureCLI) GetGraphAccessToken() (string, error) {
+	return a.GetAccessToken(GraphResource)
 }
 
-func GetSpId(appName string) (string, error) {
-	c := fmt.Sprintf("az ad sp list --display-name '%s' --query [0].objectId -o tsv", appName)
-	appId, err := ExecuteCmd(c)
-	return strings.TrimSpace(appId), err
+// get an access token for an azure resource, tokens are cached until shortly before they expire
+func (a *AzureCLI) GetAccessToken(resource string) (string, error) {
+	a.tokenLock.Lock()
+	defer a.tokenLock.Unlock()
+	if token, ok := a.tokens[resource]; ok && time.Until(token.expiresOn) > 5*time.Minute {
+		return token.value, nil
+	}
+	if a.tokens == nil {
+		a.tokens = make(map[string]accessToken)
+	}
+	if a.credential != nil {
+		token, err := a.credential.token(resource)
+		if err != nil {
+			return "", err
+		}
+		a.tokens[resource] = token
+		return token.value, nil
+	}
+	output, err := a.Run("account", "get-access-token", "--resource", resource, "-o", "json")
+	if err != nil {
+		return "", err
+	}
+	var response struct {
+		AccessToken string `json:"accessToken"`
+		ExpiresOn   string `json:"expiresOn"`
+	}
+	if err := json.Unmarshal([]byte(output), &response); err != nil {
+		return "", errorWrapper.Wrap(err, "failed in decoding the access token of "+resource)
+	}
+	expiresOn, err := time.ParseInLocation("2006-01-02 15:04:05.999999", response.ExpiresOn, time.Local)
+	if err != nil {
+		// an unknown expiry is never cached
+		expiresOn = time.Now()
+	}
+	a.tokens[resource] = accessToken{value: response.AccessToken, expiresOn: expiresOn}
+	return response.AccessToken, nil
 }
 
-func GetSpScimId(appName string) (string, error) {
-	c := fmt.Sprintf("az ad sp list --display-name '%s' --query \"[0].servicePrincipalNames[0]\" -o tsv", appName)
-	appId, err := ExecuteCmd(c)
-	return strings.TrimSpace(appId), err
+// the id of the subscription used for the deployment
+func (a *AzureCLI) SubscriptionID() (string, error) {
+	if a.subscriptionID != "" {
+		return a.subscriptionID, nil
+	}
+	subscriptionID := viper.GetString("SUBSCRIPTION_ID")
+	if subscriptionID == "" && a.credential != nil {
+		// without the Azure CLI the subscription can only be guessed when there is exactly one
+		client := arm.NewClient(viper.GetString("ARM_ENDPOINT"), "", func() (string, error) {
+			return a.GetAccessToken(arm.TokenResource)
+		})
+		a.wrapTransport(client.HTTPClient)
+		subscriptions, err := client.ListSubscriptions()
+		if err != nil {
+			return "", errorWrapper.Wrap(err, "failed in listing the subscriptions")
+		}
+		if len(subscriptions) != 1 {
+			return "", fmt.Errorf("found %d subscriptions, please set SUBSCRIPTION_ID in the config file",
+				len(subscriptions))
+		}
+		subscriptionID = subscriptions[0].SubscriptionID
+	} else if subscriptionID == "" {
+		output, err := a.Run("account", "show", "--query", "id", "-o", "tsv")
+		if err != nil {
+			return "", errorWrapper.Wrap(err, "failed in reading the current subscription")
+		}
+		subscriptionID = strings.TrimSpace(output)
+	}
+	a.subscriptionID = subscriptionID
+	return subscriptionID, nil
 }
 
-func HttpRequest(method string, url string, body []byte, accessToken string) (*http.Response, error) {
-	req, err := http.NewRequest(method, url, bytes.NewBuffer(body))
-	if err != nil {
-		return nil, err
+// a client for Azure Resource Manager authenticated with the current login
+func (a *AzureCLI) ArmClient() (*arm.Client, error) {
+	if a.armClient != nil {
+		return a.armClient, nil
 	}
-	req.Header.Add("Authorization", accessToken)
-	req.Header.Add("Content-Type", "application/json")
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	subscriptionID, err := a.SubscriptionID()
 	if err != nil {
 		return nil, err
 	}
-	return resp, nil
+	a.armClient = arm.NewClient(viper.GetString("ARM_ENDPOINT"), subscriptionID, func() (string, error) {
+		return a.GetAccessToken(arm.TokenResource)
+	})
+	a.wrapTransport(a.armClient.HTTPClient)
+	return a.armClient, nil
+}
+
+// a client for Microsoft Graph authenticated with the current login
+func (a *AzureCLI) GraphClient() (*graph.Client, error) {
+	if a.graphClient == nil {
+		a.graphClient = graph.NewClient(viper.GetString("GRAPH_ENDPOINT"), a.GetGraphAccessToken)
+		a.wrapTransport(a.graphClient.HTTPClient)
+	}
+	return a.graphClient, nil
+}
+
+// send the calls of an HTTP client through the executor when it records or replays them
+func (a *AzureCLI) wrapTransport(client *http.Client) {
+	if wrapper, ok := a.Executor.(TransportWrapper); ok {
+		transport := client.Transport
+		if transport == nil {
+			transport = http.DefaultTransport
+		}
+		client.Transport = wrapper.Transport(transport)
+	}
 }
 
-func CreateProvisioningJob(accessToken string, appId string) error {
-	url := fmt.Sprintf("https://graph.microsoft.com/beta/servicePrincipals/%s/synchronization/jobs", appId)
-	body := `
-{ 
-    "templateId": "scim"
-}`
-	response, err := HttpRequest("POST", url, []byte(body), accessToken)
+func (a *AzureCLI) GetSpId(appName string) (string, error) {
+	if id, ok := a.servicePrincipals[appName]; ok {
+		return id, nil
+	}
+	client, err := a.GraphClient()
 	if err != nil {
-		return err
+		return "", err
 	}
-	if response.StatusCode != http.StatusCreated {
-		return errors.New(fmt.Sprintf("got unexpected http status code: %s for creating a provision job",
-			response.StatusCode))
+	sp, err := client.FindServicePrincipal(appName)
+	if err != nil {
+		return "", err
 	}
-	return nil
+	a.rememberServicePrincipal(appName, sp.ID)
+	return sp.ID, nil
 }
 
-func DeployAppSchema(body []byte, appId string, appScimId string, accessToken string) error {
-	url := fmt.Sprintf("https://graph.microsoft.com/beta/servicePrincipals/%s/synchronization/jobs/scim.7868462e3eae47bb9d58896e03ce6c43.%s/schema", appId, appScimId)
-	response, err := HttpRequest("PUT", url, body, accessToken)
+func (a *AzureCLI) GetSpScimId(appName string) (string, error) {
+	client, err := a.GraphClient()
 	if err != nil {
-		return err
+		return "", err
 	}
-	if response.StatusCode != http.StatusNoContent {
-		return errors.New(fmt.Sprintf("got unexpected http status code: %d for deploying app SCIM schmea",
-			response.StatusCode))
+	sp, err := client.FindServicePrincipal(appName)
+	if err != nil {
+		return "", err
 	}
-	return nil
+	if len(sp.ServicePrincipalNames) == 0 {
+		return "", fmt.Errorf("the service principal of '%s' has no service principal names", appName)
+	}
+	return sp.ServicePrincipalNames[0], nil
 }
 
-func UpdateApp(appName string, args []string) error {
-	output, err := ExecuteCmd(fmt.Sprintf("az ad app list --display-name '%s' --query [].objectId --output tsv",
-		appName))
+func (a *AzureCLI) UpdateApp(appName string, update *graph.Application) error {
+	client, err := a.GraphClient()
 	if err != nil {
 		return err
 	}
-	argsString := strings.Join(args, " ")
-	c := fmt.Sprintf("az ad app update --id %s %s", strings.TrimSpace(output), argsString)
-	_, err = ExecuteCmd(c)
+	app, err := client.FindApplication(appName)
 	if err != nil {
 		return err
 	}
-	return nil
+	return client.UpdateApplication(app.ID, update)
 }
 
-func CreateGroup(name string) error {
-	mailNickname := strings.ToLower(name)
-	mailNickname = strings.ReplaceAll(name, " ", ".")
-	c := fmt.Sprintf("az ad group create --display-name '%s' --mail-nickname '%s'", name, mailNickname)
-	_, err := ExecuteCmd(c)
-	time.Sleep(3 * time.Second)
+func (a *AzureCLI) AddMemberToGroup(groupName string, userEmail string) error {
+	client, err := a.GraphClient()
 	if err != nil {
 		return err
 	}
-	return nil
-}
-
-func AddMemberToGroup(groupName string, userEmail string) error {
-	c := fmt.Sprintf("az ad user list --upn '%s' --query [].objectId -o tsv", userEmail)
-	userIp, err := ExecuteCmd(c)
+	user, err := client.GetUser(userEmail)
 	if err != nil {
 		return err
 	}
-	c = fmt.Sprintf("az ad group member add -g '%s' --member-id %s", groupName, userIp)
-	_, err = ExecuteCmd(c)
+	group, err := client.FindGroup(groupName)
 	if err != nil {
 		return err
 	}
-	return nil
+	return client.AddGroupMember(group.ID, user.ID)
 }
@@ -0,0 +1,149 @@
+package lib
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"github.cicd.cloud.fpdev.io/BD/bd-azure-smc-deployment/lib/pkcs12"
+	"github.com/pkg/errors"
+	"math"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	// the certificate of the ldapsSettings of the domainServices resource
+	CertSourceDomainService = "domain-services"
+	// the certificate LDAPS presents on the external access ip address
+	CertSourceServed = "ldaps-endpoint"
+	// a PFX of the config or of a file
+	CertSourcePfx = "pfx"
+)
+
+// CertificateInfo describes one certificate of the report, Error is set when it could not be read
+type CertificateInfo struct {
+	Source     string     `json:"source"`
+	Location   string     `json:"location,omitempty"`
+	Thumbprint string     `json:"thumbprint,omitempty"`
+	Subject    string     `json:"subject,omitempty"`
+	Issuer     string     `json:"issuer,omitempty"`
+	SANs       []string   `json:"sans,omitempty"`
+	NotAfter   *time.Time `json:"notAfter,omitempty"`
+	DaysLeft   *int       `json:"daysLeft,omitempty"`
+	Error      string     `json:"error,omitempty"`
+}
+
+// CertificateReport is the state of the LDAPS certificates of a deployment
+type CertificateReport struct {
+	Domain       string            `json:"domain"`
+	WindowDays   int               `json:"expiryWindowDays"`
+	Certificates []CertificateInfo `json:"certificates"`
+	Findings     []string          `json:"findings"`
+}
+
+// describe a certificate, the days left are counted from now
+func NewCertificateInfo(source string, location string, certificate *x509.Certificate, now time.Time) CertificateInfo {
+	sans := append([]string(nil), certificate.DNSNames...)
+	for _, ip := range certificate.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	info := CertificateInfo{
+		Source:     source,
+		Location:   location,
+		Thumbprint: CertificateThumbprint(certificate),
+		Subject:    certificate.Subject.String(),
+		Issuer:     certificate.Issuer.String(),
+		SANs:       sans,
+	}
+	info.setExpiry(certificate.NotAfter, now)
+	return info
+}
+
+func (c *CertificateInfo) setExpiry(notAfter time.Time, now time.Time) {
+	notAfter = notAfter.UTC()
+	daysLeft := int(math.Floor(notAfter.Sub(now).Hours() / 24))
+	c.NotAfter, c.DaysLeft = &notAfter, &daysLeft
+}
+
+// the certificate of the domainServices resource, azure only reports the thumbprint and the expiry
+// when the public certificate is missing
+func DomainServiceCertificate(domainService *DomainService, now time.Time) CertificateInfo {
+	settings := domainService.Properties.LdapsSettings
+	info := CertificateInfo{Source: CertSourceDomainService, Location: domainService.Name,
+		Thumbprint: strings.ToUpper(settings.CertificateThumbprint)}
+	if settings.PublicCertificate != "" {
+		der, err := base64.StdEncoding.DecodeString(settings.PublicCertificate)
+		if err == nil {
+			var certificate *x509.Certificate
+			if certificate, err = x509.ParseCertificate(der); err == nil {
+				return NewCertificateInfo(CertSourceDomainService, domainService.Name, certificate, now)
+			}
+		}
+		info.Error = "failed in reading the public certificate: " + err.Error()
+	}
+	expiry, err := domainService.CertificateExpiry()
+	if err != nil {
+		info.Error = err.Error()
+		return info
+	}
+	info.setExpiry(expiry, now)
+	return info
+}
+
+// the certificate LDAPS serves on an address
+func ServedCertificateInfo(address string, timeout time.Duration, now time.Time) CertificateInfo {
+	location := net.JoinHostPort(address, LdapsPort)
+	certificate, err := ServedCertificate(address, timeout)
+	if err != nil {
+		return CertificateInfo{Source: CertSourceServed, Location: location, Error: err.Error()}
+	}
+	return NewCertificateInfo(CertSourceServed, location, certificate, now)
+}
+
+// the certificate of a PFX protected by the password, the first certificate of the bundle is the
+// one of the key
+func PfxCertificateInfo(location string, pfx []byte, password string, now time.Time) CertificateInfo {
+	certificates, err := pkcs12.Certificates(pfx, password)
+	if err != nil {
+		return CertificateInfo{Source: CertSourcePfx, Location: location,
+			Error: errors.Wrap(err, "failed in reading the PFX").Error()}
+	}
+	return NewCertificateInfo(CertSourcePfx, location, certificates[0], now)
+}
+
+// flag the certificates which could not be read, which expire within the window and which differ
+// from the certificate of the managed domain
+func (r *CertificateReport) Check() {
+	r.Findings = []string{}
+	var configured *CertificateInfo
+	for i, info := range r.Certificates {
+		if info.Source == CertSourceDomainService && info.Thumbprint != "" {
+			configured = &r.Certificates[i]
+		}
+	}
+	for _, info := range r.Certificates {
+		name := info.Source
+		if info.Location != "" {
+			name += " " + info.Location
+		}
+		if info.Error != "" {
+			r.Findings = append(r.Findings, fmt.Sprintf("%s: %s", name, info.Error))
+		}
+		if info.NotAfter != nil {
+			switch {
+			case *info.DaysLeft < 0:
+				r.Findings = append(r.Findings, fmt.Sprintf("%s: the certificate %s expired on %s", name,
+					info.Thumbprint, info.NotAfter.Format("2006-01-02")))
+			case *info.DaysLeft <= r.WindowDays:
+				r.Findings = append(r.Findings, fmt.Sprintf("%s: the certificate %s expires in %d days, on %s",
+					name, info.Thumbprint, *info.DaysLeft, info.NotAfter.Format("2006-01-02")))
+			}
+		}
+		if configured != nil && info.Source != CertSourceDomainService && info.Thumbprint != "" &&
+			!strings.EqualFold(info.Thumbprint, configured.Thumbprint) {
+			r.Findings = append(r.Findings, fmt.Sprintf("%s: the certificate %s is not the certificate %s of "+
+				"the managed domain", name, info.Thumbprint, configured.Thumbprint))
+		}
+	}
+}
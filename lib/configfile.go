@@ -0,0 +1,147 @@
+package lib
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// set a top level key of a YAML or JSON config file. A YAML file is edited line by line so that its
+// comments and its order are kept, the key is appended when it is missing. The file is replaced at
+// once so that a failure leaves the old config
+func SetConfigValue(file string, key string, value string) error {
+	if file == "" {
+		return errors.New("no config file is used, pass one with --config")
+	}
+	// a linked config is replaced where it lives
+	file, err := filepath.EvalSymlinks(file)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(file)
+	if err != nil {
+		return err
+	}
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".yaml", ".yml":
+		if content, err = setYAMLValue(content, key, value); err != nil {
+			return fmt.Errorf("failed in setting %s in the config file %s: %v", key, file, err)
+		}
+	case ".json":
+		if content, err = setJSONValue(content, key, value); err != nil {
+			return fmt.Errorf("failed in reading the config file %s: %v", file, err)
+		}
+	default:
+		return fmt.Errorf("the config file %s is not YAML or JSON, set %s in it by hand", file, key)
+	}
+	return replaceFile(file, content, info.Mode().Perm())
+}
+
+// write the content to a temporary file next to the file and rename it over the file
+func replaceFile(file string, content []byte, perm os.FileMode) error {
+	temp, err := ioutil.TempFile(filepath.Dir(file), "."+filepath.Base(file)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+	if _, err := temp.Write(content); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Sync(); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(temp.Name(), perm); err != nil {
+		return err
+	}
+	return os.Rename(temp.Name(), file)
+}
+
+// replace the value of a top level key, the lines of a block, folded or multi-line value and of a
+// nested mapping or sequence go with it. The result is parsed to make sure it holds the value
+func setYAMLValue(content []byte, key string, value string) ([]byte, error) {
+	quoted, _ := json.Marshal(value)
+	keyLine := regexp.MustCompile(`(?i)^(` + regexp.QuoteMeta(key) + `)[ \t]*:([ \t].*)?$`)
+	lines := strings.SplitAfter(string(content), "\n")
+	found := false
+	for i := 0; i < len(lines); i++ {
+		match := keyLine.FindStringSubmatch(strings.TrimRight(lines[i], "\r\n"))
+		if match == nil {
+			continue
+		}
+		// the key keeps the case it is written in
+		lines[i] = match[1] + ": " + string(quoted) + "\n"
+		last := i
+		for j := i + 1; j < len(lines); j++ {
+			line := strings.TrimRight(lines[j], "\r\n")
+			if strings.TrimSpace(line) == "" {
+				continue
+			}
+			if !valueContinues(line) {
+				break
+			}
+			last = j
+		}
+		lines = append(lines[:i+1], lines[last+1:]...)
+		found = true
+		break
+	}
+	result := strings.Join(lines, "")
+	if !found {
+		if result != "" && !strings.HasSuffix(result, "\n") {
+			result += "\n"
+		}
+		result += key + ": " + string(quoted) + "\n"
+	}
+	config := make(map[string]interface{})
+	if err := yaml.Unmarshal([]byte(result), &config); err != nil {
+		return nil, err
+	}
+	for existing, got := range config {
+		if strings.EqualFold(existing, key) && got != value {
+			return nil, fmt.Errorf("the edited config has %v for %s", got, key)
+		}
+	}
+	return []byte(result), nil
+}
+
+// whether a line after a top level key still belongs to its value: an indented line, or an item of a
+// sequence which YAML allows at the indentation of the key
+func valueContinues(line string) bool {
+	if line[0] == ' ' || line[0] == '\t' {
+		return true
+	}
+	return line == "-" || strings.HasPrefix(line, "- ")
+}
+
+func setJSONValue(content []byte, key string, value string) ([]byte, error) {
+	config := make(map[string]interface{})
+	if err := json.Unmarshal(content, &config); err != nil {
+		return nil, err
+	}
+	for existing := range config {
+		if strings.EqualFold(existing, key) {
+			key = existing
+		}
+	}
+	config[key] = value
+	b, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(b, '\n'), nil
+}
@@ -0,0 +1,65 @@
+package lib
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSetYAMLValue(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{"plain", "# the deployment\nDOMAIN_NAME: example.com\nPFX_CERTIFICATE_BASE64: old\nSMC:\n  PORT: 8082\n",
+			"# the deployment\nDOMAIN_NAME: example.com\nPFX_CERTIFICATE_BASE64: \"new\"\nSMC:\n  PORT: 8082\n"},
+		{"literal block", "PFX_CERTIFICATE_BASE64: |\n  MIIK\n  AAAA\n\nDOMAIN_NAME: example.com\n",
+			"PFX_CERTIFICATE_BASE64: \"new\"\n\nDOMAIN_NAME: example.com\n"},
+		{"folded block", "pfx_certificate_base64: >-\n    MIIK\n\n    AAAA\n# the domain\nDOMAIN_NAME: example.com\n",
+			"pfx_certificate_base64: \"new\"\n# the domain\nDOMAIN_NAME: example.com\n"},
+		{"sequence", "PFX_CERTIFICATE_BASE64:\n- a\n- b\nDOMAIN_NAME: example.com",
+			"PFX_CERTIFICATE_BASE64: \"new\"\nDOMAIN_NAME: example.com"},
+		{"missing", "DOMAIN_NAME: example.com", "DOMAIN_NAME: example.com\nPFX_CERTIFICATE_BASE64: \"new\"\n"},
+	}
+	for _, test := range tests {
+		got, err := setYAMLValue([]byte(test.content), "PFX_CERTIFICATE_BASE64", "new")
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if string(got) != test.want {
+			t.Errorf("%s: setYAMLValue() =\n%s\nwant\n%s", test.name, got, test.want)
+		}
+	}
+}
+
+func TestSetConfigValueReplacesTheFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "deployment.yaml")
+	if err := ioutil.WriteFile(file, []byte("DOMAIN_NAME: example.com\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetConfigValue(file, "PFX_CERTIFICATE_BASE64", "MIIK"); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("the config file has the mode %v, want 0600", info.Mode().Perm())
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Errorf("the config directory has %d files, the temporary file was left behind", len(files))
+	}
+}
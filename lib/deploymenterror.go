@@ -0,0 +1,199 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.cicd.cloud.fpdev.io/BD/bd-azure-smc-deployment/lib/arm"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+	"io"
+	"strings"
+)
+
+// the cause of every DeploymentError
+var ErrDeploymentFailed = errors.New("the template deployment failed")
+
+// a hint for a known failure, Message narrows the match to errors containing it
+type errorHint struct {
+	Code    string
+	Message string
+	Hint    string
+}
+
+// the known failures of the AAD DS deployment
+var errorHints = []errorHint{
+	{Code: "MissingSubscriptionRegistration",
+		Hint: "register the resource provider with: az provider register --namespace Microsoft.AAD"},
+	{Code: "NoRegisteredProviderFound",
+		Hint: "register the resource provider with: az provider register --namespace Microsoft.AAD"},
+	{Code: "MissingRegistrationForType",
+		Hint: "register the resource provider with: az provider register --namespace Microsoft.AAD"},
+	{Code: "DomainNameConflict",
+		Hint: "the tenant already has a managed domain, only one AAD DS domain is allowed per tenant"},
+	{Code: "Conflict", Message: "already exists",
+		Hint: "the tenant already has a managed domain, only one AAD DS domain is allowed per tenant"},
+	{Code: "InUseSubnetCannotBeDeleted",
+		Hint: "the subnet is used by other resources, pick another DOMAIN_SERVICES_SUBNET_NAME"},
+	{Code: "InUseSubnetCannotBeUpdated",
+		Hint: "the subnet is used by other resources, pick another DOMAIN_SERVICES_SUBNET_NAME"},
+	{Code: "SubnetInUse",
+		Hint: "the subnet is used by other resources, pick another DOMAIN_SERVICES_SUBNET_NAME"},
+	{Code: "NetcfgInvalidSubnet",
+		Hint: "DOMAIN_SERVICES_SUBNET_ADDRESS_PREFIX must be inside DOMAIN_SERVICES_VNET_ADDRESS_PREFIX"},
+	{Code: "SecurityRuleInvalidAddressPrefix",
+		Hint: "an entry of LDAPS_ALLOWED_CIDRS is not a valid address prefix"},
+	{Code: "InvalidCertificate",
+		Hint: "the LDAPS certificate is invalid, generate it again with generate-ssl-cert"},
+	{Code: "InvalidParameter", Message: "pfx",
+		Hint: "the LDAPS certificate or its password is invalid, generate it again with generate-ssl-cert"},
+	{Code: "AuthorizationFailed",
+		Hint: "the account needs the Contributor role on the subscription or the resource group"},
+	{Code: "RequestDisallowedByPolicy",
+		Hint: "an Azure policy denies the resource, ask the subscription owner for an exemption"},
+	{Code: "SkuNotAvailable",
+		Hint: "the resource is not available in the LOCATION, pick another region"},
+	{Code: "LocationNotAvailableForResourceType",
+		Hint: "AAD DS is not available in the LOCATION, pick another region"},
+}
+
+// FailedOperation is a deployment operation which failed and the resource it targeted
+type FailedOperation struct {
+	OperationID  string
+	ResourceType string
+	ResourceName string
+	ResourceID   string
+	Err          *arm.Error
+}
+
+// DeploymentError is the decoded failure of a template deployment
+type DeploymentError struct {
+	Deployment string
+	Err        *arm.Error
+	Operations []FailedOperation
+}
+
+func (e *DeploymentError) Error() string {
+	var b bytes.Buffer
+	e.Render(&b)
+	return strings.TrimRight(b.String(), "\n")
+}
+
+func (e *DeploymentError) Cause() error {
+	return ErrDeploymentFailed
+}
+
+// the hints of every known failure in the error tree
+func (e *DeploymentError) Hints() []string {
+	var hints []string
+	seen := make(map[string]bool)
+	var walk func(err *arm.Error)
+	walk = func(err *arm.Error) {
+		if err == nil {
+			return
+		}
+		for _, hint := range errorHints {
+			if hint.Code == err.Code && strings.Contains(strings.ToLower(err.Message), hint.Message) &&
+				!seen[hint.Hint] {
+				seen[hint.Hint] = true
+				hints = append(hints, hint.Hint)
+			}
+		}
+		for i := range err.Details {
+			walk(&err.Details[i])
+		}
+	}
+	walk(e.Err)
+	for _, operation := range e.Operations {
+		walk(operation.Err)
+	}
+	return hints
+}
+
+// write the error tree, the failing operations and the hints
+func (e *DeploymentError) Render(w io.Writer) {
+	fmt.Fprintf(w, "the template deployment %s failed\n", e.Deployment)
+	if e.Err != nil {
+		renderError(w, e.Err, 1)
+	}
+	for _, operation := range e.Operations {
+		fmt.Fprintf(w, "  operation %s on %s %s\n", operation.OperationID, operation.ResourceType,
+			operation.ResourceName)
+		if operation.ResourceID != "" {
+			fmt.Fprintf(w, "    resource: %s\n", operation.ResourceID)
+		}
+		if operation.Err != nil {
+			renderError(w, operation.Err, 2)
+		}
+	}
+	for _, hint := range e.Hints() {
+		fmt.Fprintf(w, "  hint: %s\n", hint)
+	}
+}
+
+func renderError(w io.Writer, err *arm.Error, depth int) {
+	indent := strings.Repeat("  ", depth)
+	fmt.Fprintf(w, "%s%s: %s\n", indent, err.Code, strings.TrimSpace(err.Message))
+	if err.Target != "" {
+		fmt.Fprintf(w, "%s  target: %s\n", indent, err.Target)
+	}
+	for i := range err.Details {
+		renderError(w, &err.Details[i], depth+1)
+	}
+}
+
+// decode the status message of an operation, it is an error object, an object wrapping it or plain text
+func operationError(statusMessage json.RawMessage) *arm.Error {
+	if len(statusMessage) == 0 {
+		return nil
+	}
+	var wrapped struct {
+		Error *arm.Error `json:"error"`
+	}
+	if err := json.Unmarshal(statusMessage, &wrapped); err == nil && wrapped.Error != nil {
+		return wrapped.Error
+	}
+	plain := &arm.Error{}
+	if err := json.Unmarshal(statusMessage, plain); err == nil && plain.Code != "" {
+		return plain
+	}
+	var text string
+	if err := json.Unmarshal(statusMessage, &text); err == nil {
+		return &arm.Error{Message: text}
+	}
+	return &arm.Error{Message: string(statusMessage)}
+}
+
+// read the failure of a deployment with its failed operations
+func (a *AzureCLI) DeploymentError(name string) (*DeploymentError, error) {
+	client, err := a.ArmClient()
+	if err != nil {
+		return nil, err
+	}
+	resourceGroup := viper.GetString("RESOURCE_GROUP")
+	deployment, err := client.GetDeployment(resourceGroup, name)
+	if err != nil {
+		return nil, err
+	}
+	operations, err := client.ListDeploymentOperations(resourceGroup, name)
+	if err != nil {
+		return nil, err
+	}
+	deploymentErr := &DeploymentError{Deployment: name, Err: deployment.Properties.Error}
+	for _, operation := range operations {
+		if operation.Properties.ProvisioningState != arm.StateFailed {
+			continue
+		}
+		failed := FailedOperation{
+			OperationID: operation.OperationID,
+			Err:         operationError(operation.Properties.StatusMessage),
+		}
+		if target := operation.Properties.TargetResource; target != nil {
+			failed.ResourceType = target.ResourceType
+			failed.ResourceName = target.ResourceName
+			failed.ResourceID = target.ID
+		}
+		deploymentErr.Operations = append(deploymentErr.Operations, failed)
+	}
+	return deploymentErr, nil
+}
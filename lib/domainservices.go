@@ -0,0 +1,216 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.cicd.cloud.fpdev.io/BD/bd-azure-smc-deployment/lib/arm"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	DomainServicesType       = "Microsoft.AAD/domainServices"
+	DomainServicesApiVersion = "2021-05-01"
+
+	// the service status of a healthy replica set
+	ReplicaSetRunning = "Running"
+)
+
+type LdapsSettings struct {
+	Ldaps                   string `json:"ldaps,omitempty"`
+	ExternalAccess          string `json:"externalAccess,omitempty"`
+	ExternalAccessIpAddress string `json:"externalAccessIpAddress,omitempty"`
+	CertificateThumbprint   string `json:"certificateThumbprint,omitempty"`
+	CertificateNotAfter     string `json:"certificateNotAfter,omitempty"`
+	PublicCertificate       string `json:"publicCertificate,omitempty"`
+}
+
+type HealthMonitor struct {
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	Details string `json:"details"`
+}
+
+type HealthAlert struct {
+	ID            string `json:"id"`
+	Name          string `json:"name"`
+	Issue         string `json:"issue"`
+	Severity      string `json:"severity"`
+	Raised        string `json:"raised"`
+	LastDetected  string `json:"lastDetected"`
+	ResolutionUri string `json:"resolutionUri"`
+}
+
+// a replica set of the managed domain, with its domain controllers and health
+type ReplicaSet struct {
+	ReplicaSetID              string          `json:"replicaSetId"`
+	Location                  string          `json:"location"`
+	SubnetId                  string          `json:"subnetId"`
+	DomainControllerIpAddress []string        `json:"domainControllerIpAddress"`
+	ExternalAccessIpAddress   string          `json:"externalAccessIpAddress"`
+	ServiceStatus             string          `json:"serviceStatus"`
+	HealthLastEvaluated       string          `json:"healthLastEvaluated"`
+	HealthMonitors            []HealthMonitor `json:"healthMonitors"`
+	HealthAlerts              []HealthAlert   `json:"healthAlerts"`
+}
+
+type DomainServiceProperties struct {
+	DomainName             string                 `json:"domainName"`
+	ProvisioningState      string                 `json:"provisioningState"`
+	SubnetId               string                 `json:"subnetId"`
+	Sku                    string                 `json:"sku"`
+	FilteredSync           string                 `json:"filteredSync"`
+	LdapsSettings          LdapsSettings          `json:"ldapsSettings"`
+	DomainSecuritySettings DomainSecuritySettings `json:"domainSecuritySettings"`
+	NotificationSettings   NotificationSettings   `json:"notificationSettings"`
+	ReplicaSets            []ReplicaSet           `json:"replicaSets"`
+}
+
+type DomainService struct {
+	ID         string
+	Name       string
+	Properties DomainServiceProperties
+}
+
+// the id of the domainServices resource of the deployment
+func (a *AzureCLI) DomainServiceID() (string, error) {
+	client, err := a.ArmClient()
+	if err != nil {
+		return "", err
+	}
+	return client.ResourceID(viper.GetString("RESOURCE_GROUP"), DomainServicesType,
+		viper.GetString("DOMAIN_NAME")), nil
+}
+
+// read the domainServices resource of the deployment
+func (a *AzureCLI) GetDomainService() (*DomainService, error) {
+	client, err := a.ArmClient()
+	if err != nil {
+		return nil, err
+	}
+	id, err := a.DomainServiceID()
+	if err != nil {
+		return nil, err
+	}
+	resource, err := client.GetResource(id, DomainServicesApiVersion)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed in reading the domainServices resource")
+	}
+	domainService := &DomainService{ID: resource.ID, Name: resource.Name}
+	if err := json.Unmarshal(resource.Properties, &domainService.Properties); err != nil {
+		return nil, errors.Wrap(err, "failed in decoding the domainServices properties")
+	}
+	return domainService, nil
+}
+
+// whether the managed domain or one of its replica sets is in the subnet
+func (d *DomainService) UsesSubnet(subnetID string) bool {
+	if strings.EqualFold(d.Properties.SubnetId, subnetID) {
+		return true
+	}
+	for _, replicaSet := range d.Properties.ReplicaSets {
+		if strings.EqualFold(replicaSet.SubnetId, subnetID) {
+			return true
+		}
+	}
+	return false
+}
+
+// the reasons the managed domain is not healthy yet, none when it is ready for LDAPS
+func (d *DomainService) Unhealthy() []string {
+	var reasons []string
+	if d.Properties.ProvisioningState != arm.StateSucceeded {
+		reasons = append(reasons, "provisioning state is "+d.Properties.ProvisioningState)
+	}
+	if len(d.Properties.ReplicaSets) == 0 {
+		reasons = append(reasons, "no replica set yet")
+	}
+	for _, replicaSet := range d.Properties.ReplicaSets {
+		if replicaSet.ServiceStatus != ReplicaSetRunning {
+			reasons = append(reasons, fmt.Sprintf("replica set in %s is %s", replicaSet.Location,
+				replicaSet.ServiceStatus))
+		}
+		if len(replicaSet.DomainControllerIpAddress) == 0 {
+			reasons = append(reasons, fmt.Sprintf("replica set in %s has no domain controller yet", replicaSet.Location))
+		}
+		for _, alert := range replicaSet.HealthAlerts {
+			reasons = append(reasons, fmt.Sprintf("health alert %s: %s", alert.Name, alert.Issue))
+		}
+	}
+	if d.Properties.LdapsSettings.ExternalAccessIpAddress == "" {
+		reasons = append(reasons, "no LDAPS external access ip address yet")
+	}
+	return reasons
+}
+
+// poll the domainServices resource until it is healthy, every change of its health monitors,
+// alerts and status is reported
+func (a *AzureCLI) WaitForHealthyDomainService(reporter Reporter, timeout time.Duration,
+	interval time.Duration) (*DomainService, error) {
+	deadline := time.Now().Add(timeout)
+	started := time.Now()
+	seen := make(map[string]string)
+	for {
+		domainService, err := a.GetDomainService()
+		if err != nil {
+			return nil, err
+		}
+		current := domainServiceHealth(domainService)
+		for _, key := range sortedKeys(current) {
+			if seen[key] != current[key] {
+				report(reporter, Event{Type: EventResourceStatus, ResourceType: DomainServicesType,
+					Resource: key, Status: current[key], ElapsedSeconds: time.Since(started).Seconds()})
+			}
+		}
+		for _, key := range sortedKeys(seen) {
+			if _, ok := current[key]; !ok {
+				report(reporter, Event{Type: EventResourceStatus, ResourceType: DomainServicesType,
+					Resource: key, Status: "Resolved", ElapsedSeconds: time.Since(started).Seconds()})
+			}
+		}
+		seen = current
+		reasons := domainService.Unhealthy()
+		if len(reasons) == 0 {
+			return domainService, nil
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("the managed domain is not healthy after %s: %s", timeout,
+				strings.Join(reasons, ", "))
+		}
+		time.Sleep(interval)
+	}
+}
+
+// the health of the managed domain as a flat map, so changes are easy to detect
+func domainServiceHealth(domainService *DomainService) map[string]string {
+	health := map[string]string{"provisioning": domainService.Properties.ProvisioningState}
+	if ip := domainService.Properties.LdapsSettings.ExternalAccessIpAddress; ip != "" {
+		health["ldaps external access"] = ip
+	}
+	for _, replicaSet := range domainService.Properties.ReplicaSets {
+		prefix := "replica set " + replicaSet.Location
+		health[prefix] = replicaSet.ServiceStatus
+		if len(replicaSet.DomainControllerIpAddress) != 0 {
+			health[prefix+" domain controllers"] = strings.Join(replicaSet.DomainControllerIpAddress, ", ")
+		}
+		for _, monitor := range replicaSet.HealthMonitors {
+			health[prefix+" monitor "+monitor.Name] = monitor.Details
+		}
+		for _, alert := range replicaSet.HealthAlerts {
+			health[prefix+" alert "+alert.Name] = alert.Severity + ": " + alert.Issue
+		}
+	}
+	return health
+}
+
+func sortedKeys(values map[string]string) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
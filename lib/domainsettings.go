@@ -0,0 +1,192 @@
+package lib
+
+import (
+	"fmt"
+	"github.com/spf13/viper"
+	"net/mail"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	Enabled  = "Enabled"
+	Disabled = "Disabled"
+
+	// the settings of the original template, every legacy protocol is enabled
+	DomainSecurityPresetLegacy = "legacy"
+	// NTLMv1, TLS 1.0 and RC4 are disabled and Kerberos armoring is enabled
+	DomainSecurityPresetHardened = "hardened"
+)
+
+// the SKUs of a managed domain
+var domainSkus = []string{"Standard", "Enterprise", "Premium"}
+
+// DomainSecuritySettings is domainSecuritySettings of the domainServices resource
+type DomainSecuritySettings struct {
+	NtlmV1                string `json:"ntlmV1"`
+	TlsV1                 string `json:"tlsV1"`
+	SyncNtlmPasswords     string `json:"syncNtlmPasswords"`
+	SyncKerberosPasswords string `json:"syncKerberosPasswords"`
+	SyncOnPremPasswords   string `json:"syncOnPremPasswords"`
+	KerberosRc4Encryption string `json:"kerberosRc4Encryption"`
+	KerberosArmoring      string `json:"kerberosArmoring"`
+}
+
+// NotificationSettings is notificationSettings of the domainServices resource
+type NotificationSettings struct {
+	NotifyGlobalAdmins   string   `json:"notifyGlobalAdmins"`
+	NotifyDcAdmins       string   `json:"notifyDcAdmins"`
+	AdditionalRecipients []string `json:"additionalRecipients"`
+}
+
+// DomainSettings are the settings of the managed domain the config can change
+type DomainSettings struct {
+	Sku                    string
+	FilteredSync           string
+	DomainSecuritySettings DomainSecuritySettings
+	NotificationSettings   NotificationSettings
+}
+
+// a DOMAIN_SECURITY key, the setting it changes and its value in every preset
+type securitySetting struct {
+	key     string
+	field   func(settings *DomainSecuritySettings) *string
+	presets map[string]string
+}
+
+var securitySettings = []securitySetting{
+	{key: "NTLM_V1", field: func(s *DomainSecuritySettings) *string { return &s.NtlmV1 },
+		presets: map[string]string{DomainSecurityPresetLegacy: Enabled, DomainSecurityPresetHardened: Disabled}},
+	{key: "TLS_V1", field: func(s *DomainSecuritySettings) *string { return &s.TlsV1 },
+		presets: map[string]string{DomainSecurityPresetLegacy: Enabled, DomainSecurityPresetHardened: Disabled}},
+	{key: "SYNC_NTLM_PASSWORDS", field: func(s *DomainSecuritySettings) *string { return &s.SyncNtlmPasswords },
+		presets: map[string]string{DomainSecurityPresetLegacy: Enabled, DomainSecurityPresetHardened: Enabled}},
+	{key: "SYNC_KERBEROS_PASSWORDS", field: func(s *DomainSecuritySettings) *string { return &s.SyncKerberosPasswords },
+		presets: map[string]string{DomainSecurityPresetLegacy: Enabled, DomainSecurityPresetHardened: Enabled}},
+	{key: "SYNC_ON_PREM_PASSWORDS", field: func(s *DomainSecuritySettings) *string { return &s.SyncOnPremPasswords },
+		presets: map[string]string{DomainSecurityPresetLegacy: Enabled, DomainSecurityPresetHardened: Enabled}},
+	{key: "KERBEROS_RC4_ENCRYPTION", field: func(s *DomainSecuritySettings) *string { return &s.KerberosRc4Encryption },
+		presets: map[string]string{DomainSecurityPresetLegacy: Enabled, DomainSecurityPresetHardened: Disabled}},
+	{key: "KERBEROS_ARMORING", field: func(s *DomainSecuritySettings) *string { return &s.KerberosArmoring },
+		presets: map[string]string{DomainSecurityPresetLegacy: Disabled, DomainSecurityPresetHardened: Enabled}},
+}
+
+// a setting of the config as Enabled or Disabled, it is a boolean or one of the two words
+func enabledValue(key string) (string, error) {
+	switch value := viper.Get(key).(type) {
+	case bool:
+		if value {
+			return Enabled, nil
+		}
+		return Disabled, nil
+	case string:
+		switch strings.ToLower(strings.TrimSpace(value)) {
+		case "enabled":
+			return Enabled, nil
+		case "disabled":
+			return Disabled, nil
+		}
+		if enabled, err := strconv.ParseBool(strings.TrimSpace(value)); err == nil {
+			if enabled {
+				return Enabled, nil
+			}
+			return Disabled, nil
+		}
+	}
+	return "", fmt.Errorf("%s must be true, false, Enabled or Disabled, not '%v'", key, viper.Get(key))
+}
+
+// the domain security settings of DOMAIN_SECURITY_PRESET with the ones of DOMAIN_SECURITY on top
+func domainSecuritySettings() (DomainSecuritySettings, error) {
+	settings := DomainSecuritySettings{}
+	preset := strings.ToLower(strings.TrimSpace(viper.GetString("DOMAIN_SECURITY_PRESET")))
+	if preset != DomainSecurityPresetLegacy && preset != DomainSecurityPresetHardened {
+		return settings, fmt.Errorf("unknown DOMAIN_SECURITY_PRESET '%s', expected %s or %s", preset,
+			DomainSecurityPresetLegacy, DomainSecurityPresetHardened)
+	}
+	known := make(map[string]bool)
+	for _, setting := range securitySettings {
+		known[strings.ToLower(setting.key)] = true
+		*setting.field(&settings) = setting.presets[preset]
+		key := "DOMAIN_SECURITY." + setting.key
+		if !viper.IsSet(key) {
+			continue
+		}
+		value, err := enabledValue(key)
+		if err != nil {
+			return settings, err
+		}
+		*setting.field(&settings) = value
+	}
+	var unknown []string
+	for key := range viper.GetStringMap("DOMAIN_SECURITY") {
+		if !known[strings.ToLower(key)] {
+			unknown = append(unknown, strings.ToUpper(key))
+		}
+	}
+	if len(unknown) != 0 {
+		sort.Strings(unknown)
+		return settings, fmt.Errorf("unknown DOMAIN_SECURITY settings: %s", strings.Join(unknown, ", "))
+	}
+	return settings, nil
+}
+
+// read and validate the settings of the managed domain from the config
+func ConfiguredDomainSettings() (*DomainSettings, error) {
+	security, err := domainSecuritySettings()
+	if err != nil {
+		return nil, err
+	}
+	settings := &DomainSettings{DomainSecuritySettings: security}
+	for _, sku := range domainSkus {
+		if strings.EqualFold(sku, strings.TrimSpace(viper.GetString("DOMAIN_SKU"))) {
+			settings.Sku = sku
+		}
+	}
+	if settings.Sku == "" {
+		return nil, fmt.Errorf("unknown DOMAIN_SKU '%s', expected one of: %s", viper.GetString("DOMAIN_SKU"),
+			strings.Join(domainSkus, ", "))
+	}
+	if settings.FilteredSync, err = enabledValue("FILTERED_SYNC"); err != nil {
+		return nil, err
+	}
+	if settings.NotificationSettings.NotifyGlobalAdmins, err = enabledValue("NOTIFY_GLOBAL_ADMINS"); err != nil {
+		return nil, err
+	}
+	if settings.NotificationSettings.NotifyDcAdmins, err = enabledValue("NOTIFY_DC_ADMINS"); err != nil {
+		return nil, err
+	}
+	settings.NotificationSettings.AdditionalRecipients = []string{}
+	for _, recipient := range viper.GetStringSlice("NOTIFICATION_RECIPIENTS") {
+		address, err := mail.ParseAddress(strings.TrimSpace(recipient))
+		if err != nil {
+			return nil, fmt.Errorf("the notification recipient '%s' is not an email address", recipient)
+		}
+		settings.NotificationSettings.AdditionalRecipients = append(
+			settings.NotificationSettings.AdditionalRecipients, address.Address)
+	}
+	return settings, nil
+}
+
+// the differences between the settings of a deployed managed domain and the configured ones
+func (s *DomainSettings) Changes(current *DomainServiceProperties) []string {
+	var changes []string
+	changed := func(name string, before string, after string) {
+		if before != after {
+			changes = append(changes, fmt.Sprintf("%s %s -> %s", name, before, after))
+		}
+	}
+	changed("sku", current.Sku, s.Sku)
+	changed("filteredSync", current.FilteredSync, s.FilteredSync)
+	for _, setting := range securitySettings {
+		changed(setting.key, *setting.field(&current.DomainSecuritySettings),
+			*setting.field(&s.DomainSecuritySettings))
+	}
+	changed("notifyGlobalAdmins", current.NotificationSettings.NotifyGlobalAdmins,
+		s.NotificationSettings.NotifyGlobalAdmins)
+	changed("notifyDcAdmins", current.NotificationSettings.NotifyDcAdmins, s.NotificationSettings.NotifyDcAdmins)
+	changed("additionalRecipients", strings.Join(current.NotificationSettings.AdditionalRecipients, ","),
+		strings.Join(s.NotificationSettings.AdditionalRecipients, ","))
+	return changes
+}
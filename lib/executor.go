@@ -0,0 +1,299 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	errorWrapper "github.com/pkg/errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+const (
+	CLIExecutorName    = "cli"
+	RecordExecutorName = "record"
+	ReplayExecutorName = "replay"
+)
+
+// arguments whose following value must never be written to logs or fixtures
+var secretArgs = map[string]bool{
+	"-p":              true,
+	"--password":      true,
+	"--client-secret": true,
+	"--secret":        true,
+}
+
+// the JSON fields of az outputs which hold credentials, such as the token of az account get-access-token
+var secretFields = regexp.MustCompile(
+	`("(?:accessToken|access_token|refreshToken|refresh_token|password|clientSecret|secretText)"\s*:\s*)"(?:[^"\\]|\\.)*"`)
+
+// AzureExecutor runs one Azure CLI command given as argv (without the leading "az")
+// and returns its standard output
+type AzureExecutor interface {
+	Run(args ...string) (string, error)
+}
+
+// create the executor selected in the config
+func NewAzureExecutor(name string, fixtures string) (AzureExecutor, error) {
+	switch name {
+	case "", CLIExecutorName:
+		return &CLIExecutor{}, nil
+	case RecordExecutorName:
+		if fixtures == "" {
+			return nil, errors.New("AZURE_FIXTURES must be set when recording azure commands")
+		}
+		return &RecordingExecutor{Executor: &CLIExecutor{}, FixturesFile: fixtures}, nil
+	case ReplayExecutorName:
+		if fixtures == "" {
+			return nil, errors.New("AZURE_FIXTURES must be set when replaying azure commands")
+		}
+		return NewReplayExecutor(fixtures)
+	}
+	return nil, fmt.Errorf("unknown azure executor '%s', expected one of: %s, %s, %s",
+		name, CLIExecutorName, RecordExecutorName, ReplayExecutorName)
+}
+
+// the command line of an az call with all secrets masked
+func CommandLine(args []string) string {
+	masked := make([]string, len(args))
+	for i, arg := range args {
+		if i > 0 && secretArgs[args[i-1]] {
+			masked[i] = "****"
+			continue
+		}
+		masked[i] = arg
+	}
+	return "az " + strings.Join(masked, " ")
+}
+
+// an az output with the values of its credential fields masked
+func MaskOutput(output string) string {
+	return secretFields.ReplaceAllString(output, `${1}"****"`)
+}
+
+// CLIExecutor runs the az binary directly with argv, no shell is involved
+type CLIExecutor struct {
+	Binary string
+	Env    []string
+}
+
+func (e *CLIExecutor) Run(args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	binary := e.Binary
+	if binary == "" {
+		binary = "az"
+	}
+	exe := exec.Command(binary, args...)
+	exe.Env = append(os.Environ(), e.Env...)
+	exe.Stderr = &stderr
+	exe.Stdout = &stdout
+	err := exe.Run()
+	errorResult := stderr.String()
+	if len(errorResult) != 0 && !strings.Contains(errorResult, "deprecated") {
+		return "", errors.New(errorResult)
+	}
+	if err != nil && !strings.Contains(errorResult, "deprecated") {
+		return "", fmt.Errorf("failed in executing the azure command: %s", CommandLine(args))
+	}
+	return stdout.String(), nil
+}
+
+// TransportWrapper is an executor which also records or replays the HTTP calls of the ARM and Graph
+// clients, Transport wraps the transport of their http.Client
+type TransportWrapper interface {
+	Transport(base http.RoundTripper) http.RoundTripper
+}
+
+// the response headers kept in the fixture of an HTTP call, the ones long running operations are
+// followed with
+var fixtureHeaders = []string{"Content-Type", "Location", "Azure-AsyncOperation", "Retry-After"}
+
+// a canned result of one az command, or of one HTTP call with its status and headers. The command
+// of an HTTP call is its method and URL
+type Fixture struct {
+	Command string            `json:"command"`
+	Output  string            `json:"output"`
+	Error   string            `json:"error,omitempty"`
+	Status  int               `json:"status,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+func httpCommand(req *http.Request) string {
+	return req.Method + " " + req.URL.String()
+}
+
+func readFixtures(path string) ([]Fixture, error) {
+	var fixtures []Fixture
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &fixtures); err != nil {
+		return nil, errorWrapper.Wrap(err, "failed in decoding the fixtures file "+path)
+	}
+	return fixtures, nil
+}
+
+// RecordingExecutor passes every command to Executor and appends its result to FixturesFile, so are
+// the HTTP calls of its Transport. The credentials in the outputs are masked
+type RecordingExecutor struct {
+	Executor     AzureExecutor
+	FixturesFile string
+	fixtures     []Fixture
+	lock         sync.Mutex
+}
+
+func (e *RecordingExecutor) Run(args ...string) (string, error) {
+	output, err := e.Executor.Run(args...)
+	fixture := Fixture{Command: CommandLine(args), Output: MaskOutput(output)}
+	if err != nil {
+		fixture.Error = MaskOutput(err.Error())
+	}
+	if recordErr := e.record(fixture); recordErr != nil {
+		return output, recordErr
+	}
+	return output, err
+}
+
+// append a fixture to the fixtures file
+func (e *RecordingExecutor) record(fixture Fixture) error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.fixtures = append(e.fixtures, fixture)
+	b, err := json.MarshalIndent(e.fixtures, "", " ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(e.FixturesFile, b, 0600); err != nil {
+		return errorWrapper.Wrap(err, "failed in writing the fixtures file")
+	}
+	return nil
+}
+
+// the HTTP calls go through base and are recorded next to the az commands
+func (e *RecordingExecutor) Transport(base http.RoundTripper) http.RoundTripper {
+	return &recordingTransport{base: base, recorder: e}
+}
+
+type recordingTransport struct {
+	base     http.RoundTripper
+	recorder *RecordingExecutor
+}
+
+func (t *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	fixture := Fixture{Command: httpCommand(req)}
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		fixture.Error = err.Error()
+		if recordErr := t.recorder.record(fixture); recordErr != nil {
+			return nil, recordErr
+		}
+		return nil, err
+	}
+	// the body is read to be recorded and handed to the caller again
+	b, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(b))
+	fixture.Output, fixture.Status = MaskOutput(string(b)), resp.StatusCode
+	for _, header := range fixtureHeaders {
+		if value := resp.Header.Get(header); value != "" {
+			if fixture.Headers == nil {
+				fixture.Headers = make(map[string]string)
+			}
+			fixture.Headers[header] = value
+		}
+	}
+	if err := t.recorder.record(fixture); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// ReplayExecutor serves recorded fixtures instead of calling azure or the ARM and Graph APIs.
+// Repeated commands are answered in the recorded order, the last answer is repeated once they run out
+type ReplayExecutor struct {
+	fixtures map[string][]Fixture
+	lock     sync.Mutex
+}
+
+func NewReplayExecutor(path string) (*ReplayExecutor, error) {
+	fixtures, err := readFixtures(path)
+	if err != nil {
+		return nil, err
+	}
+	e := &ReplayExecutor{fixtures: make(map[string][]Fixture)}
+	for _, fixture := range fixtures {
+		e.fixtures[fixture.Command] = append(e.fixtures[fixture.Command], fixture)
+	}
+	return e, nil
+}
+
+func (e *ReplayExecutor) Run(args ...string) (string, error) {
+	fixture, err := e.next(CommandLine(args))
+	if err != nil {
+		return "", err
+	}
+	if fixture.Error != "" {
+		return fixture.Output, errors.New(fixture.Error)
+	}
+	return fixture.Output, nil
+}
+
+// the next recorded answer of a command
+func (e *ReplayExecutor) next(command string) (Fixture, error) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	queue := e.fixtures[command]
+	if len(queue) == 0 {
+		return Fixture{}, fmt.Errorf("no fixture found for the command: %s", command)
+	}
+	if len(queue) > 1 {
+		e.fixtures[command] = queue[1:]
+	}
+	return queue[0], nil
+}
+
+// the HTTP calls are answered from the fixtures, nothing is sent
+func (e *ReplayExecutor) Transport(base http.RoundTripper) http.RoundTripper {
+	return &replayTransport{replay: e}
+}
+
+type replayTransport struct {
+	replay *ReplayExecutor
+}
+
+func (t *replayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+	fixture, err := t.replay.next(httpCommand(req))
+	if err != nil {
+		return nil, err
+	}
+	if fixture.Error != "" {
+		return nil, errors.New(fixture.Error)
+	}
+	resp := &http.Response{
+		Status:     fmt.Sprintf("%d %s", fixture.Status, http.StatusText(fixture.Status)),
+		StatusCode: fixture.Status,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+		Body:       ioutil.NopCloser(strings.NewReader(fixture.Output)),
+		Request:    req,
+	}
+	for header, value := range fixture.Headers {
+		resp.Header.Set(header, value)
+	}
+	return resp, nil
+}
@@ -0,0 +1,162 @@
+package lib
+
+import (
+	"errors"
+	"github.cicd.cloud.fpdev.io/BD/bd-azure-smc-deployment/lib/arm"
+	"github.cicd.cloud.fpdev.io/BD/bd-azure-smc-deployment/lib/graph"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type fakeExecutor struct {
+	output string
+	err    error
+}
+
+func (e *fakeExecutor) Run(args ...string) (string, error) {
+	return e.output, e.err
+}
+
+func TestCommandLineMasksSecrets(t *testing.T) {
+	got := CommandLine([]string{"login", "-u", "admin@example.com", "-p", "Secr3t"})
+	if want := "az login -u admin@example.com -p ****"; got != want {
+		t.Errorf("CommandLine() = %q, want %q", got, want)
+	}
+}
+
+func TestMaskOutput(t *testing.T) {
+	output := `{"accessToken": "eyJ0eXAi.secret", "refresh_token":"r\"t", "expiresOn": "2099-01-01"}`
+	got := MaskOutput(output)
+	if strings.Contains(got, "secret") || strings.Contains(got, `r\"t`) {
+		t.Errorf("MaskOutput() kept a credential: %s", got)
+	}
+	if !strings.Contains(got, `"expiresOn": "2099-01-01"`) {
+		t.Errorf("MaskOutput() changed another field: %s", got)
+	}
+}
+
+func TestRecordingExecutorMasksTokens(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fixtures")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fixtures := filepath.Join(dir, "fixtures.json")
+	token := `{"accessToken": "eyJ0eXAi.secret", "expiresOn": "2099-01-01 00:00:00.000000"}`
+	recorder := &RecordingExecutor{Executor: &fakeExecutor{output: token}, FixturesFile: fixtures}
+	output, err := recorder.Run("account", "get-access-token", "--resource", arm.TokenResource, "-o", "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if output != token {
+		t.Errorf("the recorder changed the output passed to the caller: %s", output)
+	}
+	recorded, err := ioutil.ReadFile(fixtures)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(recorded), "eyJ0eXAi") {
+		t.Errorf("the access token was written to the fixtures file: %s", recorded)
+	}
+}
+
+func TestRecordingExecutorKeepsErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fixtures")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fixtures := filepath.Join(dir, "fixtures.json")
+	recorder := &RecordingExecutor{Executor: &fakeExecutor{err: errors.New("failed")}, FixturesFile: fixtures}
+	if _, err := recorder.Run("group", "show", "-n", "rg"); err == nil || err.Error() != "failed" {
+		t.Errorf("Run() error = %v, want failed", err)
+	}
+	replay, err := NewReplayExecutor(fixtures)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := replay.Run("group", "show", "-n", "rg"); err == nil || err.Error() != "failed" {
+		t.Errorf("the replayed error = %v, want failed", err)
+	}
+}
+
+func TestReplayFixtures(t *testing.T) {
+	executor, err := NewReplayExecutor(filepath.Join("testdata", "azure_fixtures.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	azure := &AzureCLI{Executor: executor}
+	subscriptionID, err := azure.SubscriptionID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if subscriptionID != "00000000-0000-0000-0000-000000000001" {
+		t.Errorf("SubscriptionID() = %q", subscriptionID)
+	}
+	token, err := azure.GetAccessToken(arm.TokenResource)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "****" {
+		t.Errorf("GetAccessToken() = %q, want the masked token", token)
+	}
+	if _, err := executor.Run("account", "show"); err == nil || !strings.Contains(err.Error(), "az login") {
+		t.Errorf("the replayed error = %v", err)
+	}
+	if _, err := executor.Run("group", "list"); err == nil {
+		t.Error("a command without fixture must fail")
+	}
+}
+
+// deploy-app end to end without a tenant: the token comes from az and the Graph calls from the fixtures
+func TestReplayEnsureApp(t *testing.T) {
+	executor, err := NewReplayExecutor(filepath.Join("testdata", "deploy_app_fixtures.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	azure := &AzureCLI{Executor: executor}
+	appID, spID, err := azure.EnsureApp("smc-app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if appID != "11111111-1111-1111-1111-111111111111" || spID != "33333333-3333-3333-3333-333333333333" {
+		t.Errorf("EnsureApp() = %s, %s, want the created app and service principal", appID, spID)
+	}
+}
+
+func TestRecordingTransportReplays(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fixtures")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fixtures := filepath.Join(dir, "fixtures.json")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"value":[{"id":"1","displayName":"SMC Admins"}]}`))
+	}))
+	token := func() (string, error) { return "token", nil }
+	recorder := &RecordingExecutor{Executor: &fakeExecutor{}, FixturesFile: fixtures}
+	client := graph.NewClient(server.URL, token)
+	client.HTTPClient.Transport = recorder.Transport(http.DefaultTransport)
+	if _, err := client.FindGroups("SMC Admins"); err != nil {
+		t.Fatal(err)
+	}
+	server.Close()
+	replay, err := NewReplayExecutor(fixtures)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.HTTPClient.Transport = replay.Transport(nil)
+	groups, err := client.FindGroups("SMC Admins")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(groups) != 1 || groups[0].ID != "1" {
+		t.Errorf("the replayed FindGroups() = %+v, want the recorded group", groups)
+	}
+}
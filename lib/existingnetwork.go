@@ -0,0 +1,259 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.cicd.cloud.fpdev.io/BD/bd-azure-smc-deployment/lib/arm"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+	"net"
+	"net/http"
+	"strings"
+)
+
+const (
+	// missing NSG rules fail the deployment
+	NsgModeValidate = "validate"
+	// missing NSG rules are added, a subnet without NSG gets one
+	NsgModeAttach = "attach"
+)
+
+// SubnetCheck is the result of checking an existing subnet for the managed domain
+type SubnetCheck struct {
+	VnetID                 string
+	SubnetID               string
+	Location               string
+	AddressPrefix          string
+	NetworkSecurityGroupID string
+	// the required rules the NSG of the subnet does not allow, all of them when it has no NSG
+	MissingRules []SecurityRule
+	Errors       []string
+	Warnings     []string
+}
+
+// the problems which prevent the deployment in the subnet, nil when there is none
+func (c *SubnetCheck) Err() error {
+	if len(c.Errors) == 0 {
+		return nil
+	}
+	return errors.New("the subnet " + c.SubnetID + " cannot be used: " + strings.Join(c.Errors, "; "))
+}
+
+type subnetProperties struct {
+	AddressPrefix        string   `json:"addressPrefix"`
+	AddressPrefixes      []string `json:"addressPrefixes"`
+	NetworkSecurityGroup *struct {
+		ID string `json:"id"`
+	} `json:"networkSecurityGroup"`
+	IpConfigurations []struct {
+		ID string `json:"id"`
+	} `json:"ipConfigurations"`
+	Delegations []struct {
+		Properties struct {
+			ServiceName string `json:"serviceName"`
+		} `json:"properties"`
+	} `json:"delegations"`
+}
+
+// how missing NSG rules of an existing subnet are handled
+func NsgMode() (string, error) {
+	mode := strings.ToLower(strings.TrimSpace(viper.GetString("EXISTING_NSG_MODE")))
+	if mode != NsgModeValidate && mode != NsgModeAttach {
+		return "", fmt.Errorf("unknown EXISTING_NSG_MODE '%s', expected %s or %s", mode, NsgModeValidate, NsgModeAttach)
+	}
+	return mode, nil
+}
+
+func normalizeLocation(location string) string {
+	return strings.ToLower(strings.Replace(location, " ", "", -1))
+}
+
+// check that the existing subnet of the config exists, is empty, is large enough and lets the traffic
+// of the managed domain through. Nothing is changed
+func (a *AzureCLI) CheckExistingSubnet() (*SubnetCheck, error) {
+	mode, err := NsgMode()
+	if err != nil {
+		return nil, err
+	}
+	client, err := a.ArmClient()
+	if err != nil {
+		return nil, err
+	}
+	vnetName := viper.GetString("DOMAIN_SERVICES_VNET_NAME")
+	subnetName := viper.GetString("DOMAIN_SERVICES_SUBNET_NAME")
+	check := &SubnetCheck{VnetID: client.ResourceID(VnetResourceGroup(), VirtualNetworkType, vnetName)}
+	check.SubnetID = check.VnetID + "/subnets/" + subnetName
+	vnet, err := client.GetResource(check.VnetID, NetworkApiVersion)
+	if arm.IsStatus(err, http.StatusNotFound) {
+		check.Errors = append(check.Errors, fmt.Sprintf("the VNet %s does not exist in the resource group %s",
+			vnetName, VnetResourceGroup()))
+		return check, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "failed in reading the VNet")
+	}
+	check.Location = vnet.Location
+	if normalizeLocation(vnet.Location) != normalizeLocation(viper.GetString("LOCATION")) {
+		check.Errors = append(check.Errors, fmt.Sprintf("the VNet is in %s, the managed domain must be in the "+
+			"same region as its VNet but LOCATION is %s", vnet.Location, viper.GetString("LOCATION")))
+	}
+	subnet, err := client.GetResource(check.SubnetID, NetworkApiVersion)
+	if arm.IsStatus(err, http.StatusNotFound) {
+		check.Errors = append(check.Errors, fmt.Sprintf("the subnet %s does not exist in the VNet %s",
+			subnetName, vnetName))
+		return check, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "failed in reading the subnet")
+	}
+	var properties subnetProperties
+	if err := json.Unmarshal(subnet.Properties, &properties); err != nil {
+		return nil, errors.Wrap(err, "failed in decoding the subnet properties")
+	}
+
+	check.AddressPrefix = properties.AddressPrefix
+	if check.AddressPrefix == "" && len(properties.AddressPrefixes) != 0 {
+		check.AddressPrefix = properties.AddressPrefixes[0]
+	}
+	if _, prefix, err := net.ParseCIDR(check.AddressPrefix); err != nil {
+		check.Errors = append(check.Errors, fmt.Sprintf("the subnet has no valid address prefix '%s'",
+			check.AddressPrefix))
+	} else if ones, _ := prefix.Mask.Size(); ones > 29 {
+		check.Errors = append(check.Errors, fmt.Sprintf("the subnet %s is too small, the managed domain needs "+
+			"at least a /29", check.AddressPrefix))
+	} else if ones > 24 {
+		check.Warnings = append(check.Warnings, fmt.Sprintf("the subnet %s is smaller than the /24 Microsoft "+
+			"recommends for a managed domain", check.AddressPrefix))
+	}
+
+	// the network interfaces of the managed domain itself are expected when it is deployed already
+	if len(properties.IpConfigurations) != 0 {
+		domainService, err := a.GetDomainService()
+		if err != nil || !domainService.UsesSubnet(check.SubnetID) {
+			check.Errors = append(check.Errors, fmt.Sprintf("the subnet has %d devices connected, the managed "+
+				"domain needs a dedicated empty subnet", len(properties.IpConfigurations)))
+		}
+	}
+	for _, delegation := range properties.Delegations {
+		check.Errors = append(check.Errors, fmt.Sprintf("the subnet is delegated to %s",
+			delegation.Properties.ServiceName))
+	}
+
+	if properties.NetworkSecurityGroup == nil {
+		if check.MissingRules, err = RequiredSecurityRules(); err != nil {
+			return nil, err
+		}
+		if mode == NsgModeAttach {
+			check.Warnings = append(check.Warnings, fmt.Sprintf("the subnet has no NSG, %s will be created "+
+				"and attached", NetworkSecurityGroupName()))
+		} else {
+			check.Errors = append(check.Errors, "the subnet has no NSG, the managed domain needs one which "+
+				"allows its traffic, set EXISTING_NSG_MODE to attach to create it")
+		}
+		return check, nil
+	}
+	check.NetworkSecurityGroupID = properties.NetworkSecurityGroup.ID
+	rules, err := securityRules(client, check.NetworkSecurityGroupID)
+	if err != nil {
+		return nil, err
+	}
+	if check.MissingRules, err = MissingSecurityRules(rules); err != nil {
+		return nil, err
+	}
+	for _, rule := range check.MissingRules {
+		message := fmt.Sprintf("the NSG does not allow TCP %s from %s (%s)", rule.Properties.DestinationPortRange,
+			strings.Join(rule.sources(), ", "), rule.Name)
+		if mode == NsgModeAttach {
+			check.Warnings = append(check.Warnings, message+", the rule will be added")
+		} else {
+			check.Errors = append(check.Errors, message)
+		}
+	}
+	return check, nil
+}
+
+// the security rules of an NSG
+func securityRules(client *arm.Client, id string) ([]SecurityRule, error) {
+	nsg, err := client.GetResource(id, NetworkApiVersion)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed in reading the NSG of the subnet")
+	}
+	var properties struct {
+		SecurityRules []SecurityRule `json:"securityRules"`
+	}
+	if err := json.Unmarshal(nsg.Properties, &properties); err != nil {
+		return nil, errors.Wrap(err, "failed in decoding the NSG properties")
+	}
+	return properties.SecurityRules, nil
+}
+
+// add the missing rules of a check to the NSG of the subnet, a subnet without NSG gets a new one with
+// all the required rules
+func (a *AzureCLI) AttachSecurityRules(check *SubnetCheck) error {
+	if len(check.MissingRules) == 0 {
+		return nil
+	}
+	client, err := a.ArmClient()
+	if err != nil {
+		return err
+	}
+	if check.NetworkSecurityGroupID == "" {
+		nsgID := client.ResourceID(VnetResourceGroup(), NetworkSecurityGroupType, NetworkSecurityGroupName())
+		properties, err := json.Marshal(map[string]interface{}{"securityRules": check.MissingRules})
+		if err != nil {
+			return err
+		}
+		nsg := &arm.Resource{Location: check.Location, Properties: properties}
+		if err := client.PutResource(nsgID, NetworkApiVersion, nsg); err != nil {
+			return errors.Wrap(err, "failed in creating the NSG "+NetworkSecurityGroupName())
+		}
+		err = updateResource(client, check.SubnetID, func(properties map[string]interface{}) error {
+			properties["networkSecurityGroup"] = map[string]interface{}{"id": nsgID}
+			return nil
+		})
+		if err != nil {
+			return errors.Wrap(err, "failed in attaching the NSG to the subnet")
+		}
+		check.NetworkSecurityGroupID = nsgID
+		return nil
+	}
+	err = updateResource(client, check.NetworkSecurityGroupID, func(properties map[string]interface{}) error {
+		// the existing rules are kept as they are, only the decoded copy is used for the names and priorities
+		raw, _ := properties["securityRules"].([]interface{})
+		b, err := json.Marshal(raw)
+		if err != nil {
+			return err
+		}
+		var existing []SecurityRule
+		if err := json.Unmarshal(b, &existing); err != nil {
+			return err
+		}
+		for _, rule := range placeSecurityRules(existing, check.MissingRules) {
+			raw = append(raw, rule)
+		}
+		properties["securityRules"] = raw
+		return nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed in adding the rules to the NSG of the subnet")
+	}
+	return nil
+}
+
+// read a resource, change its properties and write it back
+func updateResource(client *arm.Client, id string, update func(properties map[string]interface{}) error) error {
+	resource, err := client.GetResource(id, NetworkApiVersion)
+	if err != nil {
+		return err
+	}
+	properties := make(map[string]interface{})
+	if err := json.Unmarshal(resource.Properties, &properties); err != nil {
+		return err
+	}
+	if err := update(properties); err != nil {
+		return err
+	}
+	delete(properties, "provisioningState")
+	if resource.Properties, err = json.Marshal(properties); err != nil {
+		return err
+	}
+	return client.PutResource(id, NetworkApiVersion, resource)
+}
@@ -2,34 +2,66 @@ package lib
 
 import (
 	"github.com/spf13/viper"
-	"io/ioutil"
 	"strings"
 )
 
-func GenerateParameters() (string, error) {
-	fileName := ""
-	tempFile, err := ioutil.TempFile(viper.GetString("PARAMETERS_PATH"), "parameters_*.json")
-	if err != nil {
-		return fileName, err
-	} else {
-		fileName = tempFile.Name()
-	}
-	p := Parameters{
+// build the parameters of the deployment template from the config
+func GenerateParameters() (*Parameters, error) {
+	p := &Parameters{
 		Schema:         "https://schema.management.azure.com/schemas/2015-01-01/deploymentParameters.json#",
 		ContentVersion: "1.0.0.0",
-		Parameters:     make(map[string]map[string]string),
+		Parameters:     make(map[string]map[string]interface{}),
 	}
 	p.AddParameter("domainName", strings.TrimSpace(viper.GetString("DOMAIN_NAME")))
 	p.AddParameter("location", strings.TrimSpace(viper.GetString("LOCATION")))
+	p.AddParameter("createNetwork", !ExistingVnet())
+	p.AddParameter("vnetResourceGroup", VnetResourceGroup())
 	p.AddParameter("domainServicesVnetName", strings.TrimSpace(viper.GetString("DOMAIN_SERVICES_VNET_NAME")))
 	p.AddParameter("domainServicesVnetAddressPrefix", strings.TrimSpace(viper.GetString("DOMAIN_SERVICES_VNET_ADDRESS_PREFIX")))
 	p.AddParameter("domainServicesSubnetName", strings.TrimSpace(viper.GetString("DOMAIN_SERVICES_SUBNET_NAME")))
 	p.AddParameter("domainServicesSubnetAddressPrefix", strings.TrimSpace(viper.GetString("DOMAIN_SERVICES_SUBNET_ADDRESS_PREFIX")))
-	p.AddParameter("smcIpAddress", strings.TrimSpace(viper.GetString("NGINX_PUBLIC_IP_ADDRESS")))
 	p.AddParameter("pfxBase64", strings.TrimSpace(viper.GetString("PFX_CERTIFICATE_BASE64")))
 	p.AddParameter("pfxPassword", strings.TrimSpace(viper.GetString("PFX_CERTIFICATE_PASSWORD")))
-	if err := p.ToJson(fileName); err != nil {
-		return fileName, err
+	domainSettings, err := ConfiguredDomainSettings()
+	if err != nil {
+		return nil, err
+	}
+	p.AddParameter("sku", domainSettings.Sku)
+	p.AddParameter("filteredSync", domainSettings.FilteredSync)
+	p.AddParameter("domainSecuritySettings", domainSettings.DomainSecuritySettings)
+	p.AddParameter("notificationSettings", domainSettings.NotificationSettings)
+	securityRules, err := RequiredSecurityRules()
+	if err != nil {
+		return nil, err
+	}
+	p.AddParameter("securityRules", securityRules)
+	dnsServers, err := DNSServers()
+	if err != nil {
+		return nil, err
+	}
+	p.AddParameter("dnsServers", dnsServers)
+	return p, nil
+}
+
+// template parameters which are never printed
+var secretParameters = map[string]bool{
+	"pfxBase64":   true,
+	"pfxPassword": true,
+}
+
+// a copy of the parameters with all secret values masked
+func MaskedParameters(p *Parameters) *Parameters {
+	masked := &Parameters{
+		Schema:         p.Schema,
+		ContentVersion: p.ContentVersion,
+		Parameters:     make(map[string]map[string]interface{}),
+	}
+	for name, parameter := range p.Parameters {
+		if secretParameters[name] && parameter["value"] != nil && parameter["value"] != "" {
+			masked.AddParameter(name, "****")
+			continue
+		}
+		masked.Parameters[name] = parameter
 	}
-	return fileName, nil
+	return masked
 }
@@ -1,111 +1,548 @@
 package lib
 
 import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"github.cicd.cloud.fpdev.io/BD/bd-azure-smc-deployment/lib/pkcs12"
 	"io/ioutil"
+	"math/big"
+	"net"
 	"os"
-	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
 )
 
+const (
+	KeyTypeRSA2048   = "rsa2048"
+	KeyTypeRSA3072   = "rsa3072"
+	KeyTypeRSA4096   = "rsa4096"
+	KeyTypeECDSAP256 = "ecdsa-p256"
+	KeyTypeECDSAP384 = "ecdsa-p384"
+	DefaultKeyType   = KeyTypeRSA4096
+
+	// a self-signed certificate, nothing trusts it until it is imported
+	CertModeSelfSigned = "self-signed"
+	// a certificate signed by the CA of CA_CERT_FILE and CA_KEY_FILE
+	CertModeCA = "ca"
+	// a certificate request signed outside of the tool, the signed certificate is imported afterwards
+	CertModeCSR = "csr"
+
+	// the base64 PFX printed to stdout
+	CertFormatBase64 = "base64"
+	// cert.pfx in the output directory
+	CertFormatPFX = "pfx"
+	// private.pem, public.pem and ca.pem in the output directory
+	CertFormatPEM = "pem"
+	// PFX_CERTIFICATE_BASE64 of the config file
+	CertFormatConfig = "config"
+)
+
+// the key types of the generated keys
+var keyTypes = []string{KeyTypeRSA2048, KeyTypeRSA3072, KeyTypeRSA4096, KeyTypeECDSAP256, KeyTypeECDSAP384}
+
+// the subject fields besides the common name, as in openssl
+var subjectFields = map[string]func(name *pkix.Name) *[]string{
+	"C":  func(name *pkix.Name) *[]string { return &name.Country },
+	"ST": func(name *pkix.Name) *[]string { return &name.Province },
+	"L":  func(name *pkix.Name) *[]string { return &name.Locality },
+	"O":  func(name *pkix.Name) *[]string { return &name.Organization },
+	"OU": func(name *pkix.Name) *[]string { return &name.OrganizationalUnit },
+}
+
+// SSLCertGenerator creates the wildcard certificate of the managed domain in memory, it is self-signed
+// unless a CA is set
 type SSLCertGenerator struct {
-	Days         int
-	Domain       string
-	Password     string
-	TmpDirectory string
-	PrivateKey   string
-	PublicKey    string
-	PFX          string
-	Base64       string
-}
-
-// create a temporary file
-func (s *SSLCertGenerator) CreateTempFile() error {
-	name, err := ioutil.TempDir("/tmp", "azure_smc_")
+	Days     int
+	Domain   string
+	Password string
+	// one of the KeyType constants, DefaultKeyType when empty
+	KeyType string
+	// the subject of the certificate, its common name is always *.Domain
+	Subject pkix.Name
+	// the DNS names and ip addresses the certificate is issued for besides *.Domain
+	SANs []string
+
+	// the CA which signs the certificate and the certificates up to its root, the CA first
+	CACertificates []*x509.Certificate
+	CAKey          crypto.Signer
+
+	PrivateKey  crypto.Signer
+	Certificate *x509.Certificate
+	// the certificates from the issuer of Certificate up to the root, they go into the PFX
+	Chain []*x509.Certificate
+	CSR   []byte
+	PFX   []byte
+}
+
+// the certificate mode of CERT_MODE
+func CertMode(mode string) (string, error) {
+	mode = strings.ToLower(strings.TrimSpace(mode))
+	switch mode {
+	case CertModeSelfSigned, CertModeCA, CertModeCSR:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unknown CERT_MODE '%s', expected one of: %s", mode,
+		strings.Join([]string{CertModeSelfSigned, CertModeCA, CertModeCSR}, ", "))
+}
+
+// the key type of CERT_KEY_TYPE
+func KeyType(keyType string) (string, error) {
+	keyType = strings.ToLower(strings.TrimSpace(keyType))
+	for _, known := range keyTypes {
+		if keyType == known {
+			return keyType, nil
+		}
+	}
+	return "", fmt.Errorf("unknown CERT_KEY_TYPE '%s', expected one of: %s", keyType, strings.Join(keyTypes, ", "))
+}
+
+// the subject of CERT_SUBJECT, fields such as O=Forcepoint,OU=IT,C=US. The common name is set by the
+// generator so it cannot be given
+func ParseSubject(subject string) (pkix.Name, error) {
+	name := pkix.Name{}
+	for _, field := range strings.Split(subject, ",") {
+		if strings.TrimSpace(field) == "" {
+			continue
+		}
+		parts := strings.SplitN(field, "=", 2)
+		key := strings.ToUpper(strings.TrimSpace(parts[0]))
+		values, known := subjectFields[key]
+		if len(parts) != 2 || !known {
+			return name, fmt.Errorf("the subject field '%s' is not one of C, ST, L, O or OU followed by = and a value",
+				strings.TrimSpace(field))
+		}
+		value := strings.TrimSpace(parts[1])
+		if key == "C" && len(value) != 2 {
+			return name, fmt.Errorf("the country '%s' of the subject is not a two letter code", value)
+		}
+		*values(&name) = append(*values(&name), value)
+	}
+	return name, nil
+}
+
+// generate the key, the certificate and the PFX bundle
+func (s *SSLCertGenerator) Generate() error {
+	if err := s.validate(); err != nil {
+		return err
+	}
+	if err := s.GeneratePrivateKey(); err != nil {
+		return err
+	}
+	if err := s.GenerateCertificate(); err != nil {
+		return err
+	}
+	return s.GeneratePFX()
+}
+
+func (s *SSLCertGenerator) validate() error {
+	if s.Domain == "" {
+		return errors.New("the domain of the certificate is empty")
+	}
+	if s.Days <= 0 {
+		return errors.New("the certificate must be valid for at least one day")
+	}
+	_, _, err := s.alternativeNames()
+	return err
+}
+
+func (s *SSLCertGenerator) commonName() string {
+	return "*." + s.Domain
+}
+
+// the subject with the common name of the domain
+func (s *SSLCertGenerator) subject() pkix.Name {
+	subject := s.Subject
+	subject.CommonName = s.commonName()
+	return subject
+}
+
+// the SANs of the certificate, *.Domain first and the SANs split into DNS names and ip addresses
+func (s *SSLCertGenerator) alternativeNames() ([]string, []net.IP, error) {
+	dnsNames := []string{s.commonName()}
+	var ips []net.IP
+	for _, san := range s.SANs {
+		san = strings.TrimSpace(san)
+		if ip := net.ParseIP(san); ip != nil {
+			ips = append(ips, ip)
+			continue
+		}
+		if san == "" || strings.ContainsAny(san, " /:@") {
+			return nil, nil, fmt.Errorf("the SAN '%s' is not a DNS name or an ip address", san)
+		}
+		if !containsFold(dnsNames, san) {
+			dnsNames = append(dnsNames, san)
+		}
+	}
+	return dnsNames, ips, nil
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// generate the private key of the KeyType
+func (s *SSLCertGenerator) GeneratePrivateKey() error {
+	keyType := s.KeyType
+	if keyType == "" {
+		keyType = DefaultKeyType
+	}
+	var key crypto.Signer
+	var err error
+	switch keyType {
+	case KeyTypeRSA2048:
+		key, err = rsa.GenerateKey(rand.Reader, 2048)
+	case KeyTypeRSA3072:
+		key, err = rsa.GenerateKey(rand.Reader, 3072)
+	case KeyTypeRSA4096:
+		key, err = rsa.GenerateKey(rand.Reader, 4096)
+	case KeyTypeECDSAP256:
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case KeyTypeECDSAP384:
+		key, err = ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	default:
+		_, err = KeyType(keyType)
+	}
 	if err != nil {
 		return err
 	}
-	s.TmpDirectory = name
+	s.PrivateKey = key
 	return nil
 }
 
-// remove all temporary files
-func (s *SSLCertGenerator) CleanUp() error {
-	if err := os.RemoveAll(s.TmpDirectory); err != nil {
+// generate the certificate for *.Domain and the SANs, it is valid for server and client authentication.
+// It is signed by the CA when there is one
+func (s *SSLCertGenerator) GenerateCertificate() error {
+	dnsNames, ips, err := s.alternativeNames()
+	if err != nil {
 		return err
 	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+	publicKey, err := x509.MarshalPKIXPublicKey(s.PrivateKey.Public())
+	if err != nil {
+		return err
+	}
+	keyID := sha1.Sum(publicKey)
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               s.subject(),
+		DNSNames:              dnsNames,
+		IPAddresses:           ips,
+		NotBefore:             now,
+		NotAfter:              now.AddDate(0, 0, s.Days),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		SubjectKeyId:          keyID[:],
+	}
+	// an ECDSA key cannot encipher keys
+	if _, ok := s.PrivateKey.Public().(*rsa.PublicKey); ok {
+		template.KeyUsage |= x509.KeyUsageKeyEncipherment
+	}
+	parent, signer := template, s.PrivateKey
+	if len(s.CACertificates) != 0 {
+		parent, signer = s.CACertificates[0], s.CAKey
+		// a certificate cannot outlive its CA
+		if template.NotAfter.After(parent.NotAfter) {
+			template.NotAfter = parent.NotAfter
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, s.PrivateKey.Public(), signer)
+	if err != nil {
+		return err
+	}
+	if s.Certificate, err = x509.ParseCertificate(der); err != nil {
+		return err
+	}
+	s.Chain = s.CACertificates
 	return nil
 }
 
-// generate private key using openssl
-func (s *SSLCertGenerator) GeneratePrivateKey() error {
-	tempFile, err := ioutil.TempFile(s.TmpDirectory, "private_*.pem")
+// generate the private key and a certificate request for *.Domain and the SANs
+func (s *SSLCertGenerator) GenerateCSR() error {
+	if s.Domain == "" {
+		return errors.New("the domain of the certificate is empty")
+	}
+	dnsNames, ips, err := s.alternativeNames()
 	if err != nil {
 		return err
 	}
-	s.PrivateKey = tempFile.Name()
-	cmd := exec.Command("sh", "-c", fmt.Sprintf("openssl genrsa 4096 > %s", s.PrivateKey))
-	err = cmd.Run()
+	if err := s.GeneratePrivateKey(); err != nil {
+		return err
+	}
+	template := &x509.CertificateRequest{Subject: s.subject(), DNSNames: dnsNames, IPAddresses: ips}
+	der, err := x509.CreateCertificateRequest(rand.Reader, template, s.PrivateKey)
 	if err != nil {
 		return err
 	}
+	s.CSR = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der})
 	return nil
 }
 
-//generate a public key using openssl
-func (s *SSLCertGenerator) GeneratePublicKey() error {
-
-	tempFile, err := ioutil.TempFile(s.TmpDirectory, "public_*.pem")
+// use a certificate signed from the CSR, the PEM holds the certificate followed by its chain. The
+// certificate must belong to the private key and chain up to the last certificate of the chain
+func (s *SSLCertGenerator) ImportCertificate(certificatePEM []byte) error {
+	certificates, err := ParseCertificates(certificatePEM)
 	if err != nil {
 		return err
 	}
-	s.PublicKey = tempFile.Name()
-	c := fmt.Sprintf("openssl req -x509 -days %d -new -key %s -out %s -addext extendedKeyUsage=serverAuth,clientAuth -subj \"/CN=*.%s\"",
-		s.Days, s.PrivateKey, s.PublicKey, s.Domain)
-	cmd := exec.Command("sh", "-c", c)
-	err = cmd.Run()
-	if err != nil {
+	if s.PrivateKey == nil {
+		return errors.New("the private key of the certificate request is missing")
+	}
+	certificate := certificates[0]
+	if !samePublicKey(certificate.PublicKey, s.PrivateKey.Public()) {
+		return errors.New("the certificate does not belong to the private key")
+	}
+	if certificate.Subject.CommonName != s.commonName() && certificate.VerifyHostname("ldaps."+s.Domain) != nil {
+		return fmt.Errorf("the certificate is not issued for %s", s.commonName())
+	}
+	chain := certificates[1:]
+	for _, caCertificate := range s.CACertificates {
+		if !containsCertificate(chain, caCertificate) {
+			chain = append(chain, caCertificate)
+		}
+	}
+	if err := verifyChain(certificate, chain); err != nil {
 		return err
 	}
+	s.Certificate = certificate
+	s.Chain = chain
 	return nil
+}
+
+// check the certificate chains up to the last certificate of the chain
+func verifyChain(certificate *x509.Certificate, chain []*x509.Certificate) error {
+	if len(chain) == 0 {
+		return nil
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(chain[len(chain)-1])
+	intermediates := x509.NewCertPool()
+	for _, intermediate := range chain[:len(chain)-1] {
+		intermediates.AddCert(intermediate)
+	}
+	_, err := certificate.Verify(x509.VerifyOptions{Roots: roots, Intermediates: intermediates,
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny}})
+	if err != nil {
+		return fmt.Errorf("the certificate does not chain up to %s: %v", chain[len(chain)-1].Subject, err)
+	}
+	return nil
+}
 
+func samePublicKey(a crypto.PublicKey, b crypto.PublicKey) bool {
+	key, ok := a.(interface{ Equal(crypto.PublicKey) bool })
+	return ok && key.Equal(b)
 }
 
-// generate PFX certificate
+func containsCertificate(certificates []*x509.Certificate, certificate *x509.Certificate) bool {
+	for _, c := range certificates {
+		if c.Equal(certificate) {
+			return true
+		}
+	}
+	return false
+}
+
+// bundle the key, the certificate and its chain as a PFX protected by the password
 func (s *SSLCertGenerator) GeneratePFX() error {
-	tempFile, err := ioutil.TempFile(s.TmpDirectory, "cert_*.pfx")
+	pfx, err := pkcs12.Encode(rand.Reader, s.PrivateKey, s.Certificate, s.Chain, s.Password, "")
 	if err != nil {
 		return err
 	}
-	s.PFX = tempFile.Name()
-	c := fmt.Sprintf("openssl pkcs12 -export -in %s -inkey %s -out %s -password pass:%s",
-		s.PublicKey, s.PrivateKey, s.PFX, s.Password)
-	cmd := exec.Command("sh", "-c", c)
-	err = cmd.Run()
-	if err != nil {
+	s.PFX = pfx
+	return nil
+}
+
+// the PFX as a base64 string, the format of PFX_CERTIFICATE_BASE64
+func (s *SSLCertGenerator) Base64() string {
+	return base64.StdEncoding.EncodeToString(s.PFX)
+}
+
+// the certificate LDAP clients such as SMC must trust, the root of the chain or the self-signed certificate
+func (s *SSLCertGenerator) TrustedCertificate() *x509.Certificate {
+	if len(s.Chain) != 0 {
+		return s.Chain[len(s.Chain)-1]
+	}
+	return s.Certificate
+}
+
+// write what was generated into a directory, only the owner can read the files. private.pem is the
+// key, public.pem the certificate, ca.pem the certificate to trust, request.csr the certificate
+// request and cert.pfx the bundle
+func (s *SSLCertGenerator) WriteFiles(directory string) error {
+	return s.writeFiles(directory, "private.pem", "public.pem", "ca.pem", "request.csr", "cert.pfx")
+}
+
+// write cert.pfx into a directory
+func (s *SSLCertGenerator) WritePFX(directory string) error {
+	if s.PFX == nil {
+		return errors.New("there is no PFX to write")
+	}
+	return s.writeFiles(directory, "cert.pfx")
+}
+
+// write the PEM key and certificate pair into a directory, private.pem, public.pem and ca.pem
+func (s *SSLCertGenerator) WritePEM(directory string) error {
+	if s.PrivateKey == nil || s.Certificate == nil {
+		return errors.New("there is no key and certificate to write")
+	}
+	return s.writeFiles(directory, "private.pem", "public.pem", "ca.pem")
+}
+
+// write the named files which were generated
+func (s *SSLCertGenerator) writeFiles(directory string, names ...string) error {
+	if err := os.MkdirAll(directory, 0700); err != nil {
 		return err
 	}
+	files := make(map[string][]byte)
+	if s.PrivateKey != nil {
+		key, err := x509.MarshalPKCS8PrivateKey(s.PrivateKey)
+		if err != nil {
+			return err
+		}
+		files["private.pem"] = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key})
+	}
+	if s.Certificate != nil {
+		files["public.pem"] = EncodeCertificates(append([]*x509.Certificate{s.Certificate}, s.Chain...))
+		files["ca.pem"] = EncodeCertificates([]*x509.Certificate{s.TrustedCertificate()})
+	}
+	if s.CSR != nil {
+		files["request.csr"] = s.CSR
+	}
+	if s.PFX != nil {
+		files["cert.pfx"] = s.PFX
+	}
+	for _, name := range names {
+		content, ok := files[name]
+		if !ok {
+			continue
+		}
+		if err := ioutil.WriteFile(filepath.Join(directory, name), content, 0600); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-// convert PFX certificate to BASE64 sting
-func (s *SSLCertGenerator) ConvertToBase64() error {
-	tempFile, err := ioutil.TempFile(s.TmpDirectory, "base64_*.txt")
+// the certificates of a PEM file in their order
+func ParseCertificates(data []byte) ([]*x509.Certificate, error) {
+	var certificates []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		certificate, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certificates = append(certificates, certificate)
+	}
+	if len(certificates) == 0 {
+		return nil, errors.New("no certificate found in the PEM data")
+	}
+	return certificates, nil
+}
+
+func EncodeCertificates(certificates []*x509.Certificate) []byte {
+	var b bytes.Buffer
+	for _, certificate := range certificates {
+		_ = pem.Encode(&b, &pem.Block{Type: "CERTIFICATE", Bytes: certificate.Raw})
+	}
+	return b.Bytes()
+}
+
+// the first private key of a PEM file, PKCS#1, PKCS#8 and SEC 1 keys are read. Encrypted keys are not
+func ParsePrivateKey(data []byte) (crypto.Signer, error) {
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return nil, errors.New("no private key found in the PEM data")
+		}
+		if _, encrypted := block.Headers["Proc-Type"]; encrypted || block.Type == "ENCRYPTED PRIVATE KEY" {
+			return nil, errors.New("the private key is encrypted, decrypt it first")
+		}
+		switch block.Type {
+		case "RSA PRIVATE KEY":
+			return x509.ParsePKCS1PrivateKey(block.Bytes)
+		case "EC PRIVATE KEY":
+			return x509.ParseECPrivateKey(block.Bytes)
+		case "PRIVATE KEY":
+			key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			switch key := key.(type) {
+			case *rsa.PrivateKey:
+				return key, nil
+			case *ecdsa.PrivateKey:
+				return key, nil
+			case ed25519.PrivateKey:
+				return key, nil
+			}
+			return nil, fmt.Errorf("unsupported private key type %T", key)
+		}
+	}
+}
+
+// read the CA of CA_CERT_FILE and CA_KEY_FILE, the certificate file may hold the chain of the CA after it
+func ReadCA(certificateFile string, keyFile string) ([]*x509.Certificate, crypto.Signer, error) {
+	certificates, err := ReadCertificates(certificateFile)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
-	s.Base64 = tempFile.Name()
-	c := fmt.Sprintf("openssl base64 -in %s -out %s", s.PFX, s.Base64)
-	cmd := exec.Command("sh", "-c", c)
-	err = cmd.Run()
+	keyPEM, err := ioutil.ReadFile(keyFile)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
-	return nil
+	key, err := ParsePrivateKey(keyPEM)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed in reading the CA key %s: %v", keyFile, err)
+	}
+	if !samePublicKey(certificates[0].PublicKey, key.Public()) {
+		return nil, nil, errors.New("the CA key does not belong to the first certificate of " + certificateFile)
+	}
+	if !certificates[0].IsCA {
+		return nil, nil, errors.New("the certificate of " + certificateFile + " is not a CA")
+	}
+	return certificates, key, nil
 }
 
-func (s *SSLCertGenerator) OutputBase64() ([]byte, error) {
-	c := fmt.Sprintf("cat %s | tr -d \"\n\"", s.Base64)
-	cmd := exec.Command("sh", "-c", c)
-	output, err := cmd.CombinedOutput()
-	return output, err
+// the certificates of a PEM file
+func ReadCertificates(file string) ([]*x509.Certificate, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	certificates, err := ParseCertificates(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed in reading %s: %v", file, err)
+	}
+	return certificates, nil
 }
@@ -0,0 +1,155 @@
+package graph
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+type WebApplication struct {
+	HomePageURL  string   `json:"homePageUrl,omitempty"`
+	RedirectURIs []string `json:"redirectUris,omitempty"`
+}
+
+type Application struct {
+	ID             string          `json:"id,omitempty"`
+	AppID          string          `json:"appId,omitempty"`
+	DisplayName    string          `json:"displayName,omitempty"`
+	SignInAudience string          `json:"signInAudience,omitempty"`
+	Web            *WebApplication `json:"web,omitempty"`
+}
+
+type ServicePrincipal struct {
+	ID                    string   `json:"id,omitempty"`
+	AppID                 string   `json:"appId,omitempty"`
+	DisplayName           string   `json:"displayName,omitempty"`
+	ServicePrincipalNames []string `json:"servicePrincipalNames,omitempty"`
+	Tags                  []string `json:"tags,omitempty"`
+}
+
+// list the applications with the given display name
+func (c *Client) FindApplications(displayName string) ([]Application, error) {
+	var applications []Application
+	err := c.list(versionV1+"/applications"+displayNameFilter(displayName), func(value json.RawMessage) error {
+		var page []Application
+		if err := json.Unmarshal(value, &page); err != nil {
+			return err
+		}
+		applications = append(applications, page...)
+		return nil
+	})
+	return applications, err
+}
+
+// find the single application with the given display name
+func (c *Client) FindApplication(displayName string) (*Application, error) {
+	applications, err := c.FindApplications(displayName)
+	if err != nil {
+		return nil, err
+	}
+	if len(applications) == 0 {
+		return nil, fmt.Errorf("no application found with the name '%s'", displayName)
+	}
+	if len(applications) > 1 {
+		return nil, fmt.Errorf("%d applications found with the name '%s'", len(applications), displayName)
+	}
+	return &applications[0], nil
+}
+
+// read an application by object id
+func (c *Client) GetApplication(id string) (*Application, error) {
+	application := &Application{}
+	if err := c.do(http.MethodGet, versionV1+"/applications/"+url.PathEscape(id), nil, application); err != nil {
+		return nil, err
+	}
+	return application, nil
+}
+
+func (c *Client) CreateApplication(application *Application) (*Application, error) {
+	created := &Application{}
+	if err := c.do(http.MethodPost, versionV1+"/applications", application, created); err != nil {
+		return nil, err
+	}
+	return created, nil
+}
+
+func (c *Client) UpdateApplication(id string, update *Application) error {
+	return c.do(http.MethodPatch, versionV1+"/applications/"+id, update, nil)
+}
+
+func (c *Client) DeleteApplication(id string) error {
+	return c.do(http.MethodDelete, versionV1+"/applications/"+id, nil, nil)
+}
+
+// list the service principals with the given display name
+func (c *Client) FindServicePrincipals(displayName string) ([]ServicePrincipal, error) {
+	var servicePrincipals []ServicePrincipal
+	err := c.list(versionV1+"/servicePrincipals"+displayNameFilter(displayName), func(value json.RawMessage) error {
+		var page []ServicePrincipal
+		if err := json.Unmarshal(value, &page); err != nil {
+			return err
+		}
+		servicePrincipals = append(servicePrincipals, page...)
+		return nil
+	})
+	return servicePrincipals, err
+}
+
+// find the single service principal with the given display name
+func (c *Client) FindServicePrincipal(displayName string) (*ServicePrincipal, error) {
+	servicePrincipals, err := c.FindServicePrincipals(displayName)
+	if err != nil {
+		return nil, err
+	}
+	if len(servicePrincipals) == 0 {
+		return nil, fmt.Errorf("no service principal found with the name '%s'", displayName)
+	}
+	if len(servicePrincipals) > 1 {
+		return nil, fmt.Errorf("%d service principals found with the name '%s'", len(servicePrincipals), displayName)
+	}
+	return &servicePrincipals[0], nil
+}
+
+// read a service principal by object id
+func (c *Client) GetServicePrincipal(id string) (*ServicePrincipal, error) {
+	servicePrincipal := &ServicePrincipal{}
+	if err := c.do(http.MethodGet, versionV1+"/servicePrincipals/"+url.PathEscape(id), nil,
+		servicePrincipal); err != nil {
+		return nil, err
+	}
+	return servicePrincipal, nil
+}
+
+// create the service principal of an application
+func (c *Client) CreateServicePrincipal(appId string) (*ServicePrincipal, error) {
+	created := &ServicePrincipal{}
+	if err := c.do(http.MethodPost, versionV1+"/servicePrincipals", &ServicePrincipal{AppID: appId},
+		created); err != nil {
+		return nil, err
+	}
+	return created, nil
+}
+
+func (c *Client) UpdateServicePrincipal(id string, update *ServicePrincipal) error {
+	return c.do(http.MethodPatch, versionV1+"/servicePrincipals/"+id, update, nil)
+}
+
+func (c *Client) DeleteServicePrincipal(id string) error {
+	return c.do(http.MethodDelete, versionV1+"/servicePrincipals/"+id, nil, nil)
+}
+
+// add a tag to a service principal, existing tags are kept
+func (c *Client) AddServicePrincipalTag(servicePrincipal *ServicePrincipal, tag string) error {
+	for _, existing := range servicePrincipal.Tags {
+		if existing == tag {
+			return nil
+		}
+	}
+	tags := append(append([]string{}, servicePrincipal.Tags...), tag)
+	if err := c.UpdateServicePrincipal(servicePrincipal.ID, &ServicePrincipal{Tags: tags}); err != nil {
+		return err
+	}
+	servicePrincipal.Tags = tags
+	return nil
+}
@@ -0,0 +1,200 @@
+// Package graph is a small typed client for the Microsoft Graph API covering applications,
+// service principals, groups, users and the synchronization (SCIM provisioning) endpoints.
+package graph
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultBaseURL = "https://graph.microsoft.com"
+
+	versionV1   = "/v1.0"
+	versionBeta = "/beta"
+
+	// how many times a throttled request is retried
+	maxRetries = 5
+)
+
+type Client struct {
+	// BaseURL can point to a local fake of the Graph API
+	BaseURL string
+	// Token returns a valid bearer token for Graph
+	Token      func() (string, error)
+	HTTPClient *http.Client
+}
+
+func NewClient(baseURL string, token func() (string, error)) *Client {
+	if baseURL == "" {
+		baseURL = DefaultBaseURL
+	}
+	return &Client{
+		BaseURL:    strings.TrimRight(baseURL, "/"),
+		Token:      token,
+		HTTPClient: &http.Client{Timeout: 60 * time.Second},
+	}
+}
+
+// Error is the error body returned by Graph
+type Error struct {
+	StatusCode int    `json:"-"`
+	Code       string `json:"code"`
+	Message    string `json:"message"`
+	InnerError struct {
+		RequestID string `json:"request-id"`
+		Date      string `json:"date"`
+	} `json:"innerError"`
+}
+
+func (e *Error) Error() string {
+	message := fmt.Sprintf("graph returned http status %d", e.StatusCode)
+	if e.Code != "" {
+		message = fmt.Sprintf("%s: %s: %s", message, e.Code, e.Message)
+	} else if e.Message != "" {
+		message = fmt.Sprintf("%s: %s", message, e.Message)
+	}
+	if e.InnerError.RequestID != "" {
+		message = fmt.Sprintf("%s (request-id: %s)", message, e.InnerError.RequestID)
+	}
+	return message
+}
+
+// check if an error is a Graph error with the given http status
+func IsStatus(err error, status int) bool {
+	graphErr, ok := err.(*Error)
+	return ok && graphErr.StatusCode == status
+}
+
+// an OData filter matching the displayName exactly
+func displayNameFilter(displayName string) string {
+	return "?$filter=" + url.QueryEscape(fmt.Sprintf("displayName eq '%s'", strings.ReplaceAll(displayName, "'", "''")))
+}
+
+// send a request to Graph and decode the JSON response into out when it is not nil. Throttled
+// requests were not processed so they are always retried after the delay Graph asks for, an
+// unavailable service is only retried when a retry cannot create the object twice
+func (c *Client) do(method string, path string, in interface{}, out interface{}) error {
+	requestUrl := path
+	if !strings.HasPrefix(path, "http") {
+		requestUrl = c.BaseURL + path
+	}
+	var body []byte
+	if in != nil {
+		if raw, ok := in.([]byte); ok {
+			body = raw
+		} else {
+			b, err := json.Marshal(in)
+			if err != nil {
+				return err
+			}
+			body = b
+		}
+	}
+	for attempt := 0; ; attempt++ {
+		statusCode, header, b, err := c.send(method, requestUrl, body)
+		if err != nil {
+			return err
+		}
+		if (statusCode == http.StatusTooManyRequests ||
+			statusCode == http.StatusServiceUnavailable && idempotent(method)) && attempt < maxRetries {
+			time.Sleep(retryAfter(header, attempt))
+			continue
+		}
+		if statusCode >= http.StatusBadRequest {
+			return decodeError(statusCode, b)
+		}
+		if out != nil && len(b) != 0 {
+			if err := json.Unmarshal(b, out); err != nil {
+				return fmt.Errorf("failed in decoding the response of %s %s: %s", method, path, err)
+			}
+		}
+		return nil
+	}
+}
+
+func (c *Client) send(method string, requestUrl string, body []byte) (int, http.Header, []byte, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewBuffer(body)
+	}
+	req, err := http.NewRequest(method, requestUrl, reader)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	token, err := c.Token()
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	return resp.StatusCode, resp.Header, b, nil
+}
+
+// whether sending a request twice has the effect of sending it once, a PATCH of Graph only sets
+// properties so it can be repeated while a POST creates a new object every time
+func idempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// the delay before retrying a throttled request, Retry-After when Graph sends it
+// or an exponential back-off
+func retryAfter(header http.Header, attempt int) time.Duration {
+	if seconds, err := strconv.Atoi(header.Get("Retry-After")); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	return time.Duration(1<<uint(attempt)) * time.Second
+}
+
+func decodeError(statusCode int, body []byte) error {
+	var errorResponse struct {
+		Error Error `json:"error"`
+	}
+	graphErr := &Error{StatusCode: statusCode}
+	if err := json.Unmarshal(body, &errorResponse); err == nil && errorResponse.Error.Code != "" {
+		*graphErr = errorResponse.Error
+		graphErr.StatusCode = statusCode
+	} else if len(body) != 0 {
+		graphErr.Message = strings.TrimSpace(string(body))
+	}
+	return graphErr
+}
+
+// read all pages of a collection, every page value is passed to appendPage
+func (c *Client) list(path string, appendPage func(value json.RawMessage) error) error {
+	for path != "" {
+		var page struct {
+			Value    json.RawMessage `json:"value"`
+			NextLink string          `json:"@odata.nextLink"`
+		}
+		if err := c.do(http.MethodGet, path, nil, &page); err != nil {
+			return err
+		}
+		if err := appendPage(page.Value); err != nil {
+			return err
+		}
+		path = page.NextLink
+	}
+	return nil
+}
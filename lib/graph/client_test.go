@@ -0,0 +1,120 @@
+package graph
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func testClient(server *httptest.Server) *Client {
+	return NewClient(server.URL, func() (string, error) { return "token", nil })
+}
+
+func TestDoRetriesThrottledPost(t *testing.T) {
+	posts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		posts++
+		if posts == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"id":"1","displayName":"SMC Admins"}`))
+	}))
+	defer server.Close()
+	group, err := testClient(server).CreateGroup("SMC Admins", "SMC.Admins")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if posts != 2 || group.ID != "1" {
+		t.Errorf("CreateGroup() posted %d times and returned %+v, want 2 posts and the group 1", posts, group)
+	}
+}
+
+func TestDoDoesNotRepeatUnavailablePost(t *testing.T) {
+	posts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		posts++
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+	_, err := testClient(server).CreateGroup("SMC Admins", "SMC.Admins")
+	if !IsStatus(err, http.StatusServiceUnavailable) {
+		t.Errorf("CreateGroup() = %v, want the 503 error", err)
+	}
+	if posts != 1 {
+		t.Errorf("CreateGroup() posted %d times, want 1", posts)
+	}
+}
+
+func TestListFollowsNextLink(t *testing.T) {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("$skiptoken") == "" {
+			w.Write([]byte(`{"value":[{"id":"1"},{"id":"2"}],"@odata.nextLink":"` + server.URL +
+				`/v1.0/groups?$skiptoken=page2"}`))
+			return
+		}
+		w.Write([]byte(`{"value":[{"id":"3"}]}`))
+	}))
+	defer server.Close()
+	groups, err := testClient(server).FindGroups("SMC Admins")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(groups) != 3 || groups[2].ID != "3" {
+		t.Errorf("FindGroups() returned %+v, want the groups of both pages", groups)
+	}
+}
+
+func TestDisplayNameFilterEscapesQuotes(t *testing.T) {
+	var filter string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		filter = r.URL.Query().Get("$filter")
+		w.Write([]byte(`{"value":[]}`))
+	}))
+	defer server.Close()
+	if _, err := testClient(server).FindApplications("O'Brien's SMC"); err != nil {
+		t.Fatal(err)
+	}
+	if want := "displayName eq 'O''Brien''s SMC'"; filter != want {
+		t.Errorf("the filter is %q, want %q", filter, want)
+	}
+}
+
+func TestFindGroupRejectsDuplicates(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"value":[{"id":"1"},{"id":"2"}]}`))
+	}))
+	defer server.Close()
+	if group, err := testClient(server).FindGroup("SMC Admins"); err == nil {
+		t.Errorf("FindGroup() returned %+v for two groups with the same name", group)
+	}
+}
+
+func TestDecodeError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1.0/groups/missing" {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error":{"code":"Request_ResourceNotFound","message":"the group does not exist",` +
+				`"innerError":{"request-id":"42"}}}`))
+			return
+		}
+		w.WriteHeader(http.StatusBadGateway)
+		w.Write([]byte("bad gateway\n"))
+	}))
+	defer server.Close()
+	_, err := testClient(server).GetGroup("missing")
+	if !IsStatus(err, http.StatusNotFound) {
+		t.Fatalf("GetGroup() = %v, want a 404", err)
+	}
+	graphErr := err.(*Error)
+	if graphErr.Code != "Request_ResourceNotFound" || graphErr.InnerError.RequestID != "42" {
+		t.Errorf("the error is decoded as %+v", graphErr)
+	}
+	_, err = testClient(server).GetGroup("other")
+	if !IsStatus(err, http.StatusBadGateway) || err.(*Error).Message != "bad gateway" {
+		t.Errorf("GetGroup() = %v, want the body of the 502 as the message", err)
+	}
+}
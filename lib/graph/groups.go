@@ -0,0 +1,113 @@
+package graph
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+type Group struct {
+	ID              string `json:"id,omitempty"`
+	DisplayName     string `json:"displayName"`
+	MailNickname    string `json:"mailNickname"`
+	MailEnabled     bool   `json:"mailEnabled"`
+	SecurityEnabled bool   `json:"securityEnabled"`
+}
+
+type User struct {
+	ID                string `json:"id,omitempty"`
+	DisplayName       string `json:"displayName,omitempty"`
+	UserPrincipalName string `json:"userPrincipalName,omitempty"`
+}
+
+// list the groups with the given display name
+func (c *Client) FindGroups(displayName string) ([]Group, error) {
+	var groups []Group
+	err := c.list(versionV1+"/groups"+displayNameFilter(displayName), func(value json.RawMessage) error {
+		var page []Group
+		if err := json.Unmarshal(value, &page); err != nil {
+			return err
+		}
+		groups = append(groups, page...)
+		return nil
+	})
+	return groups, err
+}
+
+// find the single group with the given display name
+func (c *Client) FindGroup(displayName string) (*Group, error) {
+	groups, err := c.FindGroups(displayName)
+	if err != nil {
+		return nil, err
+	}
+	if len(groups) == 0 {
+		return nil, fmt.Errorf("no group found with the name '%s'", displayName)
+	}
+	if len(groups) > 1 {
+		return nil, fmt.Errorf("%d groups found with the name '%s'", len(groups), displayName)
+	}
+	return &groups[0], nil
+}
+
+// read a group by object id
+func (c *Client) GetGroup(id string) (*Group, error) {
+	group := &Group{}
+	if err := c.do(http.MethodGet, versionV1+"/groups/"+url.PathEscape(id), nil, group); err != nil {
+		return nil, err
+	}
+	return group, nil
+}
+
+// create a security group
+func (c *Client) CreateGroup(displayName string, mailNickname string) (*Group, error) {
+	created := &Group{}
+	group := &Group{
+		DisplayName:     displayName,
+		MailNickname:    mailNickname,
+		MailEnabled:     false,
+		SecurityEnabled: true,
+	}
+	if err := c.do(http.MethodPost, versionV1+"/groups", group, created); err != nil {
+		return nil, err
+	}
+	return created, nil
+}
+
+func (c *Client) DeleteGroup(id string) error {
+	return c.do(http.MethodDelete, versionV1+"/groups/"+id, nil, nil)
+}
+
+// add a user, group or service principal to a group
+func (c *Client) AddGroupMember(groupId string, memberId string) error {
+	reference := map[string]string{
+		"@odata.id": fmt.Sprintf("%s%s/directoryObjects/%s", c.BaseURL, versionV1, memberId),
+	}
+	return c.do(http.MethodPost, versionV1+"/groups/"+groupId+"/members/$ref", reference, nil)
+}
+
+// read a user by object id or user principal name
+func (c *Client) GetUser(idOrUserPrincipalName string) (*User, error) {
+	user := &User{}
+	if err := c.do(http.MethodGet, versionV1+"/users/"+url.PathEscape(idOrUserPrincipalName), nil, user); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+func (c *Client) ListUsers() ([]User, error) {
+	var users []User
+	err := c.list(versionV1+"/users", func(value json.RawMessage) error {
+		var page []User
+		if err := json.Unmarshal(value, &page); err != nil {
+			return err
+		}
+		users = append(users, page...)
+		return nil
+	})
+	return users, err
+}
+
+func (c *Client) UpdateUser(id string, update *User) error {
+	return c.do(http.MethodPatch, versionV1+"/users/"+url.PathEscape(id), update, nil)
+}
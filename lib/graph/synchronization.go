@@ -0,0 +1,47 @@
+package graph
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+type SynchronizationJob struct {
+	ID         string `json:"id,omitempty"`
+	TemplateID string `json:"templateId,omitempty"`
+}
+
+func synchronizationJobsPath(servicePrincipalId string) string {
+	return versionBeta + "/servicePrincipals/" + servicePrincipalId + "/synchronization/jobs"
+}
+
+// create a provisioning job of a service principal from a synchronization template such as "scim"
+func (c *Client) CreateSynchronizationJob(servicePrincipalId string, templateId string) (*SynchronizationJob, error) {
+	created := &SynchronizationJob{}
+	if err := c.do(http.MethodPost, synchronizationJobsPath(servicePrincipalId),
+		&SynchronizationJob{TemplateID: templateId}, created); err != nil {
+		return nil, err
+	}
+	return created, nil
+}
+
+func (c *Client) ListSynchronizationJobs(servicePrincipalId string) ([]SynchronizationJob, error) {
+	var jobs []SynchronizationJob
+	err := c.list(synchronizationJobsPath(servicePrincipalId), func(value json.RawMessage) error {
+		var page []SynchronizationJob
+		if err := json.Unmarshal(value, &page); err != nil {
+			return err
+		}
+		jobs = append(jobs, page...)
+		return nil
+	})
+	return jobs, err
+}
+
+func (c *Client) DeleteSynchronizationJob(servicePrincipalId string, jobId string) error {
+	return c.do(http.MethodDelete, synchronizationJobsPath(servicePrincipalId)+"/"+jobId, nil, nil)
+}
+
+// replace the schema of a provisioning job, schema is the raw JSON document
+func (c *Client) PutSynchronizationSchema(servicePrincipalId string, jobId string, schema []byte) error {
+	return c.do(http.MethodPut, synchronizationJobsPath(servicePrincipalId)+"/"+jobId+"/schema", schema, nil)
+}
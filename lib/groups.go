@@ -0,0 +1,119 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"github.cicd.cloud.fpdev.io/BD/bd-azure-smc-deployment/lib/graph"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	GroupCreated  = "created"
+	GroupExisting = "existing"
+	GroupFailed   = "failed"
+)
+
+// how many times the POST of a group is repeated after it failed with an unavailable service or a timeout
+const createGroupRetries = 3
+
+// the outcome of ensuring one group exists
+type GroupResult struct {
+	Name   string
+	ID     string
+	Status string
+	Err    error
+}
+
+// make sure every group exists, existing groups are looked up by display name and only the
+// missing ones are created, at most parallelism at a time. The results keep the order of names
+func (a *AzureCLI) EnsureGroups(names []string, parallelism int) ([]GroupResult, error) {
+	client, err := a.GraphClient()
+	if err != nil {
+		return nil, err
+	}
+	if parallelism < 1 {
+		parallelism = 1
+	}
+	results := make([]GroupResult, len(names))
+	semaphore := make(chan struct{}, parallelism)
+	var wait sync.WaitGroup
+	for i, name := range names {
+		wait.Add(1)
+		go func(i int, name string) {
+			defer wait.Done()
+			semaphore <- struct{}{}
+			defer func() { <-semaphore }()
+			results[i] = GroupResult{Name: name}
+			groups, err := client.FindGroups(name)
+			if err != nil {
+				results[i].Status, results[i].Err = GroupFailed, err
+				return
+			}
+			if len(groups) != 0 {
+				results[i].Status, results[i].ID = GroupExisting, groups[0].ID
+				return
+			}
+			group, err := createGroup(client, name)
+			if err != nil {
+				results[i].Status, results[i].Err = GroupFailed, err
+				return
+			}
+			results[i].Status, results[i].ID = GroupCreated, group.ID
+		}(i, name)
+	}
+	wait.Wait()
+	return results, nil
+}
+
+// create a group, a POST which failed with an unavailable service or a timeout may still have
+// created it, so the group is looked up again before it is posted once more
+func createGroup(client *graph.Client, name string) (*graph.Group, error) {
+	for attempt := 0; ; attempt++ {
+		group, err := client.CreateGroup(name, groupMailNickname(name))
+		if err == nil || !retryableCreate(err) || attempt == createGroupRetries {
+			return group, err
+		}
+		time.Sleep(time.Duration(1<<uint(attempt)) * time.Second)
+		groups, findErr := client.FindGroups(name)
+		if findErr != nil {
+			return nil, err
+		}
+		if len(groups) != 0 {
+			return &groups[0], nil
+		}
+	}
+}
+
+// whether a failed POST may not have reached Graph or may have been processed without an answer
+func retryableCreate(err error) bool {
+	if graph.IsStatus(err, http.StatusServiceUnavailable) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// the mail nickname of a group cannot contain spaces
+func groupMailNickname(name string) string {
+	return strings.ReplaceAll(name, " ", ".")
+}
+
+// print a table with the outcome of every group
+func PrintGroupSummary(out io.Writer, results []GroupResult) {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "GROUP\tSTATUS\tOBJECT ID\tERROR")
+	for _, result := range results {
+		message := ""
+		if result.Err != nil {
+			message = result.Err.Error()
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", result.Name, result.Status, result.ID, message)
+	}
+	w.Flush()
+}
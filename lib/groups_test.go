@@ -0,0 +1,30 @@
+package lib
+
+import (
+	"github.cicd.cloud.fpdev.io/BD/bd-azure-smc-deployment/lib/graph"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// the first POST is processed but answered with 503, the group is found instead of being posted again
+func TestCreateGroupLooksUpAfterUnavailable(t *testing.T) {
+	posts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			posts++
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"value":[{"id":"1","displayName":"SMC Admins"}]}`))
+	}))
+	defer server.Close()
+	client := graph.NewClient(server.URL, func() (string, error) { return "token", nil })
+	group, err := createGroup(client, "SMC Admins")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if posts != 1 || group.ID != "1" {
+		t.Errorf("createGroup() posted %d times and returned %+v, want 1 post and the group 1", posts, group)
+	}
+}
@@ -0,0 +1,130 @@
+package lib
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"github.cicd.cloud.fpdev.io/BD/bd-azure-smc-deployment/lib/arm"
+	"github.com/pkg/errors"
+	"net"
+	"strings"
+	"time"
+)
+
+// the LDAPS port of the managed domain
+const LdapsPort = "636"
+
+// the expiry of the LDAPS certificate of the managed domain
+func (d *DomainService) CertificateExpiry() (time.Time, error) {
+	notAfter := d.Properties.LdapsSettings.CertificateNotAfter
+	if notAfter == "" {
+		return time.Time{}, errors.New("the managed domain has no LDAPS certificate")
+	}
+	expiry, err := time.Parse(time.RFC3339, notAfter)
+	if err != nil {
+		return time.Time{}, errors.Wrap(err, "failed in reading the expiry of the LDAPS certificate")
+	}
+	return expiry, nil
+}
+
+// the SHA-1 thumbprint of a certificate the way azure shows it
+func CertificateThumbprint(certificate *x509.Certificate) string {
+	return fmt.Sprintf("%X", sha1.Sum(certificate.Raw))
+}
+
+// whether a certificate signs itself. CheckSignatureFrom cannot tell since it wants the parent to be a
+// CA and the generated LDAPS certificate is not one
+func SelfSigned(certificate *x509.Certificate) bool {
+	return bytes.Equal(certificate.RawIssuer, certificate.RawSubject) &&
+		certificate.CheckSignature(certificate.SignatureAlgorithm, certificate.RawTBSCertificate,
+			certificate.Signature) == nil
+}
+
+// replace the LDAPS certificate of the managed domain, ARM has applied the change when it returns. Only
+// the certificate is patched, LDAPS and its external access keep their settings
+func (a *AzureCLI) UpdateLdapsCertificate(pfxBase64 string, password string) error {
+	client, err := a.ArmClient()
+	if err != nil {
+		return err
+	}
+	id, err := a.DomainServiceID()
+	if err != nil {
+		return err
+	}
+	patch := map[string]interface{}{
+		"properties": map[string]interface{}{
+			"ldapsSettings": map[string]string{
+				"pfxCertificate":         pfxBase64,
+				"pfxCertificatePassword": password,
+			},
+		},
+	}
+	if err := client.PatchResource(id, DomainServicesApiVersion, patch); err != nil {
+		return errors.Wrap(err, "failed in updating the LDAPS certificate of the managed domain")
+	}
+	return nil
+}
+
+// poll the managed domain until it reports another LDAPS certificate than the previous one
+func (a *AzureCLI) WaitForLdapsCertificate(previousThumbprint string, timeout time.Duration,
+	interval time.Duration) (*DomainService, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		domainService, err := a.GetDomainService()
+		if err != nil {
+			return nil, err
+		}
+		settings := domainService.Properties.LdapsSettings
+		if !strings.EqualFold(settings.CertificateThumbprint, previousThumbprint) &&
+			domainService.Properties.ProvisioningState == arm.StateSucceeded {
+			return domainService, nil
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("the managed domain still uses the certificate %s after %s",
+				settings.CertificateThumbprint, timeout)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// the certificate an LDAPS endpoint serves, it is read without being verified
+func ServedCertificate(address string, timeout time.Duration) (*x509.Certificate, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+	conn, err := tls.DialWithDialer(dialer, "tcp", net.JoinHostPort(address, LdapsPort),
+		&tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed in connecting to LDAPS on "+address)
+	}
+	defer conn.Close()
+	certificates := conn.ConnectionState().PeerCertificates
+	if len(certificates) == 0 {
+		return nil, errors.New("LDAPS on " + address + " did not send a certificate")
+	}
+	return certificates[0], nil
+}
+
+// poll an LDAPS endpoint until it serves the certificate with the thumbprint, the domain
+// controllers pick up a new certificate one after the other
+func WaitForServedCertificate(address string, thumbprint string, timeout time.Duration,
+	interval time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		certificate, err := ServedCertificate(address, 10*time.Second)
+		served := ""
+		if err == nil {
+			served = CertificateThumbprint(certificate)
+			if strings.EqualFold(served, thumbprint) {
+				return nil
+			}
+		}
+		if time.Now().After(deadline) {
+			if err != nil {
+				return err
+			}
+			return fmt.Errorf("LDAPS on %s still serves the certificate %s after %s", address, served, timeout)
+		}
+		time.Sleep(interval)
+	}
+}
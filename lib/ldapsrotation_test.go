@@ -0,0 +1,25 @@
+package lib
+
+import (
+	"crypto/x509"
+	"testing"
+)
+
+func TestSelfSigned(t *testing.T) {
+	selfSigned := &SSLCertGenerator{Days: 30, Domain: "example.com", Password: "Secr3t!", KeyType: KeyTypeECDSAP256}
+	if err := selfSigned.Generate(); err != nil {
+		t.Fatal(err)
+	}
+	if !SelfSigned(selfSigned.Certificate) {
+		t.Error("SelfSigned() = false for the generated self-signed certificate")
+	}
+	// signed by a certificate with the same subject, only the signature tells them apart
+	signed := &SSLCertGenerator{Days: 30, Domain: "example.com", Password: "Secr3t!", KeyType: KeyTypeECDSAP256,
+		CACertificates: []*x509.Certificate{selfSigned.Certificate}, CAKey: selfSigned.PrivateKey}
+	if err := signed.Generate(); err != nil {
+		t.Fatal(err)
+	}
+	if SelfSigned(signed.Certificate) {
+		t.Error("SelfSigned() = true for a certificate signed by another key")
+	}
+}
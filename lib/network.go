@@ -0,0 +1,145 @@
+package lib
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+	"net"
+	"strings"
+)
+
+const (
+	VirtualNetworkType       = "Microsoft.Network/virtualNetworks"
+	NetworkSecurityGroupType = "Microsoft.Network/networkSecurityGroups"
+	NetworkApiVersion        = "2018-10-01"
+)
+
+// returned by an update of updateResource when the resource does not need to change
+var errUnchanged = errors.New("the resource is unchanged")
+
+// whether the managed domain goes into an existing subnet instead of the network of the template
+func ExistingVnet() bool {
+	return viper.GetBool("EXISTING_VNET")
+}
+
+// the resource group of the VNet, an existing VNet may be in another resource group
+func VnetResourceGroup() string {
+	if resourceGroup := strings.TrimSpace(viper.GetString("VNET_RESOURCE_GROUP")); ExistingVnet() && resourceGroup != "" {
+		return resourceGroup
+	}
+	return viper.GetString("RESOURCE_GROUP")
+}
+
+// the name of the network security group the template creates for the subnet
+func NetworkSecurityGroupName() string {
+	return viper.GetString("DOMAIN_SERVICES_SUBNET_NAME") + "-nsg"
+}
+
+// the addresses AAD DS gives its two domain controllers in a new subnet, azure reserves the
+// first four addresses of every subnet so these are the fifth and the sixth
+func DefaultDNSServers(subnetPrefix string) ([]string, error) {
+	_, subnet, err := net.ParseCIDR(strings.TrimSpace(subnetPrefix))
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid subnet address prefix")
+	}
+	base := subnet.IP.To4()
+	if base == nil {
+		return nil, fmt.Errorf("the subnet %s is not an IPv4 subnet", subnetPrefix)
+	}
+	var servers []string
+	for _, offset := range []uint32{4, 5} {
+		ip := make(net.IP, 4)
+		binary.BigEndian.PutUint32(ip, binary.BigEndian.Uint32(base)+offset)
+		servers = append(servers, ip.String())
+	}
+	return servers, nil
+}
+
+// the DNS servers of the VNet, DNS_SERVERS of the config or the default domain controller addresses
+func DNSServers() ([]string, error) {
+	if servers := viper.GetStringSlice("DNS_SERVERS"); len(servers) != 0 {
+		return servers, nil
+	}
+	return DefaultDNSServers(viper.GetString("DOMAIN_SERVICES_SUBNET_ADDRESS_PREFIX"))
+}
+
+// check the address prefixes of the config, every problem is returned as a warning.
+// An existing subnet is checked by CheckExistingSubnet instead
+func NetworkWarnings() []string {
+	if ExistingVnet() {
+		return nil
+	}
+	var warnings []string
+	subnetPrefix := viper.GetString("DOMAIN_SERVICES_SUBNET_ADDRESS_PREFIX")
+	_, subnet, err := net.ParseCIDR(strings.TrimSpace(subnetPrefix))
+	if err != nil {
+		return append(warnings, fmt.Sprintf("DOMAIN_SERVICES_SUBNET_ADDRESS_PREFIX %s is not a valid prefix", subnetPrefix))
+	}
+	vnetPrefix := viper.GetString("DOMAIN_SERVICES_VNET_ADDRESS_PREFIX")
+	_, vnet, err := net.ParseCIDR(strings.TrimSpace(vnetPrefix))
+	if err != nil {
+		warnings = append(warnings, fmt.Sprintf("DOMAIN_SERVICES_VNET_ADDRESS_PREFIX %s is not a valid prefix", vnetPrefix))
+	} else if ones, _ := subnet.Mask.Size(); !vnet.Contains(subnet.IP) || ones < prefixLength(vnet) {
+		warnings = append(warnings, fmt.Sprintf("the subnet %s is not inside the VNet %s", subnetPrefix, vnetPrefix))
+	}
+	// azure reserves the first four and the last address of a subnet, a /29 is the smallest one left
+	if ones, bits := subnet.Mask.Size(); bits-ones < 3 {
+		warnings = append(warnings, fmt.Sprintf("the subnet %s cannot contain the default domain controller addresses, "+
+			"use a larger subnet", subnetPrefix))
+	}
+	if servers := viper.GetStringSlice("DNS_SERVERS"); len(servers) != 0 {
+		for _, server := range servers {
+			if ip := net.ParseIP(server); ip == nil || !subnet.Contains(ip) {
+				warnings = append(warnings, fmt.Sprintf("the DNS server %s is not inside the subnet %s", server, subnetPrefix))
+			}
+		}
+	}
+	return warnings
+}
+
+func prefixLength(network *net.IPNet) int {
+	ones, _ := network.Mask.Size()
+	return ones
+}
+
+// the domain controller addresses of all replica sets of the managed domain
+func (d *DomainService) DomainControllerIPs() []string {
+	var ips []string
+	for _, replicaSet := range d.Properties.ReplicaSets {
+		ips = append(ips, replicaSet.DomainControllerIpAddress...)
+	}
+	return ips
+}
+
+// set the DHCP DNS servers of the VNet, the VNet is only updated when they differ.
+// It returns the servers the VNet had before
+func (a *AzureCLI) UpdateVnetDNSServers(servers []string) ([]string, error) {
+	client, err := a.ArmClient()
+	if err != nil {
+		return nil, err
+	}
+	id := client.ResourceID(VnetResourceGroup(), VirtualNetworkType, viper.GetString("DOMAIN_SERVICES_VNET_NAME"))
+	var current []string
+	err = updateResource(client, id, func(properties map[string]interface{}) error {
+		dhcpOptions, _ := properties["dhcpOptions"].(map[string]interface{})
+		if dhcpOptions == nil {
+			dhcpOptions = make(map[string]interface{})
+		}
+		if dnsServers, ok := dhcpOptions["dnsServers"].([]interface{}); ok {
+			for _, server := range dnsServers {
+				current = append(current, fmt.Sprint(server))
+			}
+		}
+		if strings.Join(current, ",") == strings.Join(servers, ",") {
+			return errUnchanged
+		}
+		dhcpOptions["dnsServers"] = servers
+		properties["dhcpOptions"] = dhcpOptions
+		return nil
+	})
+	if err != nil && err != errUnchanged {
+		return nil, errors.Wrap(err, "failed in updating the DNS servers of the VNet")
+	}
+	return current, nil
+}
@@ -0,0 +1,262 @@
+package lib
+
+import (
+	"fmt"
+	"github.com/spf13/viper"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// SecurityRule is a rule of a network security group as ARM returns it
+type SecurityRule struct {
+	Name       string                 `json:"name"`
+	Properties SecurityRuleProperties `json:"properties"`
+}
+
+type SecurityRuleProperties struct {
+	Description              string   `json:"description,omitempty"`
+	Protocol                 string   `json:"protocol"`
+	SourcePortRange          string   `json:"sourcePortRange,omitempty"`
+	DestinationPortRange     string   `json:"destinationPortRange,omitempty"`
+	DestinationPortRanges    []string `json:"destinationPortRanges,omitempty"`
+	SourceAddressPrefix      string   `json:"sourceAddressPrefix,omitempty"`
+	SourceAddressPrefixes    []string `json:"sourceAddressPrefixes,omitempty"`
+	DestinationAddressPrefix string   `json:"destinationAddressPrefix,omitempty"`
+	Access                   string   `json:"access"`
+	Priority                 int      `json:"priority"`
+	Direction                string   `json:"direction"`
+}
+
+const (
+	// the rules of the original template, PowerShell remoting is open to any source
+	NsgProfileDefault = "default"
+	// PowerShell remoting and the sync with Azure AD only from the service tag of AAD DS
+	NsgProfileHardened = "hardened"
+
+	DomainServicesServiceTag = "AzureActiveDirectoryDomainServices"
+)
+
+// the sources allowed to reach LDAPS, LDAPS_ALLOWED_CIDRS or the public address of the SMC.
+// Every entry must be an IP address or a CIDR
+func LdapsAllowedCIDRs() ([]string, error) {
+	cidrs := viper.GetStringSlice("LDAPS_ALLOWED_CIDRS")
+	if len(cidrs) == 0 {
+		cidrs = []string{viper.GetString("NGINX_PUBLIC_IP_ADDRESS")}
+	}
+	var allowed []string
+	var invalid []string
+	for _, cidr := range cidrs {
+		cidr = strings.TrimSpace(cidr)
+		if net.ParseIP(cidr) == nil {
+			if _, _, err := net.ParseCIDR(cidr); err != nil {
+				invalid = append(invalid, "'"+cidr+"'")
+				continue
+			}
+		}
+		allowed = append(allowed, cidr)
+	}
+	if len(invalid) != 0 {
+		return nil, fmt.Errorf("the LDAPS sources %s are not IP addresses or CIDRs", strings.Join(invalid, ", "))
+	}
+	return allowed, nil
+}
+
+// the inbound rules the managed domain needs on its subnet for the NSG_PROFILE
+func RequiredSecurityRules() ([]SecurityRule, error) {
+	profile := strings.ToLower(strings.TrimSpace(viper.GetString("NSG_PROFILE")))
+	if profile != NsgProfileDefault && profile != NsgProfileHardened {
+		return nil, fmt.Errorf("unknown NSG_PROFILE '%s', expected %s or %s", profile, NsgProfileDefault,
+			NsgProfileHardened)
+	}
+	ldapsSources, err := LdapsAllowedCIDRs()
+	if err != nil {
+		return nil, err
+	}
+	inbound := func(name string, priority int, port string, sources ...string) SecurityRule {
+		rule := SecurityRule{Name: name, Properties: SecurityRuleProperties{
+			Protocol:                 "Tcp",
+			SourcePortRange:          "*",
+			DestinationPortRange:     port,
+			DestinationAddressPrefix: "*",
+			Access:                   "Allow",
+			Priority:                 priority,
+			Direction:                "Inbound",
+		}}
+		if len(sources) == 1 {
+			rule.Properties.SourceAddressPrefix = sources[0]
+		} else {
+			rule.Properties.SourceAddressPrefixes = sources
+		}
+		return rule
+	}
+	managementSource := "*"
+	if profile == NsgProfileHardened {
+		managementSource = DomainServicesServiceTag
+	}
+	return []SecurityRule{
+		inbound("AllowSyncWithAzureAD", 101, "443", managementSource),
+		inbound("AllowRD", 201, "3389", "CorpNetSaw"),
+		inbound("AllowPSRemoting", 301, "5986", managementSource),
+		inbound("AllowLDAPS", 401, "636", ldapsSources...),
+	}, nil
+}
+
+// the sources of a rule, a single prefix or a list of them
+func (r *SecurityRule) sources() []string {
+	if r.Properties.SourceAddressPrefix != "" {
+		return []string{r.Properties.SourceAddressPrefix}
+	}
+	return r.Properties.SourceAddressPrefixes
+}
+
+func (r *SecurityRule) ports() []string {
+	if r.Properties.DestinationPortRange != "" {
+		return []string{r.Properties.DestinationPortRange}
+	}
+	return r.Properties.DestinationPortRanges
+}
+
+// whether the rule applies to inbound TCP traffic from the source to the port
+func (r *SecurityRule) matches(port int, source string) bool {
+	if !strings.EqualFold(r.Properties.Direction, "Inbound") {
+		return false
+	}
+	if protocol := r.Properties.Protocol; protocol != "*" && !strings.EqualFold(protocol, "Tcp") {
+		return false
+	}
+	portMatch := false
+	for _, ports := range r.ports() {
+		portMatch = portMatch || portInRange(port, ports)
+	}
+	if !portMatch {
+		return false
+	}
+	for _, prefix := range r.sources() {
+		if sourceMatches(prefix, source) {
+			return true
+		}
+	}
+	return false
+}
+
+func portInRange(port int, ports string) bool {
+	if ports == "*" {
+		return true
+	}
+	bounds := strings.SplitN(ports, "-", 2)
+	low, err := strconv.Atoi(strings.TrimSpace(bounds[0]))
+	if err != nil {
+		return false
+	}
+	high := low
+	if len(bounds) == 2 {
+		if high, err = strconv.Atoi(strings.TrimSpace(bounds[1])); err != nil {
+			return false
+		}
+	}
+	return port >= low && port <= high
+}
+
+// whether a source prefix of a rule covers a source, an IP address or a CIDR. Service tags only
+// match themselves
+func sourceMatches(prefix string, source string) bool {
+	if prefix == "*" || strings.EqualFold(prefix, source) {
+		return true
+	}
+	sourceNetwork := addressRange(source)
+	if sourceNetwork == nil {
+		return false
+	}
+	if strings.EqualFold(prefix, "Internet") {
+		return true
+	}
+	network := addressRange(prefix)
+	if network == nil {
+		return false
+	}
+	ones, _ := network.Mask.Size()
+	sourceOnes, _ := sourceNetwork.Mask.Size()
+	return network.Contains(sourceNetwork.IP) && ones <= sourceOnes
+}
+
+// an IP address or a CIDR as a network, nil for anything else
+func addressRange(value string) *net.IPNet {
+	if ip := net.ParseIP(value); ip != nil {
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 8*net.IPv4len
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+	}
+	_, network, err := net.ParseCIDR(value)
+	if err != nil {
+		return nil
+	}
+	return network
+}
+
+// whether the rules let the traffic of a required rule through, the rule with the lowest priority
+// number which applies decides like it does in azure. Traffic no rule applies to is denied
+func rulesAllow(rules []SecurityRule, required SecurityRule) bool {
+	sorted := append([]SecurityRule(nil), rules...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Properties.Priority < sorted[j].Properties.Priority
+	})
+	port, err := strconv.Atoi(required.Properties.DestinationPortRange)
+	if err != nil {
+		return false
+	}
+	for _, source := range required.sources() {
+		allowed := false
+		for _, rule := range sorted {
+			if rule.matches(port, source) {
+				allowed = strings.EqualFold(rule.Properties.Access, "Allow")
+				break
+			}
+		}
+		if !allowed {
+			return false
+		}
+	}
+	return true
+}
+
+// the required rules the rules do not allow
+func MissingSecurityRules(rules []SecurityRule) ([]SecurityRule, error) {
+	required, err := RequiredSecurityRules()
+	if err != nil {
+		return nil, err
+	}
+	var missing []SecurityRule
+	for _, rule := range required {
+		if !rulesAllow(rules, rule) {
+			missing = append(missing, rule)
+		}
+	}
+	return missing, nil
+}
+
+// give the added rules a name and a priority not taken by the existing rules, the next free ones are used
+func placeSecurityRules(existing []SecurityRule, added []SecurityRule) []SecurityRule {
+	priorities := make(map[string]bool)
+	names := make(map[string]bool)
+	for _, rule := range existing {
+		priorities[rule.Properties.Direction+strconv.Itoa(rule.Properties.Priority)] = true
+		names[strings.ToLower(rule.Name)] = true
+	}
+	var placed []SecurityRule
+	for _, rule := range added {
+		for priorities[rule.Properties.Direction+strconv.Itoa(rule.Properties.Priority)] {
+			rule.Properties.Priority++
+		}
+		for name, i := rule.Name, 2; names[strings.ToLower(rule.Name)]; i++ {
+			rule.Name = name + strconv.Itoa(i)
+		}
+		priorities[rule.Properties.Direction+strconv.Itoa(rule.Properties.Priority)] = true
+		names[strings.ToLower(rule.Name)] = true
+		placed = append(placed, rule)
+	}
+	return placed
+}
@@ -0,0 +1,224 @@
+package pkcs12
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"hash"
+)
+
+var (
+	oidPBES2          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2         = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidHMACWithSHA1   = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 7}
+	oidHMACWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidSHA256         = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidAES128CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAES192CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+	oidAES256CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+
+	oidPBEWithSHAAnd40BitRC2CBC = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 1, 6}
+)
+
+type pbes2Params struct {
+	KeyDerivationFunc pkix.AlgorithmIdentifier
+	EncryptionScheme  pkix.AlgorithmIdentifier
+}
+
+type pbkdf2Params struct {
+	Salt       []byte
+	Iterations int
+	KeyLength  int                      `asn1:"optional"`
+	Prf        pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+// ErrIncorrectPassword is returned when the MAC of a PFX does not match the password
+var ErrIncorrectPassword = errors.New("pkcs12: the password is incorrect")
+
+// Certificates reads the certificates of a PFX protected by the password, the private key is left
+// encrypted. It reads the bundles of Encode and of openssl 3, the RC2 encryption of openssl -legacy
+// is not supported
+func Certificates(pfxData []byte, password string) ([]*x509.Certificate, error) {
+	var pfx pfxPdu
+	if rest, err := asn1.Unmarshal(pfxData, &pfx); err != nil {
+		return nil, errors.New("pkcs12: the data is not a PFX: " + err.Error())
+	} else if len(rest) != 0 {
+		return nil, errors.New("pkcs12: trailing data after the PFX")
+	}
+	if pfx.Version != 3 {
+		return nil, errors.New("pkcs12: only version 3 of PFX is supported")
+	}
+	if !pfx.AuthSafe.ContentType.Equal(oidDataContentType) {
+		return nil, errors.New("pkcs12: only password integrity is supported")
+	}
+	var authenticatedSafe []byte
+	if _, err := asn1.Unmarshal(pfx.AuthSafe.Content.Bytes, &authenticatedSafe); err != nil {
+		return nil, err
+	}
+	bmpPassword, err := bmpString(password)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyMac(&pfx.MacData, authenticatedSafe, bmpPassword); err != nil {
+		return nil, err
+	}
+
+	var contents []contentInfo
+	if _, err := asn1.Unmarshal(authenticatedSafe, &contents); err != nil {
+		return nil, err
+	}
+	var certificates []*x509.Certificate
+	for _, content := range contents {
+		var bagsData []byte
+		switch {
+		case content.ContentType.Equal(oidDataContentType):
+			if _, err := asn1.Unmarshal(content.Content.Bytes, &bagsData); err != nil {
+				return nil, err
+			}
+		case content.ContentType.Equal(oidEncryptedDataContentType):
+			var data encryptedData
+			if _, err := asn1.Unmarshal(content.Content.Bytes, &data); err != nil {
+				return nil, err
+			}
+			info := data.EncryptedContentInfo
+			if bagsData, err = decrypt(&info.ContentEncryptionAlgorithm, info.EncryptedContent, password,
+				bmpPassword); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, errors.New("pkcs12: only data and encrypted data contents are supported")
+		}
+		var bags []safeBag
+		if _, err := asn1.Unmarshal(bagsData, &bags); err != nil {
+			return nil, err
+		}
+		for _, bag := range bags {
+			if !bag.ID.Equal(oidCertBag) {
+				continue
+			}
+			var cert certBag
+			if _, err := asn1.Unmarshal(bag.Value.Bytes, &cert); err != nil {
+				return nil, err
+			}
+			if !cert.ID.Equal(oidCertTypeX509Certificate) {
+				continue
+			}
+			certificate, err := x509.ParseCertificate(cert.Data)
+			if err != nil {
+				return nil, err
+			}
+			certificates = append(certificates, certificate)
+		}
+	}
+	if len(certificates) == 0 {
+		return nil, errors.New("pkcs12: the PFX has no certificate")
+	}
+	return certificates, nil
+}
+
+// check the MAC of the authenticated safe, openssl 3 uses SHA-256 and older tools SHA-1
+func verifyMac(mac *macData, content []byte, password []byte) error {
+	var newHash func() hash.Hash
+	switch {
+	case mac.Mac.Algorithm.Algorithm.Equal(oidSHA1):
+		newHash = sha1.New
+	case mac.Mac.Algorithm.Algorithm.Equal(oidSHA256):
+		newHash = sha256.New
+	default:
+		return errors.New("pkcs12: unsupported MAC algorithm " + mac.Mac.Algorithm.Algorithm.String())
+	}
+	key := pbkdfHash(newHash, password, mac.MacSalt, mac.Iterations, 3, newHash().Size())
+	h := hmac.New(newHash, key)
+	h.Write(content)
+	if !hmac.Equal(h.Sum(nil), mac.Mac.Digest) {
+		return ErrIncorrectPassword
+	}
+	return nil
+}
+
+// decrypt with pbeWithSHAAnd3-KeyTripleDES-CBC or PBES2 with PBKDF2 and AES-CBC. PBES2 takes the
+// password as UTF-8 and the PKCS#12 derivation as a BMPString
+func decrypt(algorithm *pkix.AlgorithmIdentifier, ciphertext []byte, password string,
+	bmpPassword []byte) ([]byte, error) {
+	var block cipher.Block
+	var iv []byte
+	switch {
+	case algorithm.Algorithm.Equal(oidPBEWithSHAAnd3KeyTripleDESCBC):
+		var params pbeParams
+		if _, err := asn1.Unmarshal(algorithm.Parameters.FullBytes, &params); err != nil {
+			return nil, err
+		}
+		var err error
+		if block, err = des.NewTripleDESCipher(pbkdf(bmpPassword, params.Salt, params.Iterations, 1, 24)); err != nil {
+			return nil, err
+		}
+		iv = pbkdf(bmpPassword, params.Salt, params.Iterations, 2, block.BlockSize())
+	case algorithm.Algorithm.Equal(oidPBES2):
+		var params pbes2Params
+		if _, err := asn1.Unmarshal(algorithm.Parameters.FullBytes, &params); err != nil {
+			return nil, err
+		}
+		if !params.KeyDerivationFunc.Algorithm.Equal(oidPBKDF2) {
+			return nil, errors.New("pkcs12: PBES2 only supports PBKDF2")
+		}
+		var kdfParams pbkdf2Params
+		if _, err := asn1.Unmarshal(params.KeyDerivationFunc.Parameters.FullBytes, &kdfParams); err != nil {
+			return nil, err
+		}
+		newHash := sha1.New
+		if prf := kdfParams.Prf.Algorithm; len(prf) != 0 && !prf.Equal(oidHMACWithSHA1) {
+			if !prf.Equal(oidHMACWithSHA256) {
+				return nil, errors.New("pkcs12: unsupported PBKDF2 function " + prf.String())
+			}
+			newHash = sha256.New
+		}
+		var keySize int
+		switch scheme := params.EncryptionScheme.Algorithm; {
+		case scheme.Equal(oidAES128CBC):
+			keySize = 16
+		case scheme.Equal(oidAES192CBC):
+			keySize = 24
+		case scheme.Equal(oidAES256CBC):
+			keySize = 32
+		default:
+			return nil, errors.New("pkcs12: unsupported PBES2 cipher " + scheme.String())
+		}
+		if _, err := asn1.Unmarshal(params.EncryptionScheme.Parameters.FullBytes, &iv); err != nil {
+			return nil, err
+		}
+		var err error
+		if block, err = aes.NewCipher(pbkdf2(newHash, []byte(password), kdfParams.Salt, kdfParams.Iterations,
+			keySize)); err != nil {
+			return nil, err
+		}
+		if len(iv) != block.BlockSize() {
+			return nil, errors.New("pkcs12: the AES IV has the wrong size")
+		}
+	case algorithm.Algorithm.Equal(oidPBEWithSHAAnd40BitRC2CBC):
+		return nil, errors.New("pkcs12: pbeWithSHAAnd40BitRC2-CBC is not supported, export the PFX with AES or 3DES")
+	default:
+		return nil, errors.New("pkcs12: unsupported encryption " + algorithm.Algorithm.String())
+	}
+	if len(ciphertext) == 0 || len(ciphertext)%block.BlockSize() != 0 {
+		return nil, errors.New("pkcs12: the encrypted data is not a multiple of the block size")
+	}
+	plaintext := make([]byte, len(ciphertext))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plaintext, ciphertext)
+	padding := int(plaintext[len(plaintext)-1])
+	if padding == 0 || padding > block.BlockSize() {
+		return nil, ErrIncorrectPassword
+	}
+	for _, b := range plaintext[len(plaintext)-padding:] {
+		if int(b) != padding {
+			return nil, ErrIncorrectPassword
+		}
+	}
+	return plaintext[:len(plaintext)-padding], nil
+}
@@ -0,0 +1,107 @@
+package pkcs12
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"io/ioutil"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func testCertificate(t *testing.T, commonName string, parent *x509.Certificate,
+	parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  parent == nil,
+		BasicConstraintsValid: true,
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certificate, key
+}
+
+func TestEncodeRoundTrip(t *testing.T) {
+	ca, caKey := testCertificate(t, "Test CA", nil, nil)
+	leaf, leafKey := testCertificate(t, "*.example.com", ca, caKey)
+	for _, password := range []string{"Secr3t!", "pässwörd€", ""} {
+		pfx, err := Encode(rand.Reader, leafKey, leaf, []*x509.Certificate{ca}, password, "ldaps")
+		if err != nil {
+			t.Fatalf("Encode() with the password %q: %v", password, err)
+		}
+		certificates, err := Certificates(pfx, password)
+		if err != nil {
+			t.Fatalf("Certificates() with the password %q: %v", password, err)
+		}
+		if len(certificates) != 2 || !certificates[0].Equal(leaf) || !certificates[1].Equal(ca) {
+			t.Errorf("Certificates() with the password %q returned %d certificates, want the leaf and the CA",
+				password, len(certificates))
+		}
+	}
+}
+
+func TestCertificatesWrongPassword(t *testing.T) {
+	certificate, key := testCertificate(t, "*.example.com", nil, nil)
+	pfx, err := Encode(rand.Reader, key, certificate, nil, "pässwörd", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, password := range []string{"wrong", "passwort", "pässwörd "} {
+		if _, err := Certificates(pfx, password); err != ErrIncorrectPassword {
+			t.Errorf("Certificates() with the password %q = %v, want ErrIncorrectPassword", password, err)
+		}
+	}
+}
+
+func TestBmpStringRejectsAstralCharacters(t *testing.T) {
+	if _, err := bmpString("key🔑"); err == nil {
+		t.Error("bmpString() accepted a character outside the basic multilingual plane")
+	}
+	if _, err := Encode(rand.Reader, nil, &x509.Certificate{}, nil, "key🔑", ""); err == nil {
+		t.Error("Encode() accepted a character outside the basic multilingual plane")
+	}
+}
+
+// testdata/openssl3.pfx is the openssl 3 default: AES-256-CBC with PBKDF2 HMAC-SHA256 and a SHA-256 MAC,
+// exported with the password pässwörd
+func TestCertificatesOpenSSL3(t *testing.T) {
+	pfx, err := ioutil.ReadFile("testdata/openssl3.pfx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificates, err := Certificates(pfx, "pässwörd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(certificates) != 1 {
+		t.Fatalf("Certificates() returned %d certificates, want 1", len(certificates))
+	}
+	thumbprint := sha1.Sum(certificates[0].Raw)
+	if got, want := hex.EncodeToString(thumbprint[:]), "6dd70353f642d8682253f0d383115bbd4dc16551"; got != want {
+		t.Errorf("the certificate has the thumbprint %s, want %s", got, want)
+	}
+	if _, err := Certificates(pfx, "passwörd"); err != ErrIncorrectPassword {
+		t.Errorf("Certificates() with a wrong password = %v, want ErrIncorrectPassword", err)
+	}
+}
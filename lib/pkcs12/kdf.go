@@ -0,0 +1,85 @@
+package pkcs12
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/binary"
+	"hash"
+)
+
+// the key derivation of RFC 7292 appendix B.2 with SHA-1, id is 1 for an encryption key, 2 for an IV
+// and 3 for a MAC key
+func pbkdf(password []byte, salt []byte, iterations int, id byte, size int) []byte {
+	return pbkdfHash(sha1.New, password, salt, iterations, id, size)
+}
+
+// the key derivation of RFC 7292 appendix B.2, SHA-1 and SHA-2 share the block size v
+func pbkdfHash(newHash func() hash.Hash, password []byte, salt []byte, iterations int, id byte, size int) []byte {
+	const v = 64
+	d := bytes.Repeat([]byte{id}, v)
+	i := append(fill(salt, v), fill(password, v)...)
+	var key []byte
+	for {
+		h := newHash()
+		h.Write(d)
+		h.Write(i)
+		a := h.Sum(nil)
+		for j := 1; j < iterations; j++ {
+			h.Reset()
+			h.Write(a)
+			a = h.Sum(nil)
+		}
+		key = append(key, a...)
+		if len(key) >= size {
+			return key[:size]
+		}
+		// every block of I becomes I + B + 1 modulo 2^(v*8)
+		b := fill(a, v)
+		for start := 0; start < len(i); start += v {
+			carry := 1
+			for k := v - 1; k >= 0; k-- {
+				sum := int(i[start+k]) + int(b[k]) + carry
+				i[start+k] = byte(sum)
+				carry = sum >> 8
+			}
+		}
+	}
+}
+
+// repeat the value up to the next multiple of v bytes, an empty value stays empty
+func fill(value []byte, v int) []byte {
+	if len(value) == 0 {
+		return nil
+	}
+	filled := make([]byte, v*((len(value)+v-1)/v))
+	for i := range filled {
+		filled[i] = value[i%len(value)]
+	}
+	return filled
+}
+
+// PBKDF2 of RFC 8018 section 5.2
+func pbkdf2(newHash func() hash.Hash, password []byte, salt []byte, iterations int, size int) []byte {
+	prf := hmac.New(newHash, password)
+	var key []byte
+	for block := uint32(1); len(key) < size; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		var index [4]byte
+		binary.BigEndian.PutUint32(index[:], block)
+		prf.Write(index[:])
+		u := prf.Sum(nil)
+		t := append([]byte(nil), u...)
+		for j := 1; j < iterations; j++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for k := range t {
+				t[k] ^= u[k]
+			}
+		}
+		key = append(key, t...)
+	}
+	return key[:size]
+}
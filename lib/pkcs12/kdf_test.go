@@ -0,0 +1,67 @@
+package pkcs12
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"testing"
+)
+
+// the expected keys are computed with openssl kdf PKCS12KDF and the BMPString of "sesame"
+func TestPbkdf(t *testing.T) {
+	password, err := bmpString("sesame")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		newHash func() hash.Hash
+		salt    string
+		id      byte
+		size    int
+		want    string
+	}{
+		{"sha1 key", sha1.New, "ffffffffffffffff", 1, 24, "7cd9fd3e2b3be7691a44e3bef0f9ea0fb9b897d4e325d9d1"},
+		{"sha1 iv", sha1.New, "ffffffffffffffff", 2, 24, "3f5a277f9c21ff82b0d22f41c70f72d36d6c1e365247094a"},
+		{"sha1 mac", sha1.New, "ffffffffffffffff", 3, 24, "91715bd27aa978513e3a40f55b8f7b567b5a9f3c4279edab"},
+		{"sha256 mac", sha256.New, "0102030405060708", 3, 32,
+			"387e92981f3af02830d01363708fdf6f85b057dcdb05db4a9517f71109cb2d56"},
+	}
+	for _, test := range tests {
+		salt, _ := hex.DecodeString(test.salt)
+		got := hex.EncodeToString(pbkdfHash(test.newHash, password, salt, 2048, test.id, test.size))
+		if got != test.want {
+			t.Errorf("%s: pbkdfHash() = %s, want %s", test.name, got, test.want)
+		}
+	}
+	salt, _ := hex.DecodeString("ffffffffffffffff")
+	if got := hex.EncodeToString(pbkdf(password, salt, 2048, 1, 24)); got != tests[0].want {
+		t.Errorf("pbkdf() = %s, want %s", got, tests[0].want)
+	}
+}
+
+// the vectors of RFC 6070 for HMAC-SHA1 and the same inputs with HMAC-SHA256
+func TestPbkdf2(t *testing.T) {
+	tests := []struct {
+		newHash    func() hash.Hash
+		password   string
+		salt       string
+		iterations int
+		size       int
+		want       string
+	}{
+		{sha1.New, "password", "salt", 1, 20, "0c60c80f961f0e71f3a9b524af6012062fe037a6"},
+		{sha1.New, "password", "salt", 4096, 20, "4b007901b765489abead49d926f721d065a429c1"},
+		{sha1.New, "passwordPASSWORDpassword", "saltSALTsaltSALTsaltSALTsaltSALTsalt", 4096, 25,
+			"3d2eec4fe41c849b80c8d83662c0e44a8b291a964cf2f07038"},
+		{sha256.New, "password", "salt", 2, 32, "ae4d0c95af6b46d32d0adff928f06dd02a303f8ef3c251dfd6e2d85a95474c43"},
+	}
+	for _, test := range tests {
+		got := hex.EncodeToString(pbkdf2(test.newHash, []byte(test.password), []byte(test.salt), test.iterations,
+			test.size))
+		if got != test.want {
+			t.Errorf("pbkdf2(%q, %q, %d) = %s, want %s", test.password, test.salt, test.iterations, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,290 @@
+// Package pkcs12 encodes a private key and its certificates as a PKCS#12 (PFX) bundle and reads
+// the certificates back.
+// The key and the certificates are encrypted with pbeWithSHAAnd3-KeyTripleDES-CBC and the bundle
+// is protected by an HMAC-SHA1, the format openssl and Windows read without any legacy option.
+package pkcs12
+
+import (
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"io"
+	"unicode/utf16"
+)
+
+const (
+	// the iterations of the key derivation, the default of openssl
+	iterations = 2048
+	saltSize   = 8
+)
+
+var (
+	oidDataContentType               = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidEncryptedDataContentType      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 6}
+	oidCertBag                       = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 3}
+	oidPKCS8ShroudedKeyBag           = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 2}
+	oidCertTypeX509Certificate       = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 22, 1}
+	oidLocalKeyID                    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 21}
+	oidFriendlyName                  = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 20}
+	oidPBEWithSHAAnd3KeyTripleDESCBC = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 1, 3}
+	oidSHA1                          = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+)
+
+type pfxPdu struct {
+	Version  int
+	AuthSafe contentInfo
+	MacData  macData
+}
+
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"tag:0,explicit,optional"`
+}
+
+type encryptedData struct {
+	Version              int
+	EncryptedContentInfo encryptedContentInfo
+}
+
+type encryptedContentInfo struct {
+	ContentType                asn1.ObjectIdentifier
+	ContentEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedContent           []byte `asn1:"tag:0,optional"`
+}
+
+type safeBag struct {
+	ID         asn1.ObjectIdentifier
+	Value      asn1.RawValue     `asn1:"tag:0,explicit"`
+	Attributes []pkcs12Attribute `asn1:"set,optional"`
+}
+
+type pkcs12Attribute struct {
+	ID    asn1.ObjectIdentifier
+	Value asn1.RawValue `asn1:"set"`
+}
+
+type certBag struct {
+	ID   asn1.ObjectIdentifier
+	Data []byte `asn1:"tag:0,explicit"`
+}
+
+type encryptedPrivateKeyInfo struct {
+	AlgorithmIdentifier pkix.AlgorithmIdentifier
+	EncryptedData       []byte
+}
+
+type pbeParams struct {
+	Salt       []byte
+	Iterations int
+}
+
+type macData struct {
+	Mac        digestInfo
+	MacSalt    []byte
+	Iterations int `asn1:"optional,default:1"`
+}
+
+type digestInfo struct {
+	Algorithm pkix.AlgorithmIdentifier
+	Digest    []byte
+}
+
+// Encode the private key of a certificate, the certificate and the certificates of its chain as a PFX
+// protected by the password. The friendly name of the certificate is left out when it is empty
+func Encode(rand io.Reader, privateKey interface{}, certificate *x509.Certificate, caCerts []*x509.Certificate,
+	password string, friendlyName string) ([]byte, error) {
+	bmpPassword, err := bmpString(password)
+	if err != nil {
+		return nil, err
+	}
+	localKeyID := sha1.Sum(certificate.Raw)
+	attributes, err := bagAttributes(localKeyID[:], friendlyName)
+	if err != nil {
+		return nil, err
+	}
+
+	var certBags []safeBag
+	bag, err := certificateBag(certificate, attributes)
+	if err != nil {
+		return nil, err
+	}
+	certBags = append(certBags, *bag)
+	for _, caCert := range caCerts {
+		bag, err := certificateBag(caCert, nil)
+		if err != nil {
+			return nil, err
+		}
+		certBags = append(certBags, *bag)
+	}
+	certContents, err := asn1.Marshal(certBags)
+	if err != nil {
+		return nil, err
+	}
+	certInfo, err := encryptedContent(rand, certContents, bmpPassword)
+	if err != nil {
+		return nil, err
+	}
+
+	keyBag, err := shroudedKeyBag(rand, privateKey, bmpPassword, attributes)
+	if err != nil {
+		return nil, err
+	}
+	keyContents, err := asn1.Marshal([]safeBag{*keyBag})
+	if err != nil {
+		return nil, err
+	}
+	keyInfo, err := dataContent(keyContents)
+	if err != nil {
+		return nil, err
+	}
+
+	authenticatedSafe, err := asn1.Marshal([]contentInfo{*certInfo, *keyInfo})
+	if err != nil {
+		return nil, err
+	}
+	authSafe, err := dataContent(authenticatedSafe)
+	if err != nil {
+		return nil, err
+	}
+	pfx := pfxPdu{Version: 3, AuthSafe: *authSafe}
+	pfx.MacData.Iterations = iterations
+	pfx.MacData.MacSalt = make([]byte, saltSize)
+	if _, err := io.ReadFull(rand, pfx.MacData.MacSalt); err != nil {
+		return nil, err
+	}
+	macKey := pbkdf(bmpPassword, pfx.MacData.MacSalt, iterations, 3, sha1.Size)
+	mac := hmac.New(sha1.New, macKey)
+	mac.Write(authenticatedSafe)
+	pfx.MacData.Mac.Algorithm = pkix.AlgorithmIdentifier{Algorithm: oidSHA1, Parameters: asn1.NullRawValue}
+	pfx.MacData.Mac.Digest = mac.Sum(nil)
+	return asn1.Marshal(pfx)
+}
+
+// a password as a null terminated big endian UTF-16 string
+func bmpString(password string) ([]byte, error) {
+	encoded := make([]byte, 0, 2*len(password)+2)
+	for _, r := range password {
+		if r >= 0x10000 || utf16.IsSurrogate(r) {
+			return nil, errors.New("pkcs12: the password has a character outside the basic multilingual plane")
+		}
+		encoded = append(encoded, byte(r>>8), byte(r))
+	}
+	return append(encoded, 0, 0), nil
+}
+
+// the localKeyId which pairs the key with its certificate and the optional friendlyName
+func bagAttributes(localKeyID []byte, friendlyName string) ([]pkcs12Attribute, error) {
+	keyID, err := asn1.Marshal(localKeyID)
+	if err != nil {
+		return nil, err
+	}
+	attributes := []pkcs12Attribute{{ID: oidLocalKeyID, Value: setOf(keyID)}}
+	if friendlyName != "" {
+		name, err := bmpString(friendlyName)
+		if err != nil {
+			return nil, err
+		}
+		// a BMPString has no terminator
+		value, err := asn1.Marshal(asn1.RawValue{Tag: asn1.TagBMPString, Bytes: name[:len(name)-2]})
+		if err != nil {
+			return nil, err
+		}
+		attributes = append(attributes, pkcs12Attribute{ID: oidFriendlyName, Value: setOf(value)})
+	}
+	return attributes, nil
+}
+
+func setOf(der []byte) asn1.RawValue {
+	return asn1.RawValue{Tag: asn1.TagSet, IsCompound: true, Bytes: der}
+}
+
+// an explicitly tagged [0] value
+func explicit(der []byte) asn1.RawValue {
+	return asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: der}
+}
+
+func certificateBag(certificate *x509.Certificate, attributes []pkcs12Attribute) (*safeBag, error) {
+	bag, err := asn1.Marshal(certBag{ID: oidCertTypeX509Certificate, Data: certificate.Raw})
+	if err != nil {
+		return nil, err
+	}
+	return &safeBag{ID: oidCertBag, Value: explicit(bag), Attributes: attributes}, nil
+}
+
+func shroudedKeyBag(rand io.Reader, privateKey interface{}, password []byte,
+	attributes []pkcs12Attribute) (*safeBag, error) {
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	algorithm, encrypted, err := encrypt(rand, pkcs8, password)
+	if err != nil {
+		return nil, err
+	}
+	keyInfo, err := asn1.Marshal(encryptedPrivateKeyInfo{AlgorithmIdentifier: *algorithm, EncryptedData: encrypted})
+	if err != nil {
+		return nil, err
+	}
+	return &safeBag{ID: oidPKCS8ShroudedKeyBag, Value: explicit(keyInfo), Attributes: attributes}, nil
+}
+
+// a data content info, the content is an octet string
+func dataContent(content []byte) (*contentInfo, error) {
+	octets, err := asn1.Marshal(content)
+	if err != nil {
+		return nil, err
+	}
+	return &contentInfo{ContentType: oidDataContentType, Content: explicit(octets)}, nil
+}
+
+// an encrypted data content info
+func encryptedContent(rand io.Reader, content []byte, password []byte) (*contentInfo, error) {
+	algorithm, encrypted, err := encrypt(rand, content, password)
+	if err != nil {
+		return nil, err
+	}
+	data, err := asn1.Marshal(encryptedData{Version: 0, EncryptedContentInfo: encryptedContentInfo{
+		ContentType:                oidDataContentType,
+		ContentEncryptionAlgorithm: *algorithm,
+		EncryptedContent:           encrypted,
+	}})
+	if err != nil {
+		return nil, err
+	}
+	return &contentInfo{ContentType: oidEncryptedDataContentType, Content: explicit(data)}, nil
+}
+
+// encrypt with pbeWithSHAAnd3-KeyTripleDES-CBC and a random salt
+func encrypt(rand io.Reader, plaintext []byte, password []byte) (*pkix.AlgorithmIdentifier, []byte, error) {
+	params := pbeParams{Salt: make([]byte, saltSize), Iterations: iterations}
+	if _, err := io.ReadFull(rand, params.Salt); err != nil {
+		return nil, nil, err
+	}
+	paramsDER, err := asn1.Marshal(params)
+	if err != nil {
+		return nil, nil, err
+	}
+	block, err := des.NewTripleDESCipher(pbkdf(password, params.Salt, iterations, 1, 24))
+	if err != nil {
+		return nil, nil, err
+	}
+	iv := pbkdf(password, params.Salt, iterations, 2, block.BlockSize())
+	// PKCS#7 padding, a full block when the plaintext is aligned
+	padding := block.BlockSize() - len(plaintext)%block.BlockSize()
+	padded := make([]byte, len(plaintext), len(plaintext)+padding)
+	copy(padded, plaintext)
+	for i := 0; i < padding; i++ {
+		padded = append(padded, byte(padding))
+	}
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(padded, padded)
+	algorithm := &pkix.AlgorithmIdentifier{
+		Algorithm:  oidPBEWithSHAAnd3KeyTripleDESCBC,
+		Parameters: asn1.RawValue{FullBytes: paramsDER},
+	}
+	return algorithm, padded, nil
+}
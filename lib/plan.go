@@ -0,0 +1,193 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.cicd.cloud.fpdev.io/BD/bd-azure-smc-deployment/lib/arm"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+const (
+	PlanCreate   = "+"
+	PlanDelete   = "-"
+	PlanModify   = "~"
+	PlanNoChange = "="
+	PlanWarning  = "!"
+)
+
+// the status of the plan item events by symbol
+var planStatuses = map[string]string{
+	PlanCreate:   "create",
+	PlanDelete:   "delete",
+	PlanModify:   "modify",
+	PlanNoChange: "no-change",
+	PlanWarning:  "warning",
+}
+
+// PlanPrinter writes the human readable output of a --plan run, with Events set the items, parameters,
+// rules and what-if changes are reported as events of the section instead
+type PlanPrinter struct {
+	Out     io.Writer
+	Events  Reporter
+	section string
+}
+
+func (p *PlanPrinter) Section(title string) {
+	p.section = title
+	fmt.Fprintf(p.Out, "\n%s\n%s\n", title, strings.Repeat("-", len(title)))
+}
+
+func (p *PlanPrinter) Item(symbol string, format string, args ...interface{}) {
+	message := fmt.Sprintf(format, args...)
+	if p.Events != nil {
+		p.report(Event{Status: planStatus(symbol), Message: message})
+		return
+	}
+	fmt.Fprintf(p.Out, "  %s %s\n", symbol, message)
+}
+
+// report a plan item event of the section
+func (p *PlanPrinter) report(event Event) {
+	event.Type = EventPlanItem
+	event.Step = p.section
+	p.Events.Report(event)
+}
+
+func planStatus(symbol string) string {
+	if status, ok := planStatuses[symbol]; ok {
+		return status
+	}
+	return symbol
+}
+
+// print the template parameters sorted by name
+func (p *PlanPrinter) Parameters(parameters *Parameters) {
+	names := make([]string, 0, len(parameters.Parameters))
+	for name := range parameters.Parameters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		value := parameters.Parameters[name]["value"]
+		if p.Events != nil {
+			p.report(Event{ResourceType: "parameter", Resource: name, Message: name + " = " + planValue(value),
+				Fields: map[string]interface{}{"value": value}})
+			continue
+		}
+		fmt.Fprintf(p.Out, "    %s = %s\n", name, planValue(value))
+	}
+}
+
+// print the NSG rules as a table sorted by priority
+func (p *PlanPrinter) SecurityRules(rules []SecurityRule) {
+	sorted := append([]SecurityRule(nil), rules...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Properties.Priority < sorted[j].Properties.Priority
+	})
+	if p.Events != nil {
+		for _, rule := range sorted {
+			p.report(Event{ResourceType: "securityRule", Resource: rule.Name, Fields: map[string]interface{}{
+				"priority": rule.Properties.Priority,
+				"access":   rule.Properties.Access,
+				"protocol": rule.Properties.Protocol,
+				"ports":    rule.ports(),
+				"sources":  rule.sources(),
+			}})
+		}
+		return
+	}
+	w := tabwriter.NewWriter(p.Out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "    PRIORITY\tNAME\tACCESS\tPROTOCOL\tPORT\tSOURCES")
+	for _, rule := range sorted {
+		fmt.Fprintf(w, "    %d\t%s\t%s\t%s\t%s\t%s\n", rule.Properties.Priority, rule.Name, rule.Properties.Access,
+			rule.Properties.Protocol, strings.Join(rule.ports(), ","), strings.Join(rule.sources(), ","))
+	}
+	w.Flush()
+}
+
+var whatIfSymbols = map[string]string{
+	arm.ChangeCreate:      PlanCreate,
+	arm.ChangeDelete:      PlanDelete,
+	arm.ChangeModify:      PlanModify,
+	arm.ChangeNoChange:    PlanNoChange,
+	arm.ChangeDeploy:      PlanModify,
+	arm.ChangeIgnore:      "*",
+	arm.ChangeUnsupported: PlanWarning,
+}
+
+// print the resource changes of an ARM what-if, an event carries the change type, the unsupported
+// reason and the property changes of a resource
+func (p *PlanPrinter) WhatIf(result *arm.WhatIfResult) {
+	if len(result.Properties.Changes) == 0 {
+		p.Item(PlanNoChange, "the template makes no changes")
+	}
+	for _, change := range result.Properties.Changes {
+		symbol := whatIfSymbols[change.ChangeType]
+		if p.Events != nil {
+			fields := map[string]interface{}{"changeType": change.ChangeType}
+			if change.UnsupportedReason != "" {
+				fields["unsupportedReason"] = change.UnsupportedReason
+			}
+			if delta := p.propertyChangeFields(change.Delta, ""); len(delta) != 0 {
+				fields["delta"] = delta
+			}
+			p.report(Event{Status: planStatus(symbol), ResourceType: "resource", Resource: change.ResourceID,
+				Message: change.ChangeType + " " + change.ResourceID, Fields: fields})
+			continue
+		}
+		p.Item(symbol, "%s %s", change.ChangeType, change.ResourceID)
+		if change.UnsupportedReason != "" {
+			fmt.Fprintf(p.Out, "      %s\n", change.UnsupportedReason)
+		}
+		p.propertyChanges(change.Delta, 6)
+	}
+}
+
+func (p *PlanPrinter) propertyChanges(changes []arm.WhatIfPropertyChange, indent int) {
+	for _, change := range changes {
+		prefix := strings.Repeat(" ", indent)
+		symbol := whatIfSymbols[change.PropertyChangeType]
+		if change.PropertyChangeType == "Array" || len(change.Children) != 0 {
+			fmt.Fprintf(p.Out, "%s%s %s:\n", prefix, PlanModify, change.Path)
+			p.propertyChanges(change.Children, indent+2)
+			continue
+		}
+		if symbol == "" {
+			symbol = PlanModify
+		}
+		fmt.Fprintf(p.Out, "%s%s %s: %s => %s\n", prefix, symbol, change.Path,
+			planValue(change.Before), planValue(change.After))
+	}
+}
+
+// the property changes as a flat list, the path of a nested change is prefixed with the one of its parent
+func (p *PlanPrinter) propertyChangeFields(changes []arm.WhatIfPropertyChange, parent string) []map[string]interface{} {
+	var fields []map[string]interface{}
+	for _, change := range changes {
+		path := change.Path
+		if parent != "" {
+			path = parent + "." + path
+		}
+		if change.PropertyChangeType == "Array" || len(change.Children) != 0 {
+			fields = append(fields, p.propertyChangeFields(change.Children, path)...)
+			continue
+		}
+		fields = append(fields, map[string]interface{}{"path": path, "changeType": change.PropertyChangeType,
+			"before": change.Before, "after": change.After})
+	}
+	return fields
+}
+
+func planValue(value interface{}) string {
+	if value == nil {
+		return "(none)"
+	}
+	b, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	return string(b)
+}
@@ -0,0 +1,58 @@
+package lib
+
+import (
+	"bytes"
+	"github.cicd.cloud.fpdev.io/BD/bd-azure-smc-deployment/lib/arm"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+type recordingReporter struct {
+	events []Event
+}
+
+func (r *recordingReporter) Report(event Event) { r.events = append(r.events, event) }
+func (r *recordingReporter) Writer() io.Writer  { return ioutil.Discard }
+func (r *recordingReporter) Close()             {}
+
+func TestPlanPrinterEvents(t *testing.T) {
+	out := &bytes.Buffer{}
+	events := &recordingReporter{}
+	plan := &PlanPrinter{Out: out, Events: events}
+	plan.Section("NSG")
+	plan.Parameters(&Parameters{Parameters: map[string]map[string]interface{}{"domainName": {"value": "example.com"}}})
+	plan.SecurityRules([]SecurityRule{{Name: "AllowLDAPS", Properties: SecurityRuleProperties{Protocol: "Tcp",
+		DestinationPortRange: "636", SourceAddressPrefix: "10.0.0.1", Access: "Allow", Priority: 401}}})
+	result := &arm.WhatIfResult{}
+	result.Properties.Changes = []arm.WhatIfChange{{ResourceID: "/nsg", ChangeType: arm.ChangeUnsupported,
+		UnsupportedReason: "a nested template", Delta: []arm.WhatIfPropertyChange{{Path: "properties",
+			PropertyChangeType: arm.ChangeModify, Children: []arm.WhatIfPropertyChange{{Path: "priority",
+				PropertyChangeType: arm.ChangeModify, Before: 400, After: 401}}}}}}
+	plan.WhatIf(result)
+	if out.String() != "\nNSG\n---\n" {
+		t.Errorf("the plan wrote %q besides the events", out.String())
+	}
+	if len(events.events) != 3 {
+		t.Fatalf("the plan reported %d events, want 3", len(events.events))
+	}
+	for _, event := range events.events {
+		if event.Type != EventPlanItem || event.Step != "NSG" {
+			t.Errorf("the event %+v is not a plan item of the section", event)
+		}
+	}
+	if value := events.events[0].Fields["value"]; value != "example.com" {
+		t.Errorf("the parameter event has the value %v", value)
+	}
+	if priority := events.events[1].Fields["priority"]; priority != 401 {
+		t.Errorf("the security rule event has the priority %v", priority)
+	}
+	change := events.events[2]
+	if change.Status != "warning" || change.Fields["unsupportedReason"] != "a nested template" {
+		t.Errorf("the what-if event is %+v", change)
+	}
+	delta, _ := change.Fields["delta"].([]map[string]interface{})
+	if len(delta) != 1 || delta[0]["path"] != "properties.priority" || delta[0]["after"] != 401 {
+		t.Errorf("the what-if event has the delta %v", delta)
+	}
+}
@@ -0,0 +1,285 @@
+package lib
+
+import (
+	"encoding/json"
+	"github.cicd.cloud.fpdev.io/BD/bd-azure-smc-deployment/lib/arm"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// a resource of the template without any operation yet
+	ResourceWaiting = "Waiting"
+
+	// how many durations are kept per resource type in the history file
+	historySize = 10
+)
+
+// the durations used for the estimate when the history has none for a resource type
+var defaultDurations = map[string]time.Duration{
+	strings.ToLower(NetworkSecurityGroupType):        30 * time.Second,
+	strings.ToLower(VirtualNetworkType):              30 * time.Second,
+	strings.ToLower(VirtualNetworkType + "/subnets"): 30 * time.Second,
+	strings.ToLower(DomainServicesType):              50 * time.Minute,
+}
+
+// the progress of one resource of the template
+type ResourceProgress struct {
+	Type     string
+	Name     string
+	State    string
+	Elapsed  time.Duration
+	Expected time.Duration
+}
+
+func (r *ResourceProgress) Done() bool {
+	return r.State == arm.StateSucceeded || r.State == arm.StateFailed || r.State == arm.StateCanceled
+}
+
+// DeploymentProgress is a snapshot of a running template deployment built from its operations
+type DeploymentProgress struct {
+	State     string
+	Resources []ResourceProgress
+	Elapsed   time.Duration
+	Remaining time.Duration
+	Err       error
+}
+
+// the part of the expected total duration which is done, between 0 and 1
+func (p *DeploymentProgress) Fraction() float64 {
+	total := p.Elapsed + p.Remaining
+	if p.Done() || total == 0 {
+		return 1
+	}
+	return float64(p.Elapsed) / float64(total)
+}
+
+func (p *DeploymentProgress) Done() bool {
+	return p.State == arm.StateSucceeded || p.State == arm.StateFailed || p.State == arm.StateCanceled
+}
+
+// the resource currently deployed, nil when none is running
+func (p *DeploymentProgress) Current() *ResourceProgress {
+	for i := range p.Resources {
+		if !p.Resources[i].Done() && p.Resources[i].State != ResourceWaiting {
+			return &p.Resources[i]
+		}
+	}
+	return nil
+}
+
+// the durations of previous deployments per resource type
+type deploymentHistory map[string][]time.Duration
+
+func loadHistory() deploymentHistory {
+	history := make(deploymentHistory)
+	b, err := ioutil.ReadFile(viper.GetString("DEPLOYMENT_HISTORY_FILE"))
+	if err != nil {
+		return history
+	}
+	// a broken history only makes the estimate less accurate
+	_ = json.Unmarshal(b, &history)
+	return history
+}
+
+// the average duration of a resource type
+func (h deploymentHistory) expected(resourceType string) time.Duration {
+	durations := h[strings.ToLower(resourceType)]
+	if len(durations) == 0 {
+		if duration, ok := defaultDurations[strings.ToLower(resourceType)]; ok {
+			return duration
+		}
+		return time.Minute
+	}
+	var total time.Duration
+	for _, duration := range durations {
+		total += duration
+	}
+	return total / time.Duration(len(durations))
+}
+
+// record the durations of the resources of a succeeded deployment
+func (h deploymentHistory) save(progress *DeploymentProgress) error {
+	for _, resource := range progress.Resources {
+		if resource.State != arm.StateSucceeded {
+			continue
+		}
+		key := strings.ToLower(resource.Type)
+		h[key] = append(h[key], resource.Elapsed)
+		if len(h[key]) > historySize {
+			h[key] = h[key][len(h[key])-historySize:]
+		}
+	}
+	b, err := json.MarshalIndent(h, "", " ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(viper.GetString("DEPLOYMENT_HISTORY_FILE"), b, 0644); err != nil {
+		return errors.Wrap(err, "failed in writing the deployment history")
+	}
+	return nil
+}
+
+// the resource types of the template in deployment order, nested resources are prefixed with their parent type
+func templateResourceTypes(template []byte) ([]string, error) {
+	type templateResource struct {
+		Type      string             `json:"type"`
+		Resources []templateResource `json:"resources"`
+	}
+	var parsed struct {
+		Resources []templateResource `json:"resources"`
+	}
+	if err := json.Unmarshal(template, &parsed); err != nil {
+		return nil, errors.Wrap(err, "failed in decoding the deployment template")
+	}
+	var types []string
+	var walk func(parent string, resources []templateResource)
+	walk = func(parent string, resources []templateResource) {
+		for _, resource := range resources {
+			resourceType := resource.Type
+			if parent != "" {
+				resourceType = parent + "/" + resourceType
+			}
+			types = append(types, resourceType)
+			walk(resourceType, resource.Resources)
+		}
+	}
+	walk("", parsed.Resources)
+	return types, nil
+}
+
+// the template does not deploy the network into an existing subnet
+func withoutNetworkTypes(resourceTypes []string) []string {
+	var types []string
+	for _, resourceType := range resourceTypes {
+		if !strings.HasPrefix(strings.ToLower(resourceType), "microsoft.network/") {
+			types = append(types, resourceType)
+		}
+	}
+	return types
+}
+
+// build the progress of a deployment from its operations, resources of the template without
+// an operation yet are waiting
+func buildProgress(deployment *arm.Deployment, operations []arm.DeploymentOperation, resourceTypes []string,
+	history deploymentHistory, now time.Time) *DeploymentProgress {
+	progress := &DeploymentProgress{State: deployment.Properties.ProvisioningState}
+	if duration, err := arm.ParseDuration(deployment.Properties.Duration); err == nil {
+		progress.Elapsed = duration
+	}
+	// the latest operation of every resource type
+	latest := make(map[string]arm.DeploymentOperation)
+	for _, operation := range operations {
+		target := operation.Properties.TargetResource
+		if target == nil {
+			continue
+		}
+		key := strings.ToLower(target.ResourceType)
+		if previous, ok := latest[key]; !ok || operation.Properties.Timestamp.After(previous.Properties.Timestamp) {
+			latest[key] = operation
+		}
+	}
+	for _, resourceType := range resourceTypes {
+		resource := ResourceProgress{Type: resourceType, State: ResourceWaiting, Expected: history.expected(resourceType)}
+		if operation, ok := latest[strings.ToLower(resourceType)]; ok {
+			resource.Name = operation.Properties.TargetResource.ResourceName
+			resource.State = operation.Properties.ProvisioningState
+			if duration, err := arm.ParseDuration(operation.Properties.Duration); err == nil {
+				resource.Elapsed = duration
+			}
+			if !resource.Done() && !operation.Properties.Timestamp.IsZero() {
+				if elapsed := now.Sub(operation.Properties.Timestamp) + resource.Elapsed; elapsed > 0 {
+					resource.Elapsed = elapsed
+				}
+			}
+		}
+		if !resource.Done() && resource.Expected > resource.Elapsed {
+			progress.Remaining += resource.Expected - resource.Elapsed
+		}
+		progress.Resources = append(progress.Resources, resource)
+	}
+	return progress
+}
+
+// wait until ARM reports the submitted deployment, instead of sleeping for a fixed time
+func (a *AzureCLI) WaitForDeployment(name string, timeout time.Duration) error {
+	client, err := a.ArmClient()
+	if err != nil {
+		return err
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		_, err := client.GetDeployment(viper.GetString("RESOURCE_GROUP"), name)
+		if err == nil {
+			return nil
+		}
+		if !arm.IsStatus(err, http.StatusNotFound) {
+			return err
+		}
+		if time.Now().After(deadline) {
+			return errors.New("the deployment " + name + " is not visible in azure after " + timeout.String())
+		}
+		time.Sleep(5 * time.Second)
+	}
+}
+
+// read the current progress of a deployment
+func (a *AzureCLI) DeploymentProgress(name string) (*DeploymentProgress, error) {
+	client, err := a.ArmClient()
+	if err != nil {
+		return nil, err
+	}
+	template, err := readTemplate()
+	if err != nil {
+		return nil, err
+	}
+	resourceTypes, err := templateResourceTypes(template)
+	if err != nil {
+		return nil, err
+	}
+	if ExistingVnet() {
+		resourceTypes = withoutNetworkTypes(resourceTypes)
+	}
+	resourceGroup := viper.GetString("RESOURCE_GROUP")
+	deployment, err := client.GetDeployment(resourceGroup, name)
+	if err != nil {
+		return nil, err
+	}
+	operations, err := client.ListDeploymentOperations(resourceGroup, name)
+	if err != nil {
+		return nil, err
+	}
+	return buildProgress(deployment, operations, resourceTypes, loadHistory(), time.Now()), nil
+}
+
+// poll the deployment every interval, the channel is closed after the deployment is finished or
+// reading it failed. The durations of a succeeded deployment are added to the history
+func (a *AzureCLI) MonitorDeployment(name string, interval time.Duration) <-chan *DeploymentProgress {
+	progressChan := make(chan *DeploymentProgress)
+	go func() {
+		defer close(progressChan)
+		for {
+			progress, err := a.DeploymentProgress(name)
+			if err != nil {
+				progressChan <- &DeploymentProgress{Err: err}
+				return
+			}
+			progressChan <- progress
+			if progress.Done() {
+				if progress.State == arm.StateSucceeded {
+					if err := loadHistory().save(progress); err != nil {
+						logrus.Error(err)
+					}
+				}
+				return
+			}
+			time.Sleep(interval)
+		}
+	}()
+	return progressChan
+}
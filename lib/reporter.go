@@ -0,0 +1,232 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/cheggaaa/pb/v3"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh/terminal"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	OutputAuto = "auto"
+	OutputBar  = "bar"
+	OutputText = "text"
+	OutputJSON = "json"
+)
+
+const (
+	EventStepStarted    = "step_started"
+	EventStepFinished   = "step_finished"
+	EventStepSkipped    = "step_skipped"
+	EventStepFailed     = "step_failed"
+	EventResourceStatus = "resource_status"
+	EventProgress       = "progress"
+	EventPlanItem       = "plan_item"
+	EventDeviceCode     = "device_code"
+	EventPhaseResult    = "phase_result"
+)
+
+// Event is one thing that happened during a command, the JSON renderer writes it as is
+type Event struct {
+	Time             time.Time `json:"time"`
+	Type             string    `json:"type"`
+	Step             string    `json:"step,omitempty"`
+	ResourceType     string    `json:"resourceType,omitempty"`
+	Resource         string    `json:"resource,omitempty"`
+	Status           string    `json:"status,omitempty"`
+	Message          string    `json:"message,omitempty"`
+	Error            string    `json:"error,omitempty"`
+	ElapsedSeconds   float64   `json:"elapsedSeconds,omitempty"`
+	RemainingSeconds float64   `json:"remainingSeconds,omitempty"`
+	Percent          float64   `json:"percent,omitempty"`
+	// the structured details of a plan item or the outputs of a phase
+	Fields map[string]interface{} `json:"fields,omitempty"`
+}
+
+// Reporter renders the events of a command
+type Reporter interface {
+	Report(event Event)
+	// Writer is where human readable output such as tables goes, it discards everything
+	// when the output is machine readable
+	Writer() io.Writer
+	// Close finishes the rendering, it is safe to call it more than once
+	Close()
+}
+
+// create the reporter of an output mode, auto is the bar on a terminal and text otherwise
+func NewReporter(output string, out *os.File) (Reporter, error) {
+	switch output {
+	case OutputAuto, "":
+		if terminal.IsTerminal(int(out.Fd())) {
+			return &barReporter{out: out}, nil
+		}
+		return &textReporter{out: out}, nil
+	case OutputBar:
+		return &barReporter{out: out}, nil
+	case OutputText:
+		return &textReporter{out: out}, nil
+	case OutputJSON:
+		return &jsonReporter{encoder: json.NewEncoder(out)}, nil
+	}
+	return nil, fmt.Errorf("unknown output '%s', expected one of: %s", output,
+		strings.Join([]string{OutputAuto, OutputBar, OutputText, OutputJSON}, ", "))
+}
+
+// report an event on a reporter which may be nil
+func report(reporter Reporter, event Event) {
+	if reporter != nil {
+		reporter.Report(event)
+	}
+}
+
+// events without a time happened now
+func (e *Event) stamp() {
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+}
+
+// the progress event of a deployment snapshot
+func ProgressEvent(progress *DeploymentProgress) Event {
+	event := Event{
+		Type:             EventProgress,
+		Status:           progress.State,
+		ElapsedSeconds:   progress.Elapsed.Seconds(),
+		RemainingSeconds: progress.Remaining.Seconds(),
+		Percent:          progress.Fraction() * 100,
+	}
+	if current := progress.Current(); current != nil {
+		event.ResourceType = current.Type
+		event.Resource = current.Name
+		event.Message = fmt.Sprintf("%s %s", current.State, current.Elapsed.Round(time.Second))
+	}
+	return event
+}
+
+// a one line description of an event
+func describe(event Event) string {
+	var parts []string
+	switch {
+	case event.Step != "":
+		parts = append(parts, "step "+event.Step)
+	case event.ResourceType != "" || event.Resource != "":
+		parts = append(parts, strings.TrimSpace(event.ResourceType+" "+event.Resource))
+	}
+	if event.Status != "" {
+		parts = append(parts, event.Status)
+	}
+	if event.Type == EventProgress {
+		parts = append(parts, fmt.Sprintf("%.0f%%, elapsed %s, about %s left", event.Percent,
+			seconds(event.ElapsedSeconds).Round(time.Second), seconds(event.RemainingSeconds).Round(time.Minute)))
+	} else if event.ElapsedSeconds != 0 {
+		parts = append(parts, "after "+seconds(event.ElapsedSeconds).Round(time.Second).String())
+	}
+	if event.Message != "" {
+		parts = append(parts, event.Message)
+	}
+	if event.Error != "" {
+		parts = append(parts, event.Error)
+	}
+	return strings.Join(parts, ": ")
+}
+
+func seconds(value float64) time.Duration {
+	return time.Duration(value * float64(time.Second))
+}
+
+// the interactive renderer, deployment progress is drawn as a bar and the other events are logged
+type barReporter struct {
+	out  io.Writer
+	bar  *pb.ProgressBar
+	lock sync.Mutex
+}
+
+func (r *barReporter) Report(event Event) {
+	event.stamp()
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if event.Type != EventProgress {
+		if event.Type == EventStepFailed {
+			logrus.Error(describe(event))
+		} else {
+			logrus.Info(describe(event))
+		}
+		return
+	}
+	if r.bar == nil {
+		tmpl := `{{ red "Deploying:" }} {{ bar . "┣" "┃" (cycle . "↖" "↗" "↘" "↙" ) "." "┫"}}  {{percent . | rndcolor }} {{string . "status"}}`
+		// the bar counts per mille of the expected duration
+		r.bar = pb.ProgressBarTemplate(tmpl).Start(1000)
+	}
+	status := fmt.Sprintf("elapsed %s, about %s left", seconds(event.ElapsedSeconds).Round(time.Second),
+		seconds(event.RemainingSeconds).Round(time.Minute))
+	if event.ResourceType != "" {
+		status = fmt.Sprintf("%s %s, %s", event.ResourceType, event.Message, status)
+	}
+	r.bar.Set("status", status)
+	r.bar.SetCurrent(int64(event.Percent * 10))
+	if event.Percent >= 100 {
+		r.bar.Finish()
+		r.bar = nil
+	}
+}
+
+func (r *barReporter) Writer() io.Writer {
+	return r.out
+}
+
+func (r *barReporter) Close() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.bar != nil {
+		r.bar.Finish()
+		r.bar = nil
+	}
+}
+
+// the plain renderer, one line per event
+type textReporter struct {
+	out  io.Writer
+	lock sync.Mutex
+}
+
+func (r *textReporter) Report(event Event) {
+	event.stamp()
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	fmt.Fprintf(r.out, "%s %s %s\n", event.Time.Format(time.RFC3339), event.Type, describe(event))
+}
+
+func (r *textReporter) Writer() io.Writer {
+	return r.out
+}
+
+func (r *textReporter) Close() {}
+
+// the machine readable renderer, one JSON event per line
+type jsonReporter struct {
+	encoder *json.Encoder
+	lock    sync.Mutex
+}
+
+func (r *jsonReporter) Report(event Event) {
+	event.stamp()
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if err := r.encoder.Encode(event); err != nil {
+		logrus.Error(err)
+	}
+}
+
+func (r *jsonReporter) Writer() io.Writer {
+	return ioutil.Discard
+}
+
+func (r *jsonReporter) Close() {}
@@ -0,0 +1,77 @@
+package lib
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+const (
+	DefaultGrantedDomain = "Shared Domain"
+	// not an SMC role but the superuser flag of an SMC admin
+	SuperuserRole = "Superuser"
+)
+
+// RoleMapping links an Azure AD group to the SMC role its members get in a granted domain.
+// A group given by its object id is an existing group and is never created or deleted
+type RoleMapping struct {
+	Group   string `mapstructure:"GROUP"`
+	GroupID string `mapstructure:"GROUP_ID"`
+	Role    string `mapstructure:"ROLE"`
+	Domain  string `mapstructure:"DOMAIN"`
+}
+
+// the SMC roles used when the config has no ROLE_MAPPINGS, every group is named after its role
+var defaultRoles = []string{"Operator", "Editor", "Reports Manager", "Superuser", "Owner",
+	"NSX Role", "Viewer", "Monitor", "Logs Viewer"}
+
+// the display name of the Azure AD group, with the GROUP_PREFIX of the config
+func (m RoleMapping) GroupName() string {
+	return viper.GetString("GROUP_PREFIX") + m.Group
+}
+
+// whether the SMC admins of the role mappings are wanted, the default mappings only apply with
+// CREATE_GROUPS_SMC since the groups they map do not exist otherwise
+func RoleMappingsConfigured() bool {
+	return viper.IsSet("ROLE_MAPPINGS") || viper.GetBool("CREATE_GROUPS_SMC")
+}
+
+// read the ROLE_MAPPINGS section of the config
+func RoleMappings() ([]RoleMapping, error) {
+	var mappings []RoleMapping
+	if err := viper.UnmarshalKey("ROLE_MAPPINGS", &mappings); err != nil {
+		return nil, errors.Wrap(err, "failed in reading ROLE_MAPPINGS")
+	}
+	if len(mappings) == 0 {
+		for _, role := range defaultRoles {
+			mappings = append(mappings, RoleMapping{Group: role, Role: role})
+		}
+	}
+	for i := range mappings {
+		if mappings[i].Group == "" && mappings[i].GroupID == "" {
+			return nil, fmt.Errorf("the role mapping %d has neither a GROUP nor a GROUP_ID", i+1)
+		}
+		if mappings[i].Role == "" {
+			return nil, fmt.Errorf("the role mapping of the group '%s%s' has no ROLE", mappings[i].Group,
+				mappings[i].GroupID)
+		}
+		if mappings[i].Domain == "" {
+			mappings[i].Domain = DefaultGrantedDomain
+		}
+	}
+	return mappings, nil
+}
+
+// the names of the groups the tool creates, groups given by object id are left out
+func ManagedGroupNames(mappings []RoleMapping) []string {
+	var names []string
+	seen := make(map[string]bool)
+	for _, mapping := range mappings {
+		if mapping.GroupID != "" || seen[mapping.GroupName()] {
+			continue
+		}
+		seen[mapping.GroupName()] = true
+		names = append(names, mapping.GroupName())
+	}
+	return names
+}
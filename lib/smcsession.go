@@ -0,0 +1,194 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// the SMC element type of a trusted certificate authority
+	SmcTrustedCAType = "tls_certificate_authority"
+	// the SMC element type of an external LDAP user domain
+	SmcLdapDomainType = "external_ldap_user_domain"
+	// the SMC element type of an Active Directory server
+	SmcActiveDirectoryType = "active_directory_server"
+)
+
+// SmcSession is a minimal SMC API session for the calls fp-smc-golang does not offer,
+// such as deleting elements
+type SmcSession struct {
+	Hostname   string
+	Port       string
+	APIVersion string
+	AccessKey  string
+	cookie     string
+	client     *http.Client
+}
+
+func (s *SmcSession) baseUrl() string {
+	return fmt.Sprintf("http://%s:%s/%s", s.Hostname, s.Port, s.APIVersion)
+}
+
+// login to SMC and keep the session cookie
+func (s *SmcSession) Login() error {
+	if s.cookie != "" {
+		return nil
+	}
+	if s.client == nil {
+		s.client = &http.Client{Timeout: 60 * time.Second}
+	}
+	body, _ := json.Marshal(map[string]string{
+		"domain":            "Shared Domain",
+		"authenticationkey": s.AccessKey,
+	})
+	resp, err := s.client.Post(s.baseUrl()+"/login", "application/json", bytes.NewBuffer(body))
+	if err != nil {
+		return errors.Wrap(err, "An error occurs during login process")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected http status %d received", resp.StatusCode)
+	}
+	setCookie := resp.Header.Get("Set-Cookie")
+	if setCookie == "" {
+		return errors.New("login response does not contain any cookies")
+	}
+	s.cookie = strings.Split(setCookie, ";")[0]
+	return nil
+}
+
+// terminate the session
+func (s *SmcSession) Logout() error {
+	if s.cookie == "" {
+		return nil
+	}
+	if _, err := s.request(http.MethodPut, s.baseUrl()+"/logout", nil, nil); err != nil {
+		return err
+	}
+	s.cookie = ""
+	return nil
+}
+
+func (s *SmcSession) request(method string, url string, body []byte, headers map[string]string) (*http.Response, error) {
+	req, err := http.NewRequest(method, url, bytes.NewBuffer(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Cookie", s.cookie)
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	// the body is kept in memory so that callers can read it after the connection is released
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(b))
+	if resp.StatusCode >= http.StatusBadRequest {
+		return resp, fmt.Errorf("SMC returned http status %d for %s %s: %s", resp.StatusCode, method, url,
+			strings.TrimSpace(string(b)))
+	}
+	return resp, nil
+}
+
+// the href of the element of a type with the name, empty when there is none
+func (s *SmcSession) FindElement(elementType string, name string) (string, error) {
+	resp, err := s.request(http.MethodGet, s.baseUrl()+"/elements/"+elementType+"?filter="+url.QueryEscape(name),
+		nil, nil)
+	if err != nil {
+		return "", err
+	}
+	var found struct {
+		Result []struct {
+			Href string `json:"href"`
+			Name string `json:"name"`
+		} `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&found); err != nil {
+		return "", errors.Wrap(err, "failed in decoding the SMC elements")
+	}
+	// the filter also matches names which only contain the name
+	for _, element := range found.Result {
+		if element.Name == name {
+			return element.Href, nil
+		}
+	}
+	return "", nil
+}
+
+// create an element of a type, it returns the href of the new element
+func (s *SmcSession) CreateElement(elementType string, element interface{}) (string, error) {
+	body, err := json.Marshal(element)
+	if err != nil {
+		return "", err
+	}
+	resp, err := s.request(http.MethodPost, s.baseUrl()+"/elements/"+elementType, body, nil)
+	if err != nil {
+		return "", err
+	}
+	return resp.Header.Get("Location"), nil
+}
+
+// delete an element by its href
+func (s *SmcSession) Delete(href string) error {
+	resp, err := s.request(http.MethodGet, href, nil, nil)
+	if err != nil {
+		return err
+	}
+	headers := map[string]string{}
+	if etag := resp.Header.Get("Etag"); etag != "" {
+		headers["If-Match"] = etag
+	}
+	_, err = s.request(http.MethodDelete, href, nil, headers)
+	return err
+}
+
+// change some attributes of an element, the other attributes are kept as they are
+func (s *SmcSession) UpdateElement(href string, attributes map[string]interface{}) error {
+	resp, err := s.request(http.MethodGet, href, nil, nil)
+	if err != nil {
+		return err
+	}
+	element := make(map[string]interface{})
+	if err := json.NewDecoder(resp.Body).Decode(&element); err != nil {
+		return errors.Wrap(err, "failed in decoding the SMC element")
+	}
+	for key, value := range attributes {
+		element[key] = value
+	}
+	body, err := json.Marshal(element)
+	if err != nil {
+		return err
+	}
+	headers := map[string]string{}
+	if etag := resp.Header.Get("Etag"); etag != "" {
+		headers["If-Match"] = etag
+	}
+	_, err = s.request(http.MethodPut, href, body, headers)
+	return err
+}
+
+// read an element into out
+func (s *SmcSession) GetElement(href string, out interface{}) error {
+	resp, err := s.request(http.MethodGet, href, nil, nil)
+	if err != nil {
+		return err
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return errors.Wrap(err, "failed in decoding the SMC element")
+	}
+	return nil
+}
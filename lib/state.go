@@ -0,0 +1,174 @@
+package lib
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	StepCompleted = "completed"
+	StepFailed    = "failed"
+)
+
+// the recorded result of one deployment step
+type StepState struct {
+	Name       string            `json:"name"`
+	InputsHash string            `json:"inputsHash"`
+	Status     string            `json:"status"`
+	Results    map[string]string `json:"results,omitempty"`
+	Error      string            `json:"error,omitempty"`
+	UpdatedAt  time.Time         `json:"updatedAt"`
+}
+
+// DeploymentState is the local checkpoint file of a deployment, a rerun skips every step
+// which completed with the same inputs
+type DeploymentState struct {
+	// the tenant and the subscription the steps ran in
+	Scope []string              `json:"scope,omitempty"`
+	Steps map[string]*StepState `json:"steps"`
+	// Reporter receives the step events, it can be nil
+	Reporter Reporter `json:"-"`
+	path     string
+	lock     sync.Mutex
+}
+
+// load the state file, a missing file is an empty state
+func LoadState(path string) (*DeploymentState, error) {
+	state := &DeploymentState{Steps: make(map[string]*StepState), path: path}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed in reading the state file")
+	}
+	if err := json.Unmarshal(b, state); err != nil {
+		return nil, errors.Wrap(err, "failed in decoding the state file "+path)
+	}
+	if state.Steps == nil {
+		state.Steps = make(map[string]*StepState)
+	}
+	return state, nil
+}
+
+// a stable hash of the inputs of a step
+func HashInputs(inputs ...interface{}) string {
+	b, err := json.Marshal(inputs)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// bind the state to a tenant and a subscription, the steps recorded for another one are forgotten
+// so that nothing of the other deployment is skipped or reused
+func (s *DeploymentState) SetScope(scope ...string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if len(s.Steps) != 0 && s.Scope != nil && HashInputs(s.Scope) != HashInputs(scope) {
+		logrus.Warnf("The state file %s belongs to another tenant or subscription, its steps run again", s.path)
+		s.Steps = make(map[string]*StepState)
+	}
+	s.Scope = scope
+}
+
+// forget all recorded steps
+func (s *DeploymentState) Reset() error {
+	s.lock.Lock()
+	s.Steps = make(map[string]*StepState)
+	s.lock.Unlock()
+	return s.save()
+}
+
+// forget a step so the next run executes it again
+func (s *DeploymentState) Forget(name string) {
+	s.lock.Lock()
+	delete(s.Steps, name)
+	s.lock.Unlock()
+	if err := s.save(); err != nil {
+		logrus.Error(err)
+	}
+}
+
+func (s *DeploymentState) save() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	b, err := json.MarshalIndent(s, "", " ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(s.path, b, 0600); err != nil {
+		return errors.Wrap(err, "failed in writing the state file")
+	}
+	return nil
+}
+
+// the results of a step when it already completed with the same inputs
+func (s *DeploymentState) Completed(name string, inputsHash string) (map[string]string, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	step, ok := s.Steps[name]
+	if !ok || step.Status != StepCompleted || step.InputsHash != inputsHash {
+		return nil, false
+	}
+	return step.Results, true
+}
+
+// the results of the last run of a step, whatever its status
+func (s *DeploymentState) Results(name string) map[string]string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if step, ok := s.Steps[name]; ok && step.Results != nil {
+		return step.Results
+	}
+	return map[string]string{}
+}
+
+func (s *DeploymentState) record(name string, inputsHash string, results map[string]string, stepErr error) error {
+	step := &StepState{
+		Name:       name,
+		InputsHash: inputsHash,
+		Status:     StepCompleted,
+		Results:    results,
+		UpdatedAt:  time.Now().UTC(),
+	}
+	if stepErr != nil {
+		step.Status = StepFailed
+		step.Error = stepErr.Error()
+	}
+	s.lock.Lock()
+	s.Steps[name] = step
+	s.lock.Unlock()
+	return s.save()
+}
+
+// run a step unless it already completed with the same inputs, its results and status are recorded
+func (s *DeploymentState) RunStep(name string, inputs interface{},
+	step func() (map[string]string, error)) (map[string]string, error) {
+	inputsHash := HashInputs(s.Scope, inputs)
+	if results, ok := s.Completed(name, inputsHash); ok {
+		report(s.Reporter, Event{Type: EventStepSkipped, Step: name, Message: "already completed"})
+		return results, nil
+	}
+	report(s.Reporter, Event{Type: EventStepStarted, Step: name})
+	started := time.Now()
+	results, err := step()
+	if saveErr := s.record(name, inputsHash, results, err); saveErr != nil {
+		logrus.Error(saveErr)
+	}
+	if err != nil {
+		report(s.Reporter, Event{Type: EventStepFailed, Step: name, Error: err.Error(),
+			ElapsedSeconds: time.Since(started).Seconds()})
+	} else {
+		report(s.Reporter, Event{Type: EventStepFinished, Step: name, ElapsedSeconds: time.Since(started).Seconds()})
+	}
+	return results, err
+}
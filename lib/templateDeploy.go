@@ -1,34 +1,30 @@
 package lib
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"github.cicd.cloud.fpdev.io/BD/bd-azure-smc-deployment/lib/arm"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 	"golang.org/x/crypto/ssh/terminal"
 	"io/ioutil"
-	"os/exec"
 	"strings"
 	"syscall"
 	"time"
 )
 
-const (
-	CommandFailed       = -1
-	FailedDeployment    = -2
-	RunningDeployment   = 1
-	SucceededDeployment = 0
-)
-
 type Parameters struct {
-	Schema         string                       `json:"$schema"`
-	ContentVersion string                       `json:"contentVersion"`
-	Parameters     map[string]map[string]string `json:"parameters"`
+	Schema         string                            `json:"$schema"`
+	ContentVersion string                            `json:"contentVersion"`
+	Parameters     map[string]map[string]interface{} `json:"parameters"`
 }
 
-func (p *Parameters) AddParameter(name string, value string) {
-	parameter := make(map[string]string)
+// add a parameter, the value is a string, number, bool, array or object like in the template
+func (p *Parameters) AddParameter(name string, value interface{}) {
+	parameter := make(map[string]interface{})
 	parameter["value"] = value
 	p.Parameters[name] = parameter
 }
@@ -44,69 +40,74 @@ func (p *Parameters) ToJson(filePath string) error {
 	return nil
 }
 
-func MonitorDeployment() <-chan int {
-	time.Sleep(10 * time.Second)
-	chnl := make(chan int)
-	go func() {
+// a unique name for a template deployment: the DEPLOYMENT_NAME_PREFIX, or the template file name
+// without extension, followed by the UTC time and a short random id
+func NewDeploymentName() string {
+	prefix := viper.GetString("DEPLOYMENT_NAME_PREFIX")
+	if prefix == "" {
 		parts := strings.Split(viper.GetString("DEPLOYMENT_TEMPLATE"), "/")
-		deplyName := parts[len(parts)-1]
-		parts = strings.Split(deplyName, ".")
-		viper.Set("templateName", parts[0])
-		c := fmt.Sprintf("az group deployment operation list --resource-group %s --name %s 2> /dev/null | grep provisioningState | awk  '{print $NF}' | tr -d \"\n\"",
-			viper.GetString("RESOURCE_GROUP"),
-			viper.GetString("templateName"))
-		for {
+		prefix = strings.Split(parts[len(parts)-1], ".")[0]
+	}
+	id := make([]byte, 3)
+	if _, err := rand.Read(id); err != nil {
+		logrus.Error(err)
+	}
+	suffix := fmt.Sprintf("-%s-%s", time.Now().UTC().Format("20060102-150405"), hex.EncodeToString(id))
+	// ARM limits deployment names to 64 characters
+	if len(prefix)+len(suffix) > 64 {
+		prefix = prefix[:64-len(suffix)]
+	}
+	return prefix + suffix
+}
 
-			cmd := exec.Command("sh", "-c", c)
-			output, err := cmd.CombinedOutput()
-			if err != nil {
-				chnl <- CommandFailed
-			}
-			outputParts := strings.Split(string(output), ",")
-			running := false
-			failed := false
-			for _, v := range outputParts {
-				if v == "\"Running\"" {
-					running = true
-				}
-				if v == "\"Failed\"" {
-					failed = true
-				}
-			}
-			if failed {
-				chnl <- FailedDeployment
-				break
-			} else if running {
-				chnl <- RunningDeployment
-			} else {
-				chnl <- SucceededDeployment
-				break
-			}
-		}
-		close(chnl)
-	}()
-	return chnl
+func readTemplate() ([]byte, error) {
+	template, err := ioutil.ReadFile(viper.GetString("DEPLOYMENT_TEMPLATE"))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed in reading the deployment template")
+	}
+	return template, nil
 }
 
-func ReadError() ([]byte, error) {
-	c := fmt.Sprintf("az group deployment show --resource-group %s --name %s 2> /dev/null | grep error | grep message",
-		viper.GetString("RESOURCE_GROUP"),
-		viper.GetString("templateName"))
-	cmd := exec.Command("sh", "-c", c)
-	output, err := cmd.CombinedOutput()
+// preview the changes the deployment template would make to the resource group
+func (a *AzureCLI) WhatIfTemplate(name string, parameters *Parameters) (*arm.WhatIfResult, error) {
+	client, err := a.ArmClient()
+	if err != nil {
+		return nil, err
+	}
+	template, err := readTemplate()
 	if err != nil {
 		return nil, err
 	}
-	return output, nil
+	result, err := client.WhatIf(viper.GetString("RESOURCE_GROUP"), name, template, parameters.Parameters)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed in running the what-if of the template deployment")
+	}
+	return result, nil
+}
+
+// submit the deployment template with the given parameters to the resource group
+func (a *AzureCLI) DeployTemplate(name string, parameters *Parameters) error {
+	client, err := a.ArmClient()
+	if err != nil {
+		return err
+	}
+	template, err := readTemplate()
+	if err != nil {
+		return err
+	}
+	if _, err := client.CreateDeployment(viper.GetString("RESOURCE_GROUP"), name, template,
+		parameters.Parameters); err != nil {
+		return errors.Wrap(err, "failed in creating the template deployment")
+	}
+	return nil
 }
 
-func NewPassword() (string, error) {
+func (a *AzureCLI) NewPassword() (string, error) {
 	fmt.Printf("Enter a New Password for '%s': ",
 		viper.GetString("AZURE_ADMIN_LOGIN_NAME"))
 	bytePassword, err := terminal.ReadPassword(int(syscall.Stdin))
 	if err != nil {
-		exe := exec.Command("sh", "-c", "az logout")
-		_ = exe.Run()
+		_ = a.Logout()
 		logrus.Fatal("Failed in reading the password")
 	}
 	password := string(bytePassword)
@@ -7,31 +7,13 @@ import (
 
 func main() {
 	generator := lib.SSLCertGenerator{
-		Days:         365,
-		Domain:       "corkbizdev.onmicrosoft.com",
-		Password:     "Forcepoint1",
-		TmpDirectory: "",
+		Days:     365,
+		Domain:   "corkbizdev.onmicrosoft.com",
+		Password: "Forcepoint1",
 	}
-	if err := generator.CreateTempFile(); err != nil {
+	if err := generator.Generate(); err != nil {
 		fmt.Println(err)
+		return
 	}
-	if err := generator.GeneratePrivateKey(); err != nil {
-		fmt.Println(err)
-	}
-	if err := generator.GeneratePublicKey(); err != nil {
-		fmt.Println(err)
-	}
-	if err := generator.GeneratePFX(); err != nil {
-		fmt.Println(err)
-	}
-	if err := generator.ConvertToBase64(); err != nil {
-		fmt.Println(err)
-	}
-	output, err := generator.OutputBase64()
-	if err != nil {
-		fmt.Println(err)
-	}
-	fmt.Println(string(output))
-	generator.CleanUp()
-
+	fmt.Println(generator.Base64())
 }